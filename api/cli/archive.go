@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func (r *Client) archiveUrl(path string, q url.Values) string {
+	u := r.base.JoinPath("archive", path)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// DownloadArchive writes the file or directory tree at path on the server
+// to w as archive of the format. Entries are selected by the include and
+// exclude globs matched against their relative path or base name. It
+// returns the size of the archive.
+func (r *Client) DownloadArchive(path string, format string, include, exclude []string, w io.Writer) (int64, error) {
+	q := url.Values{
+		"format":  {format},
+		"include": include,
+		"exclude": exclude,
+	}
+	resp, err := r.stream.Get(r.archiveUrl(path, q))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if !statusIsValid(resp) {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("archive: %v %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// UploadArchive extracts the archive of the format read from body into the
+// directory at path on the server, created if missing.
+func (r *Client) UploadArchive(path string, format string, body io.Reader, info *api.ArchiveInfo) error {
+	q := url.Values{
+		"format": {format},
+	}
+	req, err := http.NewRequest("POST", r.archiveUrl(path, q), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := r.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !statusIsValid(resp) {
+		return fmt.Errorf("archive: %v %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.Unmarshal(b, info)
+}
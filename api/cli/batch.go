@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// ErrNotRun is the error of calls of a batch not run after a failure.
+var ErrNotRun = errors.New("not run")
+
+// Batch collects fs calls to run in order in a single request.
+type Batch struct {
+	// StopOnError skips the calls after the first failure.
+	StopOnError bool
+
+	calls   []api.BatchCall
+	results []interface{}
+
+	// Errors has the error of each call once run, nil on success.
+	Errors []error
+}
+
+// Add appends the call, result is decoded as for the single call if not
+// nil. It returns the index of the call.
+func (b *Batch) Add(call string, args *api.CallArgs, result interface{}) int {
+	b.calls = append(b.calls, api.BatchCall{
+		Call: call,
+		Args: args,
+	})
+	b.results = append(b.results, result)
+	return len(b.calls) - 1
+}
+
+// Err returns the first error of the calls.
+func (b *Batch) Err() error {
+	for _, err := range b.Errors {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch runs the calls of b. The returned error is of the request, the
+// errors of the calls are in b.Errors.
+func (r *Client) Batch(b *Batch) error {
+	var results []api.CallResultRaw
+	err := r.fsContext(context.Background(), r.c, "batch", &api.BatchReq{
+		Calls:       b.calls,
+		StopOnError: b.StopOnError,
+	}, &results)
+	if err != nil {
+		return err
+	}
+
+	b.Errors = make([]error, len(b.calls))
+	for i := range b.calls {
+		if i >= len(results) {
+			b.Errors[i] = ErrNotRun
+			continue
+		}
+		b.Errors[i] = decodeResult(&results[i], b.results[i])
+	}
+	return nil
+}
+
+// Lstats returns the stat of each path in one round trip with the error of
+// each.
+func (r *Client) Lstats(paths []string) ([]syscall.Stat_t, []error, error) {
+	sts := make([]syscall.Stat_t, len(paths))
+
+	b := &Batch{}
+	for i, p := range paths {
+		b.Add("lstat", &api.CallArgs{Path: p}, &sts[i])
+	}
+	if err := r.Batch(b); err != nil {
+		return nil, nil, err
+	}
+	return sts, b.Errors, nil
+}
+
+func decodeResult(cr *api.CallResultRaw, result interface{}) error {
+	if cr.Status != OK {
+		return cr.Status
+	}
+	if !isNilInterface(result) {
+		return json.Unmarshal(cr.Data, result)
+	}
+	return nil
+}
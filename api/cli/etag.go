@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"bytes"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// The If variants run only if the file still matches the etag returned by
+// an earlier call, "*" for any existing file, and fail with
+// api.ErrConflict otherwise. They return the etag of the file after the
+// call. RenameIf, UnlinkIf and RmdirIf match the entry itself, which is the
+// etag of LstatETag for a symlink.
+
+// StatETag is like Stat and also returns the etag of the file.
+func (r *Client) StatETag(path string, rc *syscall.Stat_t) (string, error) {
+	return r.fsETag("stat", &api.CallArgs{
+		Path: path,
+	}, rc)
+}
+
+// LstatETag is like Lstat and also returns the etag of the entry.
+func (r *Client) LstatETag(path string, rc *syscall.Stat_t) (string, error) {
+	return r.fsETag("lstat", &api.CallArgs{
+		Path: path,
+	}, rc)
+}
+
+// WriteIf writes data to the file at offset. Large data is uploaded as blob
+// with the precondition checked again on the upload, which returns the
+// etag. No data is written inline, only checked against etag.
+func (r *Client) WriteIf(path string, data []byte, offset int64, etag string) (string, error) {
+	r.negotiate()
+
+	size := int64(len(data))
+	args := &api.CallArgs{
+		Path:    path,
+		IfMatch: etag,
+		Attr: &api.Attr{
+			Offset: &offset,
+			Size:   &size,
+		},
+	}
+	if size <= r.inline {
+		args.Data = data
+	}
+
+	var bi api.BlobInfo
+	etag, err := r.fsETag("write", args, &bi)
+	if err != nil || bi.Href == "" {
+		return etag, err
+	}
+	result, err := r.upload(bi.Href, bytes.NewReader(data), size)
+	if err != nil {
+		return "", err
+	}
+	return result.ETag, nil
+}
+
+func (r *Client) TruncateIf(path string, size int64, etag string) (string, error) {
+	return r.fsETag("truncate", &api.CallArgs{
+		Path:    path,
+		IfMatch: etag,
+		Attr: &api.Attr{
+			Size: &size,
+		},
+	}, nil)
+}
+
+func (r *Client) SetattrIf(path string, attr *api.Attr, etag string, rc *syscall.Stat_t) (string, error) {
+	return r.fsETag("setattr", &api.CallArgs{
+		Path:    path,
+		IfMatch: etag,
+		Attr:    attr,
+	}, rc)
+}
+
+func (r *Client) RenameIf(path string, to string, etag string) (string, error) {
+	return r.fsETag("rename", &api.CallArgs{
+		Path:    path,
+		To:      to,
+		IfMatch: etag,
+	}, nil)
+}
+
+func (r *Client) UnlinkIf(path string, etag string) error {
+	_, err := r.fsETag("unlink", &api.CallArgs{
+		Path:    path,
+		IfMatch: etag,
+	}, nil)
+	return err
+}
+
+func (r *Client) RmdirIf(path string, etag string) error {
+	_, err := r.fsETag("rmdir", &api.CallArgs{
+		Path:    path,
+		IfMatch: etag,
+	}, nil)
+	return err
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// MkdirAll creates the directory along with any missing parents.
+func (r *Client) MkdirAll(path string, mode uint32, rc *syscall.Stat_t) error {
+	return r.fs("mkdir", &api.CallArgs{
+		Path:      path,
+		Recursive: true,
+		Attr: &api.Attr{
+			Mode: &mode,
+		},
+	}, rc)
+}
+
+// RemoveAll starts a job on the server removing the file or directory tree.
+func (r *Client) RemoveAll(path string, job *api.Job) error {
+	return r.fs("unlink", &api.CallArgs{
+		Path:      path,
+		Recursive: true,
+	}, job)
+}
+
+// CopyAll starts a job on the server copying the file or directory tree.
+func (r *Client) CopyAll(path string, to string, job *api.Job) error {
+	return r.fs("copy", &api.CallArgs{
+		Path:      path,
+		To:        to,
+		Recursive: true,
+	}, job)
+}
+
+// ChmodAll starts a job on the server changing the mode of the tree.
+func (r *Client) ChmodAll(path string, mode uint32, job *api.Job) error {
+	return r.fs("chmod", &api.CallArgs{
+		Path:      path,
+		Recursive: true,
+		Attr: &api.Attr{
+			Mode: &mode,
+		},
+	}, job)
+}
+
+// ChownAll starts a job on the server changing the owner of the tree.
+func (r *Client) ChownAll(path string, uid, gid int, job *api.Job) error {
+	return r.fs("chown", &api.CallArgs{
+		Path:      path,
+		Recursive: true,
+		Attr: &api.Attr{
+			Owner: &api.Owner{
+				Uid: uid,
+				Gid: gid,
+			},
+		},
+	}, job)
+}
+
+func (r *Client) Job(id string, job *api.Job) error {
+	return r.fs("job", &api.CallArgs{
+		Job: id,
+	}, job)
+}
+
+func (r *Client) Jobs(jobs *[]api.Job) error {
+	return r.fs("jobs", &api.CallArgs{}, jobs)
+}
+
+func (r *Client) CancelJob(id string) error {
+	return r.fs("canceljob", &api.CallArgs{
+		Job: id,
+	}, nil)
+}
+
+// WaitJob polls the job at interval until it is finished and returns the
+// status of a failed job. fn if set is called with the progress of each
+// poll. The job is canceled if ctx is done.
+func (r *Client) WaitJob(ctx context.Context, id string, interval time.Duration, fn func(job *api.Job)) (*api.Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var job api.Job
+		if err := r.Job(id, &job); err != nil {
+			return nil, err
+		}
+		if fn != nil {
+			fn(&job)
+		}
+		switch job.State {
+		case api.Done:
+			return &job, nil
+		case api.Failed:
+			return &job, job.Status
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			r.CancelJob(id)
+			return &job, ctx.Err()
+		}
+	}
+}
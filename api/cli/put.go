@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// Put atomically replaces the whole file on the server with size bytes of
+// body, any length if negative, or with the file opts.From on the server if
+// body is nil. Readers never see a partial file, the file is unchanged if
+// the upload fails. It returns the etag of the new file, a failed
+// precondition fails with api.ErrConflict. With opts.Tx the file is only
+// staged in the transaction.
+func (r *Client) Put(path string, body io.Reader, size int64, opts *api.PutOptions, rc *syscall.Stat_t) (string, error) {
+	if opts == nil {
+		opts = &api.PutOptions{}
+	}
+	q := url.Values{
+		"path": {path},
+	}
+	if opts.Perm != nil {
+		q.Set("perm", strconv.FormatUint(uint64(*opts.Perm), 8))
+	}
+	if opts.Owner != nil {
+		q.Set("uid", strconv.Itoa(opts.Owner.Uid))
+		q.Set("gid", strconv.Itoa(opts.Owner.Gid))
+	}
+	if opts.Sync {
+		q.Set("sync", "true")
+	}
+	if opts.From != "" {
+		q.Set("from", opts.From)
+	}
+	if opts.Tx != "" {
+		q.Set("tx", opts.Tx)
+	}
+	u := r.base.JoinPath("fs", "put")
+	u.RawQuery = q.Encode()
+
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	if size >= 0 {
+		body = io.LimitReader(body, size)
+	}
+	hash := sha256.New()
+	tb := &trailerBody{Reader: io.TeeReader(body, hash)}
+	req, err := http.NewRequest("PUT", u.String(), tb)
+	if err != nil {
+		return "", err
+	}
+	// chunked for sending the trailer
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(api.ClientHeader, r.id)
+	if opts.IfMatch != "" {
+		req.Header.Set("If-Match", opts.IfMatch)
+	}
+	req.Trailer = http.Header{}
+	req.Trailer.Set(api.ChecksumHeader, "")
+	tb.done = func() {
+		req.Trailer.Set(api.ChecksumHeader, hex.EncodeToString(hash.Sum(nil)))
+	}
+
+	resp, err := r.stream.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if !statusIsValid(resp) {
+		return "", fmt.Errorf("put: %v %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var cr api.CallResultRaw
+	if err := json.Unmarshal(b, &cr); err != nil {
+		return "", err
+	}
+	return cr.ETag, decodeResult(&cr, rc)
+}
@@ -1,22 +1,29 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/dhnt/nomad/api"
+
+	"github.com/google/uuid"
 )
 
 const (
@@ -24,10 +31,24 @@ const (
 	ERR = syscall.Errno(0xff)
 )
 
+// DefaultInline is the max size of data the client transfers inline unless
+// the server supports less.
+const DefaultInline = 128 * 1024
+
 type Client struct {
 	base *url.URL
 
+	// client id owning the open file handles
+	id string
+
+	// max size of data transferred inline, negotiated with the server
+	inline     int64
+	negotiated sync.Once
+
 	c *http.Client
+
+	// client without timeout for streaming blobs
+	stream *http.Client
 }
 
 func NewClient(baseUrl string) (*Client, error) {
@@ -42,9 +63,18 @@ func NewClient(baseUrl string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	stream := c
+	stream.Timeout = 0
 	return &Client{
-		base: u,
-		c:    &c,
+		base:   u,
+		id:     id.String(),
+		inline: DefaultInline,
+		c:      &c,
+		stream: &stream,
 	}, nil
 }
 
@@ -182,25 +212,179 @@ func (r *Client) Kill(id string) error {
 	return nil
 }
 
+func (r *Client) Heartbeat(id string) error {
+	log.Printf("heartbeat: %v", id)
+
+	u, err := r.base.Parse("/procs/" + id + "/heartbeat")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return api.ErrorNotFound{
+			Status: resp.Status,
+		}
+	}
+
+	if !statusIsValid(resp) {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
+
+// do sends a request of method to ref with the JSON encoding of body if not
+// nil and decodes the response into result if not nil.
+func (r *Client) do(method string, ref string, body interface{}, result interface{}) error {
+	u, err := r.base.Parse(ref)
+	if err != nil {
+		return err
+	}
+
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u.String(), rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return api.ErrorNotFound{
+			Status: resp.Status,
+		}
+	}
+
+	if !statusIsValid(resp) {
+		return errors.New(resp.Status)
+	}
+
+	if isNilInterface(result) {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+func (r *Client) CreateSession(s *api.Session, result *api.Session) error {
+	log.Printf("create session: %v", s)
+
+	return r.do("POST", "/sessions/", s, result)
+}
+
+func (r *Client) Session(id string, result *api.Session) error {
+	log.Printf("session: %v", id)
+
+	return r.do("GET", "/sessions/"+id, nil, result)
+}
+
+func (r *Client) Sessions(result *[]api.Session) error {
+	log.Printf("sessions")
+
+	return r.do("GET", "/sessions/", nil, result)
+}
+
+func (r *Client) CloseSession(id string) error {
+	log.Printf("close session: %v", id)
+
+	return r.do("DELETE", "/sessions/"+id, nil, nil)
+}
+
+// SessionExec runs the request in the session of id using the cwd and env
+// kept on the server.
+func (r *Client) SessionExec(id string, request *api.RunReq, result *api.RunResult) error {
+	log.Printf("session exec: %v %v", id, request)
+
+	return r.do("POST", "/sessions/"+id+"/procs/", request, result)
+}
+
+func (r *Client) Templates(result *[]api.TemplateInfo) error {
+	log.Printf("templates")
+
+	return r.do("GET", "/procs/templates/", nil, result)
+}
+
+// ExecTemplate runs the template of name registered on the server.
+func (r *Client) ExecTemplate(name string, request *api.TemplateReq, result *api.RunResult) error {
+	log.Printf("exec template: %v %v", name, request)
+
+	return r.do("POST", "/procs/templates/"+url.PathEscape(name), request, result)
+}
+
 func (r *Client) fs(call string, args *api.CallArgs, result interface{}) error {
+	return r.fsContext(context.Background(), r.c, call, args, result)
+}
+
+// fsETag is like fs but also returns the etag of the file of the call.
+func (r *Client) fsETag(call string, args *api.CallArgs, result interface{}) (string, error) {
+	cr, err := r.post(context.Background(), r.c, call, args)
+	if err != nil {
+		return "", err
+	}
+	return cr.ETag, decodeResult(cr, result)
+}
+
+// fsContext is like fs but with the context and http client of the request.
+// args is the request body, api.CallArgs except for batch.
+func (r *Client) fsContext(ctx context.Context, c *http.Client, call string, args interface{}, result interface{}) error {
+	cr, err := r.post(ctx, c, call, args)
+	if err != nil {
+		return err
+	}
+	return decodeResult(cr, result)
+}
+
+// post sends the fs call and returns the undecoded result.
+func (r *Client) post(ctx context.Context, c *http.Client, call string, args interface{}) (*api.CallResultRaw, error) {
 	log.Printf("%v: %v", call, args)
 	ref := fmt.Sprintf("/fs/%s", strings.ToLower(call))
 
 	u, err := r.base.Parse(ref)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	b, err := json.Marshal(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	blen := len(b)
 	body := bytes.NewReader(b)
 
-	req, err := http.NewRequest("POST", u.String(), body)
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if blen >= 0 {
 		if blen == 0 {
@@ -211,35 +395,27 @@ func (r *Client) fs(call string, args *api.CallArgs, result interface{}) error {
 		req.ContentLength = int64(blen)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(api.ClientHeader, r.id)
 
-	resp, err := r.c.Do(req)
+	resp, err := c.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if !statusIsValid(resp) {
-		return errors.New(resp.Status)
+		return nil, errors.New(resp.Status)
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var cr api.CallResultRaw
 	if err := json.Unmarshal(data, &cr); err != nil {
-		return err
-	}
-	if cr.Status != OK {
-		return cr.Status
-	}
-
-	if !isNilInterface(result) {
-		if err := json.Unmarshal(cr.Data, result); err != nil {
-			return err
-		}
+		return nil, err
 	}
-	return nil
+	return &cr, nil
 }
 
 func (r *Client) Statfs(path string, rc *syscall.Statfs_t) error {
@@ -267,13 +443,23 @@ func (r *Client) Setattr(path string, attr *api.Attr, rc *syscall.Stat_t) error
 	}, rc)
 }
 
+// ReaddirPlus reads a page of at most count entries with stat after the
+// cookie of the previous page, 0 for the first.
+func (r *Client) ReaddirPlus(path string, cookie int64, count int, page *api.DirPage) error {
+	return r.fs("readdirplus", &api.CallArgs{
+		Path:   path,
+		Cookie: cookie,
+		Count:  count,
+	}, page)
+}
+
 func (r *Client) Readdir(path string, rc *[]api.DirEntry) error {
 	return r.fs("readdir", &api.CallArgs{
 		Path: path,
 	}, rc)
 }
 
-func (r *Client) Open(path string, mode uint32, perm uint32, rc *syscall.Stat_t) error {
+func (r *Client) Open(path string, mode uint32, perm uint32, rc *api.FileHandle) error {
 	return r.fs("open", &api.CallArgs{
 		Path: path,
 		Attr: &api.Attr{
@@ -283,7 +469,7 @@ func (r *Client) Open(path string, mode uint32, perm uint32, rc *syscall.Stat_t)
 	}, rc)
 }
 
-func (r *Client) Create(path string, mode uint32, perm uint32, rc *syscall.Stat_t) error {
+func (r *Client) Create(path string, mode uint32, perm uint32, rc *api.FileHandle) error {
 	return r.fs("create", &api.CallArgs{
 		Path: path,
 		Attr: &api.Attr{
@@ -293,6 +479,51 @@ func (r *Client) Create(path string, mode uint32, perm uint32, rc *syscall.Stat_
 	}, rc)
 }
 
+// Release closes the open file handle.
+func (r *Client) Release(fh string) error {
+	return r.fs("release", &api.CallArgs{
+		Handle: fh,
+	}, nil)
+}
+
+func (r *Client) Fsync(fh string) error {
+	return r.fs("fsync", &api.CallArgs{
+		Handle: fh,
+	}, nil)
+}
+
+func (r *Client) Fstat(fh string, rc *syscall.Stat_t) error {
+	return r.fs("stat", &api.CallArgs{
+		Handle: fh,
+	}, rc)
+}
+
+func (r *Client) Fsetattr(fh string, attr *api.Attr, rc *syscall.Stat_t) error {
+	return r.fs("setattr", &api.CallArgs{
+		Handle: fh,
+		Attr:   attr,
+	}, rc)
+}
+
+func (r *Client) Ftruncate(fh string, size int64) error {
+	return r.fs("truncate", &api.CallArgs{
+		Handle: fh,
+		Attr: &api.Attr{
+			Size: &size,
+		},
+	}, nil)
+}
+
+// Keepalive renews the lease of the open file handles of the client.
+func (r *Client) Keepalive() error {
+	return r.fs("keepalive", &api.CallArgs{}, nil)
+}
+
+// Disconnect closes all open file handles of the client.
+func (r *Client) Disconnect() error {
+	return r.fs("disconnect", &api.CallArgs{}, nil)
+}
+
 func (r *Client) Opendir(path string) error {
 	return r.fs("opendir", &api.CallArgs{
 		Path: path,
@@ -387,6 +618,17 @@ func (r *Client) Read(path string, offset, size int64, info *api.BlobInfo) error
 	}, info)
 }
 
+// Pread is like Read but on the open file handle.
+func (r *Client) Pread(fh string, offset, size int64, info *api.BlobInfo) error {
+	return r.fs("read", &api.CallArgs{
+		Handle: fh,
+		Attr: &api.Attr{
+			Offset: &offset,
+			Size:   &size,
+		},
+	}, info)
+}
+
 func (r *Client) Mknod(path string, mode uint32, rc *syscall.Stat_t) error {
 	return r.fs("mknod", &api.CallArgs{
 		Path: path,
@@ -396,6 +638,162 @@ func (r *Client) Mknod(path string, mode uint32, rc *syscall.Stat_t) error {
 	}, rc)
 }
 
+// Fallocate allocates or with FALLOC_FL_* flags in mode deallocates the
+// range of the open file handle.
+func (r *Client) Fallocate(fh string, offset, size int64, mode int) error {
+	return r.fs("fallocate", &api.CallArgs{
+		Handle: fh,
+		Flags:  mode,
+		Attr: &api.Attr{
+			Offset: &offset,
+			Size:   &size,
+		},
+	}, nil)
+}
+
+// CopyFileRange copies the range between open file handles on the server.
+func (r *Client) CopyFileRange(fhIn string, offIn int64, fhOut string, offOut int64, size int64, n *int64) error {
+	return r.fs("copy", &api.CallArgs{
+		Handle:   fhIn,
+		ToHandle: fhOut,
+		ToOffset: offOut,
+		Attr: &api.Attr{
+			Offset: &offIn,
+			Size:   &size,
+		},
+	}, n)
+}
+
+// Copy copies the whole file on the server replacing the destination.
+func (r *Client) Copy(path string, to string, n *int64) error {
+	return r.fs("copy", &api.CallArgs{
+		Path: path,
+		To:   to,
+	}, n)
+}
+
+// Checksum returns the sums of the ranges of the file computed on the server
+// with the hash algorithm, or of the whole file if no ranges are given.
+func (r *Client) Checksum(path string, hash string, ranges []api.Range, sums *[]api.Checksum) error {
+	return r.fs("checksum", &api.CallArgs{
+		Path:   path,
+		Hash:   hash,
+		Ranges: ranges,
+	}, sums)
+}
+
+// Getlk returns a lock conflicting with lk on the open file handle or one
+// of type F_UNLCK in out.
+func (r *Client) Getlk(fh string, lk *api.Lock, out *api.Lock) error {
+	return r.fs("getlk", &api.CallArgs{
+		Handle: fh,
+		Lock:   lk,
+	}, out)
+}
+
+func (r *Client) Setlk(fh string, lk *api.Lock) error {
+	return r.fs("setlk", &api.CallArgs{
+		Handle: fh,
+		Lock:   lk,
+	}, nil)
+}
+
+// Setlkw is like Setlk but waits for conflicting locks to be released
+// until ctx is done.
+func (r *Client) Setlkw(ctx context.Context, fh string, lk *api.Lock) error {
+	return r.fsContext(ctx, r.stream, "setlkw", &api.CallArgs{
+		Handle: fh,
+		Lock:   lk,
+	}, nil)
+}
+
+func (r *Client) Getxattr(path string, name string, value *[]byte) error {
+	return r.fs("getxattr", &api.CallArgs{
+		Path: path,
+		Name: name,
+	}, value)
+}
+
+func (r *Client) Setxattr(path string, name string, value []byte, flags int) error {
+	return r.fs("setxattr", &api.CallArgs{
+		Path:  path,
+		Name:  name,
+		Value: value,
+		Flags: flags,
+	}, nil)
+}
+
+func (r *Client) Listxattr(path string, names *[]string) error {
+	return r.fs("listxattr", &api.CallArgs{
+		Path: path,
+	}, names)
+}
+
+func (r *Client) Removexattr(path string, name string) error {
+	return r.fs("removexattr", &api.CallArgs{
+		Path: path,
+		Name: name,
+	}, nil)
+}
+
+// Watch calls fn for the change events of the path, including
+// subdirectories if recursive is set, until ctx is done or the stream ends.
+// ready if not nil is called once the stream is established. It fails with
+// ENOSPC if the server does not watch that many directories.
+func (r *Client) Watch(ctx context.Context, path string, recursive bool, ready func(), fn func(e *api.Event)) error {
+	u, err := r.base.Parse("/fs/watch")
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("path", path)
+	q.Set("recursive", strconv.FormatBool(recursive))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(api.ClientHeader, r.id)
+
+	resp, err := r.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return syscall.ENOSPC
+	}
+	if !statusIsValid(resp) {
+		return errors.New(resp.Status)
+	}
+	if ready != nil {
+		ready()
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e api.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+		if e.Op == api.EventLimit {
+			return syscall.ENOSPC
+		}
+		fn(&e)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return sc.Err()
+}
+
 func (r *Client) Download(href string, data []byte) (int, error) {
 	log.Printf("download: %v len: %v", href, len(data))
 	resp, err := r.c.Get(href)
@@ -422,48 +820,218 @@ func (r *Client) Write(path string, offset, size int64, info *api.BlobInfo) erro
 	}, info)
 }
 
-func (r *Client) Upload(href string, data []byte) (int, error) {
-	log.Printf("upload: %v len: %v", href, len(data))
+// Pwrite is like Write but on the open file handle.
+func (r *Client) Pwrite(fh string, offset, size int64, info *api.BlobInfo) error {
+	return r.fs("write", &api.CallArgs{
+		Handle: fh,
+		Attr: &api.Attr{
+			Offset: &offset,
+			Size:   &size,
+		},
+	}, info)
+}
+
+// negotiate lowers the inline max to the one advertised by the server.
+func (r *Client) negotiate() {
+	r.negotiated.Do(func() {
+		u, err := r.base.Parse("/fs/")
+		if err != nil {
+			return
+		}
+		req, err := http.NewRequest("OPTIONS", u.String(), nil)
+		if err != nil {
+			return
+		}
+		resp, err := r.c.Do(req)
+		if err != nil {
+			log.Printf("negotiate: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		max, err := strconv.ParseInt(resp.Header.Get(api.InlineHeader), 10, 64)
+		if err != nil {
+			// not supported by the server
+			max = 0
+		}
+		if max < r.inline {
+			r.inline = max
+		}
+		log.Printf("inline: %v", r.inline)
+	})
+}
+
+// ReadAt reads from the open file handle at offset. Small reads are
+// transferred inline, others are downloaded as blob. Holes are filled with
+// zeros without transfer.
+func (r *Client) ReadAt(fh string, buf []byte, offset int64) (int, error) {
+	r.negotiate()
+
+	var n int
+	for n < len(buf) {
+		sz, err := r.readExtent(fh, buf[n:], offset+int64(n))
+		n += sz
+		if err != nil {
+			if n > 0 {
+				break
+			}
+			return 0, err
+		}
+		if sz == 0 {
+			// end of file
+			break
+		}
+	}
+	return n, nil
+}
 
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	fw, err := w.CreateFormFile("blob", "blob")
+// readExtent reads up to the next change between data and hole.
+func (r *Client) readExtent(fh string, buf []byte, offset int64) (int, error) {
+	size := int64(len(buf))
+	var bi api.BlobInfo
+	err := r.fs("read", &api.CallArgs{
+		Handle: fh,
+		Inline: r.inline,
+		Holes:  true,
+		Attr: &api.Attr{
+			Offset: &offset,
+			Size:   &size,
+		},
+	}, &bi)
 	if err != nil {
 		return 0, err
 	}
 
-	dr := bytes.NewReader(data)
-	if _, err := io.Copy(fw, dr); err != nil {
-		return 0, err
+	switch {
+	case bi.Size <= 0:
+		return 0, nil
+	case bi.Hole:
+		for i := range buf[:bi.Size] {
+			buf[i] = 0
+		}
+		return int(bi.Size), nil
+	case bi.Href == "":
+		return copy(buf, bi.Data), nil
 	}
+	return r.Download(bi.Href, buf[:bi.Size])
+}
 
-	w.Close()
+// Lseek returns the offset of the next data or hole of the open file handle
+// with whence api.SeekData or api.SeekHole.
+func (r *Client) Lseek(fh string, offset int64, whence int, result *int64) error {
+	return r.fs("lseek", &api.CallArgs{
+		Handle: fh,
+		Flags:  whence,
+		Attr: &api.Attr{
+			Offset: &offset,
+		},
+	}, result)
+}
 
-	//
-	req, err := http.NewRequest("POST", href, &buf)
-	if err != nil {
+// WriteAt writes data to the open file handle at offset. Small writes are
+// transferred inline, others are uploaded as blob.
+func (r *Client) WriteAt(fh string, data []byte, offset int64) (int, error) {
+	size := int64(len(data))
+	if size == 0 {
+		// writes nothing like write(2) of a regular file
+		return 0, nil
+	}
+	r.negotiate()
+
+	args := &api.CallArgs{
+		Handle: fh,
+		Attr: &api.Attr{
+			Offset: &offset,
+			Size:   &size,
+		},
+	}
+	if size <= r.inline {
+		args.Data = data
+	}
+
+	var bi api.BlobInfo
+	if err := r.fs("write", args, &bi); err != nil {
 		return 0, err
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	resp, err := r.c.Do(req)
+	if bi.Href == "" {
+		return int(bi.Size), nil
+	}
+	n, err := r.Upload(bi.Href, bytes.NewReader(data), size)
+	return int(n), err
+}
+
+// Upload streams size bytes of body to the blob href, all of it if size is
+// negative. The sha256 of the data is sent in the trailer for verification
+// by the server.
+func (r *Client) Upload(href string, body io.Reader, size int64) (int64, error) {
+	result, err := r.upload(href, body, size)
 	if err != nil {
 		return 0, err
 	}
+	return result.N, nil
+}
+
+func (r *Client) upload(href string, body io.Reader, size int64) (*api.BlobResult, error) {
+	log.Printf("upload: %v size: %v", href, size)
+
+	hash := sha256.New()
+	if size >= 0 {
+		body = io.LimitReader(body, size)
+	}
+	tb := &trailerBody{Reader: io.TeeReader(body, hash)}
+	req, err := http.NewRequest("PUT", href, tb)
+	if err != nil {
+		return nil, err
+	}
+	// chunked for sending the trailer
+	req.ContentLength = -1
+	if size > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%v/*", size-1))
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Trailer = http.Header{}
+	req.Trailer.Set(api.ChecksumHeader, "")
+
+	// the trailer is written after the body is read
+	tb.done = func() {
+		req.Trailer.Set(api.ChecksumHeader, hex.EncodeToString(hash.Sum(nil)))
+	}
+
+	resp, err := r.stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	type BlobResult struct {
-		N int
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, api.ErrConflict
 	}
-	var result BlobResult
+	if !statusIsValid(resp) {
+		return nil, fmt.Errorf("upload: %v %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var result api.BlobResult
 	if err := json.Unmarshal(b, &result); err != nil {
-		return 0, err
+		return nil, err
 	}
+	return &result, nil
+}
 
-	return result.N, nil
+// trailerBody calls done at the end of the body.
+type trailerBody struct {
+	io.Reader
+	done func()
+}
+
+func (t *trailerBody) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if err == io.EOF {
+		t.done()
+	}
+	return n, err
 }
 
 func statusIsValid(resp *http.Response) bool {
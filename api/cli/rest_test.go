@@ -3,6 +3,8 @@ package cli
 import (
 	"syscall"
 	"testing"
+
+	"github.com/dhnt/nomad/api"
 )
 
 func TestStatfs(t *testing.T) {
@@ -80,3 +82,35 @@ func TestIsNilInterface(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteEmpty(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test...")
+	}
+
+	cli, err := NewClient("http://localhost:58080/")
+	if err != nil {
+		t.FailNow()
+	}
+
+	var h api.FileHandle
+	if err := cli.Create("/test/empty", syscall.O_RDWR|syscall.O_TRUNC, 0644, &h); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cli.Release(h.ID)
+	if n, err := cli.WriteAt(h.ID, nil, 0); n != 0 || err != nil {
+		t.Fatalf("%v %v", n, err)
+	}
+
+	var st syscall.Stat_t
+	etag, err := cli.StatETag("/test/empty", &st)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got, err := cli.WriteIf("/test/empty", []byte{}, 0, etag); got != etag || err != nil {
+		t.Fatalf("%v %v", got, err)
+	}
+	if _, err := cli.WriteIf("/test/empty", nil, 0, `"x"`); err != api.ErrConflict {
+		t.Fatalf("conflict: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"github.com/dhnt/nomad/api"
+)
+
+// Snapshot starts a job on the server capturing the file or directory tree
+// as the snapshot of the name, readable under /.snapshots/<name>/. The
+// method is api.SnapshotCopy if empty.
+func (r *Client) Snapshot(name string, path string, method string, job *api.Job) error {
+	return r.fs("snapshot", &api.CallArgs{
+		Snapshot: name,
+		Path:     path,
+		Method:   method,
+	}, job)
+}
+
+func (r *Client) Snapshots(snapshots *[]api.Snapshot) error {
+	return r.fs("snapshots", &api.CallArgs{}, snapshots)
+}
+
+func (r *Client) DeleteSnapshot(name string) error {
+	return r.fs("deletesnapshot", &api.CallArgs{
+		Snapshot: name,
+	}, nil)
+}
+
+// RestoreSnapshot starts a job on the server restoring the file or tree at
+// path in the snapshot to where it was captured, or to the path to if set.
+// What is there is replaced.
+func (r *Client) RestoreSnapshot(name string, path string, to string, job *api.Job) error {
+	return r.fs("restoresnapshot", &api.CallArgs{
+		Snapshot: name,
+		Path:     path,
+		To:       to,
+	}, job)
+}
@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// Trash returns the deleted entries kept on the server, oldest first. It
+// fails with ENOTSUP if the server does not keep them.
+func (r *Client) Trash(entries *[]api.TrashEntry) error {
+	return r.fs("trash", &api.CallArgs{}, entries)
+}
+
+// RestoreTrash moves the deleted entry back to its path, or to the path to
+// if set. It fails with EEXIST if the path exists.
+func (r *Client) RestoreTrash(id string, to string, rc *syscall.Stat_t) error {
+	return r.fs("restore", &api.CallArgs{
+		Trash: id,
+		To:    to,
+	}, rc)
+}
+
+// PurgeTrash removes the deleted entry for good, all for "*".
+func (r *Client) PurgeTrash(id string) error {
+	return r.fs("purge", &api.CallArgs{
+		Trash: id,
+	}, nil)
+}
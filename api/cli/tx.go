@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"github.com/dhnt/nomad/api"
+)
+
+// BeginTx opens a transaction on the server. Files are staged with Put and
+// opts.Tx and TxDelete, and replaced together by CommitTx.
+func (r *Client) BeginTx(tx *api.Tx) error {
+	return r.fs("txbegin", &api.CallArgs{}, tx)
+}
+
+func (r *Client) Tx(id string, tx *api.Tx) error {
+	return r.fs("tx", &api.CallArgs{
+		Tx: id,
+	}, tx)
+}
+
+func (r *Client) Txs(txs *[]api.Tx) error {
+	return r.fs("txs", &api.CallArgs{}, txs)
+}
+
+// TxDelete stages the removal of the file or directory tree, if it still
+// matches the etag on commit unless empty.
+func (r *Client) TxDelete(id string, path string, ifMatch string) error {
+	return r.fs("txdelete", &api.CallArgs{
+		Tx:      id,
+		Path:    path,
+		IfMatch: ifMatch,
+	}, nil)
+}
+
+// CommitTx applies the staged files all or none. The transaction is closed
+// either way.
+func (r *Client) CommitTx(id string) error {
+	return r.fs("txcommit", &api.CallArgs{
+		Tx: id,
+	}, nil)
+}
+
+func (r *Client) AbortTx(id string) error {
+	return r.fs("txabort", &api.CallArgs{
+		Tx: id,
+	}, nil)
+}
@@ -0,0 +1,519 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// ErrArchivePath is returned for archive entries escaping the directory.
+var ErrArchivePath = errors.New("invalid archive path")
+
+// ArchiveFilter selects the entries of an archive by globs matched against
+// the slash separated path relative to the archived directory or against
+// the base name. Excluded directories are skipped entirely. If there are
+// includes, only the files matching one are archived, without entries of
+// their directories.
+type ArchiveFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Validate returns path.ErrBadPattern if any glob is malformed.
+func (f *ArchiveFilter) Validate() error {
+	for _, p := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseArchiveFormat returns the format of the name, tar if empty.
+func ParseArchiveFormat(s string) (string, error) {
+	switch s {
+	case "", api.ArchiveTar:
+		return api.ArchiveTar, nil
+	case api.ArchiveTgz, "tar.gz":
+		return api.ArchiveTgz, nil
+	case api.ArchiveZip:
+		return api.ArchiveZip, nil
+	}
+	return "", fmt.Errorf("unknown archive format: %q", s)
+}
+
+type archiveWriter interface {
+	// add writes the entry, r is the content of regular files
+	add(name string, fi fs.FileInfo, link string, r io.Reader) error
+	Close() error
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarWriter) add(name string, fi fs.FileInfo, link string, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r != nil {
+		_, err = io.Copy(t.tw, r)
+	}
+	return err
+}
+
+func (t *tarWriter) Close() error {
+	err := t.tw.Close()
+	if t.gz != nil {
+		if cerr := t.gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) add(name string, fi fs.FileInfo, link string, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	w, err := z.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	// the target is the content of symlinks
+	if link != "" {
+		r = strings.NewReader(link)
+	}
+	if r != nil {
+		_, err = io.Copy(w, r)
+	}
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// WriteArchive writes the file or the directory tree at dir to w in the
+// format. Names are relative to dir, the base name for a file. Symlinks are
+// archived as such, special files are skipped.
+func WriteArchive(w io.Writer, dir string, format string, filter *ArchiveFilter) error {
+	return writeArchive(w, dir, filepath.Base(dir), format, filter, "")
+}
+
+// Archive writes the file or the directory tree at rel to w as WriteArchive,
+// a file named by the base name of rel. The state of the server is left
+// out.
+func (n *FileNode) Archive(w io.Writer, rel string, format string, filter *ArchiveFilter) error {
+	dir, err := n.path(rel)
+	if err != nil {
+		return err
+	}
+	return writeArchive(w, dir, filepath.Base(rel), format, filter, filepath.Join(n.Root, stateDir))
+}
+
+// writeArchive writes the archive of dir, named name if a file, without the
+// tree at skip.
+func writeArchive(w io.Writer, dir string, name string, format string, filter *ArchiveFilter, skip string) error {
+	var aw archiveWriter
+	switch format {
+	case api.ArchiveTar:
+		aw = &tarWriter{tw: tar.NewWriter(w)}
+	case api.ArchiveTgz:
+		gz := gzip.NewWriter(w)
+		aw = &tarWriter{tw: tar.NewWriter(gz), gz: gz}
+	case api.ArchiveZip:
+		aw = &zipWriter{zw: zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format: %q", format)
+	}
+	if filter == nil {
+		filter = &ArchiveFilter{}
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	base := dir
+	if !fi.IsDir() {
+		base = filepath.Dir(dir)
+	}
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == skip && d.IsDir() {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if p == dir && !d.IsDir() {
+			rel = name
+		}
+		rel = filepath.ToSlash(rel)
+
+		if matchAny(filter.Exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(filter.Include) > 0 && (d.IsDir() || !matchAny(filter.Include, rel)) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			return aw.add(rel, fi, "", nil)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return aw.add(rel, fi, link, nil)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return aw.add(rel, fi, "", f)
+		}
+		return nil
+	})
+	if cerr := aw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// extractor creates the entries of an archive under dir.
+type extractor struct {
+	dir  string
+	info api.ArchiveInfo
+
+	// tree entries must not be created in
+	skip string
+
+	// modes and times of directories, set last as they may deny writes
+	dirs []dirMeta
+}
+
+type dirMeta struct {
+	path  string
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+// path returns the path of the entry name. Names must be relative and must
+// not lead out of dir, neither by dot dot nor through existing symlinks.
+func (x *extractor) path(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", ErrArchivePath, name)
+	}
+
+	p := filepath.Join(x.dir, rel)
+	if x.skip != "" && (p == x.skip || strings.HasPrefix(p, x.skip+string(filepath.Separator))) {
+		return "", fmt.Errorf("%w: %q", ErrArchivePath, name)
+	}
+	if err := checkSymlinks(x.dir, filepath.Dir(rel)); err != nil {
+		return "", fmt.Errorf("%w: %q", err, name)
+	}
+	return p, nil
+}
+
+// checkSymlinks fails with ErrArchivePath if an existing component of the
+// relative path rel under dir is a symlink.
+func checkSymlinks(dir string, rel string) error {
+	p := dir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		if c == "" || c == "." {
+			continue
+		}
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: through symlink %q", ErrArchivePath, c)
+		}
+	}
+	return nil
+}
+
+// prepare creates the parents of p and removes an existing non directory.
+func prepare(p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+		return os.Remove(p)
+	}
+	return nil
+}
+
+// extractMode returns the permission bits of the mode of an entry including
+// setuid, setgid and sticky, as set by os.Chmod.
+func extractMode(mode fs.FileMode) fs.FileMode {
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
+
+func (x *extractor) mkdir(p string, mode fs.FileMode, mtime time.Time) error {
+	// a symlink in place is replaced, not followed
+	if err := prepare(p); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p, 0700); err != nil {
+		return err
+	}
+	x.dirs = append(x.dirs, dirMeta{p, extractMode(mode), mtime})
+	x.info.Files++
+	return nil
+}
+
+func (x *extractor) file(p string, mode fs.FileMode, mtime time.Time, r io.Reader) error {
+	if err := prepare(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	x.info.Files++
+	x.info.Bytes += n
+
+	if err := os.Chmod(p, extractMode(mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(p, mtime, mtime)
+}
+
+func (x *extractor) symlink(p string, link string) error {
+	if err := prepare(p); err != nil {
+		return err
+	}
+	if err := os.Symlink(link, p); err != nil {
+		return err
+	}
+	x.info.Files++
+	return nil
+}
+
+func (x *extractor) link(p string, target string) error {
+	if err := prepare(p); err != nil {
+		return err
+	}
+	if err := os.Link(target, p); err != nil {
+		return err
+	}
+	x.info.Files++
+	return nil
+}
+
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractArchive extracts the archive of the format read from r into dir,
+// created if missing. Existing files are replaced. Permission bits with
+// setuid, setgid and sticky, times of files and directories and symlinks
+// are kept, owners are not. Special files are skipped. Entries escaping dir fail with ErrArchivePath.
+func ExtractArchive(r io.Reader, dir string, format string) (*api.ArchiveInfo, error) {
+	return extractArchive(r, dir, format, "")
+}
+
+// Extract extracts the archive into the directory at rel as ExtractArchive.
+// The directory must not be reached through symlinks and no entries are
+// created in the state of the server.
+func (n *FileNode) Extract(r io.Reader, rel string, format string) (*api.ArchiveInfo, error) {
+	dir, err := n.writable(rel, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSymlinks(n.Root, filepath.Clean("/"+rel)); err != nil {
+		return nil, err
+	}
+	return extractArchive(r, dir, format, filepath.Join(n.Root, stateDir))
+}
+
+// extractArchive extracts the archive into dir without entries in skip.
+func extractArchive(r io.Reader, dir string, format string, skip string) (*api.ArchiveInfo, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	x := &extractor{dir: dir, skip: skip}
+
+	var err error
+	switch format {
+	case api.ArchiveTar:
+		err = x.tar(r)
+	case api.ArchiveTgz:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err == nil {
+			err = x.tar(gz)
+		}
+	case api.ArchiveZip:
+		err = x.zip(r)
+	default:
+		err = fmt.Errorf("unknown archive format: %q", format)
+	}
+	if err == nil {
+		err = x.finish()
+	}
+	return &x.info, err
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := x.path(hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(p, mode, hdr.ModTime)
+		case tar.TypeReg:
+			err = x.file(p, mode, hdr.ModTime, tr)
+		case tar.TypeSymlink:
+			err = x.symlink(p, hdr.Linkname)
+		case tar.TypeLink:
+			var target string
+			if target, err = x.path(hdr.Linkname); err == nil {
+				err = x.link(p, target)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(r io.Reader) error {
+	// zip needs random access, the archive is spooled to a temp file
+	tmp, err := os.CreateTemp("", "nomad-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		p, err := x.path(f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		switch {
+		case mode.IsDir():
+			err = x.mkdir(p, mode, f.Modified)
+		case mode&fs.ModeSymlink != 0:
+			var link []byte
+			if link, err = io.ReadAll(rc); err == nil {
+				err = x.symlink(p, string(link))
+			}
+		case mode.IsRegular():
+			err = x.file(p, mode, f.Modified, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestArchive(t *testing.T) {
+	src := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(src, name)
+	}
+	if err := os.MkdirAll(p("d/sub"), 0750); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"a.go", "d/b.go", "d/sub/c.txt"} {
+		if err := os.WriteFile(p(name), []byte(name), 0640); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := os.Symlink("b.go", p("d/l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		format string
+		filter *ArchiveFilter
+		files  []string
+		absent []string
+	}{
+		{api.ArchiveTar, nil, []string{"a.go", "d/b.go", "d/l", "d/sub/c.txt"}, nil},
+		{api.ArchiveTgz, &ArchiveFilter{Include: []string{"*.go"}}, []string{"a.go", "d/b.go"}, []string{"d/sub", "d/l"}},
+		{api.ArchiveZip, &ArchiveFilter{Exclude: []string{"d/sub"}}, []string{"a.go", "d/b.go", "d/l"}, []string{"d/sub"}},
+	}
+
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, src, tc.format, tc.filter); err != nil {
+			t.Fatalf("%v: %v", tc.format, err)
+		}
+		dst := t.TempDir()
+		if _, err := ExtractArchive(&buf, dst, tc.format); err != nil {
+			t.Fatalf("%v: %v", tc.format, err)
+		}
+		for _, name := range tc.files {
+			b, err := os.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Fatalf("%v: %v", tc.format, err)
+			}
+			if name != "d/l" && string(b) != name {
+				t.Fatalf("%v: %v: %q", tc.format, name, b)
+			}
+		}
+		for _, name := range tc.absent {
+			if _, err := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+				t.Fatalf("%v: %v: %v", tc.format, name, err)
+			}
+		}
+		if fi, err := os.Lstat(filepath.Join(dst, "a.go")); err != nil || fi.Mode().Perm() != 0640 {
+			t.Fatalf("%v: mode: %v", tc.format, err)
+		}
+		if tc.filter == nil {
+			if fi, err := os.Lstat(filepath.Join(dst, "d")); err != nil || fi.Mode().Perm() != 0750 {
+				t.Fatalf("%v: mode: %v", tc.format, err)
+			}
+			if link, err := os.Readlink(filepath.Join(dst, "d/l")); err != nil || link != "b.go" {
+				t.Fatalf("%v: link: %q %v", tc.format, link, err)
+			}
+		}
+	}
+}
+
+func TestArchiveModes(t *testing.T) {
+	src := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(src, name)
+	}
+	modes := map[string]os.FileMode{
+		"suid":   0755 | os.ModeSetuid,
+		"sgid":   0755 | os.ModeSetgid | os.ModeDir,
+		"sticky": 0777 | os.ModeSticky | os.ModeDir,
+	}
+	for name, mode := range modes {
+		var err error
+		if mode.IsDir() {
+			err = os.Mkdir(p(name), 0700)
+		} else {
+			err = os.WriteFile(p(name), nil, 0600)
+		}
+		if err == nil {
+			err = os.Chmod(p(name), mode)
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for _, format := range []string{api.ArchiveTar, api.ArchiveTgz, api.ArchiveZip} {
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, src, format, nil); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		dst := t.TempDir()
+		if _, err := ExtractArchive(&buf, dst, format); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		for name, mode := range modes {
+			fi, err := os.Lstat(filepath.Join(dst, name))
+			if err != nil || fi.Mode() != mode {
+				t.Fatalf("%v: %v: %v %v", format, name, fi.Mode(), err)
+			}
+		}
+	}
+}
+
+func TestExtractArchiveEscape(t *testing.T) {
+	outside := t.TempDir()
+
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+	}{
+		{"dotdot", []*tar.Header{{Name: "../x", Typeflag: tar.TypeReg}}},
+		{"abs", []*tar.Header{{Name: "/x", Typeflag: tar.TypeReg}}},
+		{"symlink", []*tar.Header{
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "l/x", Typeflag: tar.TypeReg},
+		}},
+		{"link", []*tar.Header{{Name: "x", Typeflag: tar.TypeLink, Linkname: "../../x"}}},
+	}
+
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range tc.entries {
+			hdr.Mode = 0644
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+		}
+		tw.Close()
+
+		_, err := ExtractArchive(&buf, t.TempDir(), api.ArchiveTar)
+		if !errors.Is(err, ErrArchivePath) {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+		t.Fatalf("escaped: %v", entries)
+	}
+}
+
+func TestNodeArchive(t *testing.T) {
+	dir := t.TempDir()
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, stateDir), 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, "l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	job, err := n.CreateSnapshot("s1", "/f", "")
+	waitJob(t, n, job, err)
+
+	names := func(rel string) []string {
+		var buf bytes.Buffer
+		if err := n.Archive(&buf, rel, api.ArchiveTar, nil); err != nil {
+			t.Fatalf("%v: %v", rel, err)
+		}
+		var names []string
+		tr := tar.NewReader(&buf)
+		for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+			names = append(names, hdr.Name)
+		}
+		return names
+	}
+	if got := names("/"); !reflect.DeepEqual(got, []string{"f", "l"}) {
+		t.Fatalf("root: %v", got)
+	}
+	if got := names("/.snapshots/s1"); !reflect.DeepEqual(got, []string{"s1"}) {
+		t.Fatalf("snapshot: %v", got)
+	}
+
+	tests := []struct {
+		rel  string
+		name string
+		err  error
+	}{
+		{"/", "x", nil},
+		{"/", ".nomad/x", ErrArchivePath},
+		{"/.nomad", "x", syscall.ENOENT},
+		{"/.snapshots/s1", "x", syscall.EROFS},
+		{"/l", "x", ErrArchivePath},
+		{"/l/d", "x", ErrArchivePath},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: tc.name, Typeflag: tar.TypeReg, Mode: 0644})
+		tw.Close()
+		if _, err := n.Extract(&buf, tc.rel, api.ArchiveTar); !errors.Is(err, tc.err) {
+			t.Fatalf("%v %v: %v", tc.rel, tc.name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, stateDir, "x")); !os.IsNotExist(err) {
+		t.Fatalf("state: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package fs
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// ETag returns the version of the file, the inode, change time and size.
+// The change time is set by the kernel on any change of the data or
+// attributes, also when the modification time is set back as by cp -p, the
+// inode changes if the file is replaced.
+func ETag(st *syscall.Stat_t) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, st.Ino, syscall.TimespecToNsec(ctime(st)), st.Size)
+}
+
+// ETag returns the version of the open file if fh is set, otherwise of the
+// path. Symlinks are followed if follow is set, namespace calls as rename and
+// unlink match the entry itself.
+func (n *FileNode) ETag(rel string, fh string, follow bool) (string, error) {
+	var st *syscall.Stat_t
+	var err error
+	if fh != "" || follow {
+		st, err = n.stat(rel, fh)
+	} else {
+		st, err = n.Lstat(rel)
+	}
+	if err != nil {
+		return "", err
+	}
+	return ETag(st), nil
+}
+
+// IfMatch calls fn if the file matches the etag, which is any existing file
+// for "*", and fails with api.ErrConflict otherwise. Conditional calls are
+// serialized so only one of concurrent calls with the same etag succeeds.
+// follow is as for ETag.
+func (n *FileNode) IfMatch(rel string, fh string, etag string, follow bool, fn func() error) error {
+	if etag == "" {
+		return fn()
+	}
+
+	n.condMu.Lock()
+	defer n.condMu.Unlock()
+
+	if err := n.match(rel, fh, etag, follow); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// match fails with api.ErrConflict unless the file matches the etag.
+func (n *FileNode) match(rel string, fh string, etag string, follow bool) error {
+	cur, err := n.ETag(rel, fh, follow)
+	if err != nil {
+		return err
+	}
+	if etag != "*" && etag != cur {
+		return api.ErrConflict
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package fs
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DefaultHandleLease = time.Minute * 5
+
+// Handle is an open file on behalf of a client.
+type Handle struct {
+	ID     string
+	Client string
+
+	// path relative to the root at the time of open
+	Path string
+	File *os.File
+
+	used time.Time
+}
+
+// HandleTable keeps the open files of clients. A handle expires if neither
+// it nor any request of its client is seen within the lease.
+type HandleTable struct {
+	mu sync.Mutex
+
+	m     map[string]*Handle
+	lease time.Duration
+
+	// OnClose is called after a handle is closed if set.
+	OnClose func(h *Handle)
+}
+
+func NewHandleTable(lease time.Duration) *HandleTable {
+	if lease <= 0 {
+		lease = DefaultHandleLease
+	}
+	t := &HandleTable{
+		m:     make(map[string]*Handle),
+		lease: lease,
+	}
+	go t.reap()
+	return t
+}
+
+func (t *HandleTable) Add(client, rel string, f *os.File) (*Handle, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	h := &Handle{
+		ID:     id.String(),
+		Client: client,
+		Path:   rel,
+		File:   f,
+		used:   time.Now(),
+	}
+
+	t.mu.Lock()
+	t.m[h.ID] = h
+	t.mu.Unlock()
+
+	return h, nil
+}
+
+// Get returns the handle of id and renews its lease.
+func (t *HandleTable) Get(id string) (*Handle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.m[id]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	h.used = time.Now()
+	return h, nil
+}
+
+// Release closes the handle of id.
+func (t *HandleTable) Release(id string) error {
+	t.mu.Lock()
+	h, ok := t.m[id]
+	delete(t.m, id)
+	t.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+	return t.close(h)
+}
+
+// Touch renews the lease of all handles of the client.
+func (t *HandleTable) Touch(client string) {
+	if client == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, h := range t.m {
+		if h.Client == client {
+			h.used = now
+		}
+	}
+}
+
+// CloseClient closes all handles of the client and returns the count.
+func (t *HandleTable) CloseClient(client string) int {
+	return t.closeIf(func(h *Handle) bool {
+		return h.Client == client
+	})
+}
+
+func (t *HandleTable) closeIf(fn func(h *Handle) bool) int {
+	var handles []*Handle
+
+	t.mu.Lock()
+	for id, h := range t.m {
+		if fn(h) {
+			handles = append(handles, h)
+			delete(t.m, id)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, h := range handles {
+		t.close(h)
+	}
+	return len(handles)
+}
+
+func (t *HandleTable) close(h *Handle) error {
+	err := h.File.Close()
+	if t.OnClose != nil {
+		t.OnClose(h)
+	}
+	return err
+}
+
+func (t *HandleTable) reap() {
+	ticker := time.NewTicker(t.lease / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		n := t.closeIf(func(h *Handle) bool {
+			return now.Sub(h.used) > t.lease
+		})
+		if n > 0 {
+			log.Printf("expired handles: %v", n)
+		}
+	}
+}
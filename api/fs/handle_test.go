@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestHandleTable(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return f
+	}
+
+	var closed []string
+	ht := NewHandleTable(0)
+	ht.OnClose = func(h *Handle) {
+		closed = append(closed, h.Path)
+	}
+
+	a, _ := ht.Add("c1", "a", open("a"))
+	b, _ := ht.Add("c1", "b", open("b"))
+	c, _ := ht.Add("c2", "c", open("c"))
+
+	if h, err := ht.Get(a.ID); err != nil || h.Path != "a" {
+		t.Fatalf("get: %v %v", h, err)
+	}
+	if err := ht.Release(a.ID); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := ht.Get(a.ID); err != syscall.EBADF {
+		t.Fatalf("get released: %v", err)
+	}
+	if err := ht.Release(a.ID); err != syscall.EBADF {
+		t.Fatalf("release twice: %v", err)
+	}
+
+	if n := ht.CloseClient("c1"); n != 1 {
+		t.Fatalf("close client: %v", n)
+	}
+	if _, err := ht.Get(b.ID); err != syscall.EBADF {
+		t.Fatalf("get closed: %v", err)
+	}
+	if _, err := ht.Get(c.ID); err != nil {
+		t.Fatalf("get other client: %v", err)
+	}
+
+	if len(closed) != 2 || closed[0] != "a" || closed[1] != "b" {
+		t.Fatalf("closed: %v", closed)
+	}
+}
@@ -0,0 +1,178 @@
+package fs
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/google/uuid"
+)
+
+// how long finished jobs are kept for clients to see the result
+const DefaultJobRetention = time.Minute * 10
+
+// Job is a long running fs call, see JobTable.Start.
+type Job struct {
+	mu sync.Mutex
+
+	job    api.Job
+	cancel context.CancelFunc
+	ended  time.Time
+}
+
+// Progress adds the count of entries done and bytes copied.
+func (j *Job) Progress(files, bytes int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.job.Files += files
+	j.job.Bytes += bytes
+}
+
+func (j *Job) info() api.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job := j.job
+	end := time.Now()
+	if !j.ended.IsZero() {
+		end = j.ended
+	}
+	job.Elapsed = int64(end.Sub(job.Created) / time.Second)
+	return job
+}
+
+func (j *Job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.ended = time.Now()
+	j.job.State = api.Done
+	if err != nil {
+		j.job.State = api.Failed
+		j.job.Status = api.ToErrno(err)
+		j.job.Error = err.Error()
+	}
+}
+
+// JobTable keeps the running jobs and the finished ones for the retention.
+type JobTable struct {
+	mu sync.Mutex
+
+	m         map[string]*Job
+	retention time.Duration
+}
+
+func NewJobTable(retention time.Duration) *JobTable {
+	if retention <= 0 {
+		retention = DefaultJobRetention
+	}
+	t := &JobTable{
+		m:         make(map[string]*Job),
+		retention: retention,
+	}
+	go t.reap()
+	return t
+}
+
+// Start runs fn in the background and returns the job. The context of fn is
+// done when the job is canceled.
+func (t *JobTable) Start(call, rel, to string, fn func(ctx context.Context, j *Job) error) (*api.Job, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{
+		job: api.Job{
+			ID:      id.String(),
+			Call:    call,
+			Path:    rel,
+			To:      to,
+			State:   api.Running,
+			Created: time.Now(),
+		},
+		cancel: cancel,
+	}
+
+	t.mu.Lock()
+	t.m[j.job.ID] = j
+	t.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		err := fn(ctx, j)
+		if err != nil && ctx.Err() != nil {
+			err = syscall.ECANCELED
+		}
+		j.finish(err)
+		log.Printf("job %v %v %v: %v", j.job.ID, call, rel, err)
+	}()
+
+	info := j.info()
+	return &info, nil
+}
+
+func (t *JobTable) Get(id string) (*api.Job, error) {
+	t.mu.Lock()
+	j, ok := t.m[id]
+	t.mu.Unlock()
+
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	info := j.info()
+	return &info, nil
+}
+
+// List returns all jobs by creation time.
+func (t *JobTable) List() []api.Job {
+	t.mu.Lock()
+	jobs := make([]api.Job, 0, len(t.m))
+	for _, j := range t.m {
+		jobs = append(jobs, j.info())
+	}
+	t.mu.Unlock()
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+	return jobs
+}
+
+// Cancel stops the job of id. Work done is not undone.
+func (t *JobTable) Cancel(id string) error {
+	t.mu.Lock()
+	j, ok := t.m[id]
+	t.mu.Unlock()
+
+	if !ok {
+		return syscall.ENOENT
+	}
+	j.cancel()
+	return nil
+}
+
+func (t *JobTable) reap() {
+	ticker := time.NewTicker(t.retention / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		t.mu.Lock()
+		for id, j := range t.m {
+			j.mu.Lock()
+			if !j.ended.IsZero() && now.Sub(j.ended) > t.retention {
+				delete(t.m, id)
+			}
+			j.mu.Unlock()
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,177 @@
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// fileKey identifies a file independent of its path.
+type fileKey struct {
+	Dev uint64
+	Ino uint64
+}
+
+type heldLock struct {
+	api.Lock
+
+	client string
+	handle string
+}
+
+func (l *heldLock) owned(client string, lk *api.Lock) bool {
+	return l.client == client && l.Owner == lk.Owner && l.Flock == lk.Flock
+}
+
+func (l *heldLock) overlaps(lk *api.Lock) bool {
+	return l.Start <= lk.End && lk.Start <= l.End
+}
+
+// conflicts reports whether lk of another owner can not be granted while l
+// is held. POSIX and flock locks are independent of each other.
+func (l *heldLock) conflicts(client string, lk *api.Lock) bool {
+	if l.owned(client, lk) || l.Flock != lk.Flock || !l.overlaps(lk) {
+		return false
+	}
+	return l.Type == syscall.F_WRLCK || lk.Type == syscall.F_WRLCK
+}
+
+// LockTable keeps the byte range POSIX locks and whole file flock locks of
+// clients, keyed by client and lock owner. Locks set through a handle are
+// released when the handle is closed, including on lease expiry.
+type LockTable struct {
+	mu sync.Mutex
+
+	m map[fileKey][]*heldLock
+
+	// closed and replaced whenever locks are released
+	changed chan struct{}
+}
+
+func NewLockTable() *LockTable {
+	return &LockTable{
+		m:       make(map[fileKey][]*heldLock),
+		changed: make(chan struct{}),
+	}
+}
+
+// Test returns a lock conflicting with lk or nil.
+func (t *LockTable) Test(key fileKey, client string, lk *api.Lock) *api.Lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, l := range t.m[key] {
+		if l.conflicts(client, lk) {
+			c := l.Lock
+			return &c
+		}
+	}
+	return nil
+}
+
+// Set acquires, converts or with F_UNLCK releases the range of lk. If wait
+// is set, it blocks until no lock of other owners conflicts or ctx is done,
+// otherwise it fails with EAGAIN.
+func (t *LockTable) Set(ctx context.Context, key fileKey, client, handle string, lk *api.Lock, wait bool) error {
+	if lk.Start > lk.End {
+		return syscall.EINVAL
+	}
+	switch lk.Type {
+	case syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK:
+	default:
+		return syscall.EINVAL
+	}
+
+	for {
+		t.mu.Lock()
+		if lk.Type == syscall.F_UNLCK || !t.conflict(key, client, lk) {
+			t.remove(key, client, lk)
+			if lk.Type != syscall.F_UNLCK {
+				t.m[key] = append(t.m[key], &heldLock{
+					Lock:   *lk,
+					client: client,
+					handle: handle,
+				})
+			}
+			t.mu.Unlock()
+			return nil
+		}
+		changed := t.changed
+		t.mu.Unlock()
+
+		if !wait {
+			return syscall.EAGAIN
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+// ReleaseHandle releases all locks set through the handle.
+func (t *LockTable) ReleaseHandle(handle string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, locks := range t.m {
+		var kept []*heldLock
+		for _, l := range locks {
+			if l.handle != handle {
+				kept = append(kept, l)
+			}
+		}
+		t.set(key, kept)
+	}
+	t.notify()
+}
+
+func (t *LockTable) conflict(key fileKey, client string, lk *api.Lock) bool {
+	for _, l := range t.m[key] {
+		if l.conflicts(client, lk) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes the range of lk from the locks of its owner, splitting
+// locks partially covered.
+func (t *LockTable) remove(key fileKey, client string, lk *api.Lock) {
+	var kept []*heldLock
+	for _, l := range t.m[key] {
+		if !l.owned(client, lk) || !l.overlaps(lk) {
+			kept = append(kept, l)
+			continue
+		}
+		if l.Start < lk.Start {
+			left := *l
+			left.End = lk.Start - 1
+			kept = append(kept, &left)
+		}
+		if l.End > lk.End {
+			right := *l
+			right.Start = lk.End + 1
+			kept = append(kept, &right)
+		}
+	}
+	t.set(key, kept)
+	t.notify()
+}
+
+func (t *LockTable) set(key fileKey, locks []*heldLock) {
+	if len(locks) == 0 {
+		delete(t.m, key)
+		return
+	}
+	t.m[key] = locks
+}
+
+// notify wakes up all waiters to retry.
+func (t *LockTable) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
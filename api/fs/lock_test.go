@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"context"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestLockTable(t *testing.T) {
+	lock := func(owner uint64, start, end uint64, typ uint32) *api.Lock {
+		return &api.Lock{
+			Owner: owner,
+			Start: start,
+			End:   end,
+			Type:  typ,
+		}
+	}
+	key := fileKey{Dev: 1, Ino: 1}
+
+	tests := []struct {
+		client string
+		lk     *api.Lock
+		err    error
+	}{
+		{"c1", lock(1, 0, 99, syscall.F_WRLCK), nil},
+		// conflicting range of another owner or client
+		{"c1", lock(2, 50, 59, syscall.F_RDLCK), syscall.EAGAIN},
+		{"c2", lock(1, 99, 99, syscall.F_WRLCK), syscall.EAGAIN},
+		{"c2", lock(1, 100, math.MaxUint64, syscall.F_WRLCK), nil},
+		// split by a partial unlock
+		{"c1", lock(1, 40, 59, syscall.F_UNLCK), nil},
+		{"c1", lock(2, 40, 59, syscall.F_RDLCK), nil},
+		{"c2", lock(2, 50, 50, syscall.F_RDLCK), nil},
+		{"c2", lock(2, 39, 39, syscall.F_RDLCK), syscall.EAGAIN},
+		{"c2", lock(2, 60, 60, syscall.F_RDLCK), syscall.EAGAIN},
+		// flock is independent of posix locks
+		{"c2", &api.Lock{Owner: 3, End: math.MaxUint64, Type: syscall.F_WRLCK, Flock: true}, nil},
+		{"c1", &api.Lock{Owner: 4, End: math.MaxUint64, Type: syscall.F_RDLCK, Flock: true}, syscall.EAGAIN},
+		{"c1", lock(1, 10, 5, syscall.F_WRLCK), syscall.EINVAL},
+	}
+
+	lt := NewLockTable()
+	for i, tc := range tests {
+		err := lt.Set(context.Background(), key, tc.client, "h-"+tc.client, tc.lk, false)
+		if err != tc.err {
+			t.Fatalf("%v: %v %v expected: %v got: %v", i, tc.client, *tc.lk, tc.err, err)
+		}
+	}
+
+	if c := lt.Test(key, "c1", lock(2, 0, math.MaxUint64, syscall.F_WRLCK)); c == nil {
+		t.Fatalf("test: no conflict")
+	}
+
+	// a blocked waiter proceeds once the handle holding the lock is closed
+	done := make(chan error)
+	go func() {
+		done <- lt.Set(context.Background(), key, "c3", "h-c3", lock(1, 0, math.MaxUint64, syscall.F_WRLCK), true)
+	}()
+	lt.ReleaseHandle("h-c1")
+	select {
+	case err := <-done:
+		t.Fatalf("wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	lt.ReleaseHandle("h-c2")
+	if err := <-done; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := lt.Set(ctx, key, "c1", "h-c1", lock(1, 0, 0, syscall.F_RDLCK), true); err != syscall.EINTR {
+		t.Fatalf("cancel: %v", err)
+	}
+}
@@ -1,49 +1,177 @@
 package fs
 
 import (
-	"log"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/dhnt/nomad/api"
 )
 
+const DefaultInlineMax = 128 * 1024
+
+// DefaultMaxWatches is the max number of directories watched by a watch.
+const DefaultMaxWatches = 8192
+
+const copyBufferSize = 1024 * 1024
+
+// size copied by jobs between checks of whether they are canceled
+const copyChunkSize = 64 * 1024 * 1024
+
+var hashes = map[string]func() hash.Hash{
+	"":             sha256.New,
+	api.HashSHA256: sha256.New,
+	api.HashXXH64:  func() hash.Hash { return xxhash.New() },
+}
+
+// max count of entries of a readdirplus page
+const maxDirPage = 1024
+
 type FileNode struct {
 	Root string
 	Dev  uint64
 
+	// open files of clients
+	Handles *HandleTable
+	// locks set through the open files
+	Locks *LockTable
+	// recursive calls running in the background
+	Jobs *JobTable
+	// deleted entries kept for restore, deletes are permanent if nil
+	Trash *Trash
+
+	// serializes calls with etag preconditions and commits
+	condMu sync.Mutex
+
+	// open transactions
+	txMu   sync.Mutex
+	txs    map[string]*Tx
+	txOnce sync.Once
+
+	// lease of open transactions, DefaultTxLease if 0
+	TxLease time.Duration
+
+	// max directories watched by a watch, DefaultMaxWatches if 0
+	MaxWatches int
+
+	// max size of data transferred inline in read/write calls
+	InlineMax int64
+
 	baseUrl *url.URL
 }
 
-func NewFileNode(root string, u *url.URL) (*FileNode, error) {
+func NewFileNode(root string, u *url.URL, handles *HandleTable) (*FileNode, error) {
 	var st syscall.Stat_t
 	if err := syscall.Stat(root, &st); err != nil {
 		return nil, err
 	}
-	return &FileNode{
-		Root:    root,
-		Dev:     uint64(st.Dev),
-		baseUrl: u,
-	}, nil
+	if _, err := os.Lstat(filepath.Join(root, SnapshotsPath)); err == nil {
+		return nil, &os.PathError{Op: "serve", Path: SnapshotsPath, Err: syscall.EEXIST}
+	}
+	n := &FileNode{
+		Root:      root,
+		Dev:       uint64(st.Dev),
+		Handles:   handles,
+		Locks:     NewLockTable(),
+		Jobs:      NewJobTable(0),
+		txs:       make(map[string]*Tx),
+		InlineMax: DefaultInlineMax,
+		baseUrl:   u,
+	}
+	// locks do not survive the handle
+	handles.OnClose = func(h *Handle) {
+		n.Locks.ReleaseHandle(h.ID)
+	}
+	return n, nil
 }
 
-// abs resolves the path
+// abs resolves the path, in the snapshots under SnapshotsPath
 func (n *FileNode) abs(p string) string {
+	if IsSnapshot(p) {
+		return n.snapshotPath(p)
+	}
 	return filepath.Join(n.Root, p)
 }
 
+// path resolves the path of a client, the state of the server is hidden.
+func (n *FileNode) path(rel string) (string, error) {
+	if IsState(rel) {
+		return "", syscall.ENOENT
+	}
+	return n.abs(rel), nil
+}
+
+// writable resolves the path of a client to be changed, the entry itself
+// through symlinks if follow is set. It fails with EROFS in the snapshots,
+// also if reached through symlinks.
+func (n *FileNode) writable(rel string, follow bool) (string, error) {
+	path, err := n.path(rel)
+	if err != nil {
+		return "", err
+	}
+	if IsSnapshot(rel) {
+		return "", syscall.EROFS
+	}
+	state, err := filepath.EvalSymlinks(filepath.Join(n.Root, stateDir))
+	if err != nil {
+		return path, nil
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if !follow || err != nil {
+		// the parents of the entry, up to the first one that exists
+		real = path
+		for p, rest := path, ""; p != filepath.Dir(p); p = filepath.Dir(p) {
+			rest = filepath.Join(filepath.Base(p), rest)
+			if dir, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+				real = filepath.Join(dir, rest)
+				break
+			}
+		}
+	}
+	if real == state || strings.HasPrefix(real, state+"/") {
+		return "", syscall.EROFS
+	}
+	return path, nil
+}
+
+// IsState reports whether the path is in the state of the server, which is
+// hidden from clients.
+func IsState(rel string) bool {
+	p := filepath.Clean("/" + rel)
+	return p == "/"+stateDir || strings.HasPrefix(p, "/"+stateDir+"/")
+}
+
+// resolve resolves the path of a client to open with the flags.
+func (n *FileNode) resolve(rel string, flags int) (string, error) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC) != 0 {
+		return n.writable(rel, true)
+	}
+	return n.path(rel)
+}
+
 // rel returns a relative path to the root
 func (n *FileNode) rel(p string) (string, error) {
 	return filepath.Rel(n.Root, p)
 }
 
 func (n *FileNode) Statfs(rel string) (*syscall.Statfs_t, error) {
-	path := n.abs(rel)
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
 
 	st := syscall.Statfs_t{}
-	err := syscall.Statfs(path, &st)
+	err = syscall.Statfs(path, &st)
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +182,10 @@ func (n *FileNode) Mknod(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
 	if attr == nil || attr.Mode == nil {
 		return nil, syscall.EINVAL
 	}
-	path := n.abs(rel)
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return nil, err
+	}
 
 	// syscall.S_IFREG
 	if !IsRegular(*attr.Mode) {
@@ -63,7 +194,7 @@ func (n *FileNode) Mknod(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
 	}
 	// mknod requires root privilege
 	// err := syscall.Mknod(path, mode, 0)
-	_, err := os.Create(path)
+	_, err = os.Create(path)
 	if err != nil {
 		return nil, api.ToErrno(err)
 	}
@@ -81,9 +212,12 @@ func (n *FileNode) Mkdir(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
 	if attr == nil || attr.Mode == nil {
 		return nil, syscall.EINVAL
 	}
-	path := n.abs(rel)
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return nil, err
+	}
 
-	err := os.Mkdir(path, os.FileMode(*attr.Mode))
+	err = os.Mkdir(path, os.FileMode(*attr.Mode))
 	if err != nil {
 		return nil, api.ToErrno(err)
 	}
@@ -97,32 +231,70 @@ func (n *FileNode) Mkdir(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
 }
 
 func (n *FileNode) Rmdir(rel string) error {
-	path := n.abs(rel)
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return err
+	}
 
-	err := syscall.Rmdir(path)
+	if n.Trash != nil {
+		if err := isEmptyDir(path); err != nil {
+			return err
+		}
+		if _, ok, err := n.moveToTrash(rel, path); ok {
+			return err
+		}
+	}
+	err = syscall.Rmdir(path)
 	return err
 }
 
 func (n *FileNode) Unlink(rel string) error {
-	path := n.abs(rel)
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return err
+	}
 
-	err := syscall.Unlink(path)
+	if n.Trash != nil {
+		st := syscall.Stat_t{}
+		if err := syscall.Lstat(path, &st); err != nil {
+			return err
+		}
+		if isDir(&st) {
+			return syscall.EISDIR
+		}
+		if _, ok, err := n.moveToTrash(rel, path); ok {
+			return err
+		}
+	}
+	err = syscall.Unlink(path)
 	return err
 }
 
 func (n *FileNode) Rename(rel1, rel2 string) error {
-	from := n.abs(rel1)
-	to := n.abs(rel2)
+	from, err := n.writable(rel1, false)
+	if err != nil {
+		return err
+	}
+	to, err := n.writable(rel2, false)
+	if err != nil {
+		return err
+	}
 
-	err := syscall.Rename(from, to)
+	err = syscall.Rename(from, to)
 	return err
 }
 
 func (n *FileNode) Symlink(rel string, dir string) (*syscall.Stat_t, error) {
-	path := n.abs(rel)
-	link := n.abs(dir)
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	link, err := n.writable(dir, false)
+	if err != nil {
+		return nil, err
+	}
 
-	err := syscall.Symlink(path, link)
+	err = syscall.Symlink(path, link)
 	if err != nil {
 		return nil, err
 	}
@@ -136,10 +308,16 @@ func (n *FileNode) Symlink(rel string, dir string) (*syscall.Stat_t, error) {
 }
 
 func (n *FileNode) Link(rel, dir string) (*syscall.Stat_t, error) {
-	path := n.abs(rel)
-	link := n.abs(dir)
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return nil, err
+	}
+	link, err := n.writable(dir, false)
+	if err != nil {
+		return nil, err
+	}
 
-	err := syscall.Link(path, link)
+	err = syscall.Link(path, link)
 	if err != nil {
 		return nil, err
 	}
@@ -153,7 +331,10 @@ func (n *FileNode) Link(rel, dir string) (*syscall.Stat_t, error) {
 }
 
 func (n *FileNode) Readlink(rel string) (string, error) {
-	path := n.abs(rel)
+	path, err := n.path(rel)
+	if err != nil {
+		return "", err
+	}
 
 	for l := 256; ; l *= 2 {
 		buf := make([]byte, l)
@@ -168,53 +349,323 @@ func (n *FileNode) Readlink(rel string) (string, error) {
 	}
 }
 
-func (n *FileNode) Open(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
+// Open opens the file for the client and returns the handle.
+func (n *FileNode) Open(client string, rel string, attr *api.Attr) (*api.FileHandle, error) {
 	if attr == nil || attr.Mode == nil || attr.Perm == nil {
 		return nil, syscall.EINVAL
 	}
-	path := n.abs(rel)
+	return n.open(client, rel, int(*attr.Mode), *attr.Perm)
+}
 
-	writing := *attr.Mode & syscall.O_CREAT
-	log.Printf("writing %v", writing)
+// Create creates and opens the file for the client and returns the handle.
+func (n *FileNode) Create(client string, rel string, attr *api.Attr) (*api.FileHandle, error) {
+	if attr == nil || attr.Mode == nil || attr.Perm == nil {
+		return nil, syscall.EINVAL
+	}
+	return n.open(client, rel, int(*attr.Mode|syscall.O_CREAT), *attr.Perm)
+}
 
-	fd, err := syscall.Open(path, int(*attr.Mode), *attr.Perm)
+func (n *FileNode) open(client string, rel string, flags int, perm uint32) (*api.FileHandle, error) {
+	path, err := n.resolve(rel, flags)
 	if err != nil {
 		return nil, err
 	}
-	defer syscall.Close(fd)
+
+	fd, err := syscall.Open(path, flags|syscall.O_CLOEXEC, perm)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), path)
 
 	st := syscall.Stat_t{}
 	if err := syscall.Fstat(fd, &st); err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	return &st, nil
+	h, err := n.Handles.Add(client, rel, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &api.FileHandle{
+		ID:   h.ID,
+		Stat: &st,
+	}, nil
 }
 
-func (n *FileNode) Create(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
-	if attr == nil || attr.Mode == nil || attr.Perm == nil {
-		return nil, syscall.EINVAL
+// Release closes the handle.
+func (n *FileNode) Release(fh string) error {
+	return n.Handles.Release(fh)
+}
+
+// Disconnect closes all handles of the client.
+func (n *FileNode) Disconnect(client string) int {
+	return n.Handles.CloseClient(client)
+}
+
+// Keepalive renews the lease of all handles of the client.
+func (n *FileNode) Keepalive(client string) {
+	n.Handles.Touch(client)
+}
+
+func (n *FileNode) Fsync(fh string) error {
+	h, err := n.Handles.Get(fh)
+	if err != nil {
+		return err
+	}
+	return h.File.Sync()
+}
+
+func (n *FileNode) Fstat(fh string) (*syscall.Stat_t, error) {
+	h, err := n.Handles.Get(fh)
+	if err != nil {
+		return nil, err
 	}
-	path := n.abs(rel)
 
-	mode := *attr.Mode | syscall.O_CREAT
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(h.File.Fd()), &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
 
-	fd, err := syscall.Open(path, int(mode), *attr.Perm)
+func (n *FileNode) Ftruncate(fh string, attr *api.Attr) error {
+	if attr == nil || attr.Size == nil {
+		return syscall.EINVAL
+	}
+	h, err := n.Handles.Get(fh)
 	if err != nil {
+		return err
+	}
+	return syscall.Ftruncate(int(h.File.Fd()), *attr.Size)
+}
+
+func (n *FileNode) Fsetattr(fh string, attr *api.Attr) (*syscall.Stat_t, error) {
+	if attr == nil {
+		return nil, syscall.EINVAL
+	}
+	h, err := n.Handles.Get(fh)
+	if err != nil {
+		return nil, err
+	}
+	// permitted on files open for reading
+	if _, err := n.writable(h.Path, true); err != nil {
 		return nil, err
 	}
-	defer syscall.Close(fd)
+	fd := int(h.File.Fd())
+
+	if attr.Mode != nil {
+		if err := syscall.Fchmod(fd, *attr.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	if attr.Owner != nil {
+		owner := attr.Owner
+		if err := syscall.Fchown(fd, owner.Uid, owner.Gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if attr.Atime != nil || attr.Mtime != nil {
+		var ts [2]syscall.Timespec
+		ts[0] = UtimeToTimespec(attr.Atime)
+		ts[1] = UtimeToTimespec(attr.Mtime)
+
+		if err := futimens(fd, &ts); err != nil {
+			return nil, err
+		}
+	}
+
+	if attr.Size != nil {
+		if err := syscall.Ftruncate(fd, *attr.Size); err != nil {
+			return nil, err
+		}
+	}
 
 	st := syscall.Stat_t{}
 	if err := syscall.Fstat(fd, &st); err != nil {
 		return nil, err
 	}
-
 	return &st, nil
 }
 
+// Fallocate manipulates the allocated space of the file, mode is a mask of
+// the FALLOC_FL_* flags such as FALLOC_FL_PUNCH_HOLE.
+func (n *FileNode) Fallocate(rel string, fh string, attr *api.Attr, mode int) error {
+	if attr == nil || attr.Offset == nil || attr.Size == nil {
+		return syscall.EINVAL
+	}
+	f, done, err := n.File(rel, fh, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return fallocate(int(f.Fd()), uint32(mode), *attr.Offset, *attr.Size)
+}
+
+// Copy copies the range of the source file to the destination at offset
+// without transferring the data to the client. Either side is an open file
+// handle or a path. The range extends to the end of the source if the size
+// is not set, a destination path is then truncated as for a whole file copy.
+// It returns the count of bytes copied.
+func (n *FileNode) Copy(rel string, fh string, attr *api.Attr, to string, toFh string, toOffset int64) (int64, error) {
+	var offset int64
+	if attr != nil && attr.Offset != nil {
+		offset = *attr.Offset
+	}
+	if offset < 0 || toOffset < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	in, done, err := n.File(rel, fh, os.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(in.Fd()), &st); err != nil {
+		return 0, err
+	}
+
+	size := st.Size - offset
+	whole := attr == nil || attr.Size == nil
+	if !whole {
+		size = min64(*attr.Size, size)
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	var out *os.File
+	if toFh != "" {
+		h, err := n.Handles.Get(toFh)
+		if err != nil {
+			return 0, err
+		}
+		out = h.File
+		dst := syscall.Stat_t{}
+		if err := syscall.Fstat(int(out.Fd()), &dst); err != nil {
+			return 0, err
+		}
+		if sameFile(&st, &dst) && offset < toOffset+size && toOffset < offset+size {
+			// the ranges overlap
+			return 0, syscall.EINVAL
+		}
+	} else {
+		path, err := n.writable(to, true)
+		if err != nil {
+			return 0, err
+		}
+		dst := syscall.Stat_t{}
+		if err := syscall.Stat(path, &dst); err == nil && sameFile(&st, &dst) {
+			// truncated or overlapping before read
+			if whole || offset < toOffset+size && toOffset < offset+size {
+				return 0, syscall.EINVAL
+			}
+		}
+		flag := os.O_WRONLY | os.O_CREATE
+		if whole {
+			flag |= os.O_TRUNC
+		}
+		out, err = os.OpenFile(path, flag, os.FileMode(st.Mode&0777))
+		if err != nil {
+			return 0, err
+		}
+		defer out.Close()
+	}
+
+	return copyData(in, offset, out, toOffset, size)
+}
+
+func sameFile(a, b *syscall.Stat_t) bool {
+	return a.Dev == b.Dev && a.Ino == b.Ino
+}
+
+// copyData copies the range in the kernel if possible.
+func copyData(in *os.File, offIn int64, out *os.File, offOut int64, size int64) (int64, error) {
+	written, err := copyFileRange(int(in.Fd()), offIn, int(out.Fd()), offOut, size)
+	if err != nil && written == 0 {
+		// not supported by the file systems, copy through user space
+		return copyBuffer(in, offIn, out, offOut, size)
+	}
+	return written, err
+}
+
+func copyBuffer(in *os.File, offIn int64, out *os.File, offOut int64, size int64) (int64, error) {
+	buf := make([]byte, min64(size, copyBufferSize))
+
+	var written int64
+	for written < size {
+		nr, err := in.ReadAt(buf[:min64(int64(len(buf)), size-written)], offIn+written)
+		if nr > 0 {
+			// pwrite appends if the file is opened with O_APPEND
+			nw, err := syscall.Pwrite(int(out.Fd()), buf[:nr], offOut+written)
+			written += int64(nw)
+			if err != nil {
+				return written, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Getlk returns a lock conflicting with lk or one of type F_UNLCK.
+func (n *FileNode) Getlk(client string, fh string, lk *api.Lock) (*api.Lock, error) {
+	if lk == nil {
+		return nil, syscall.EINVAL
+	}
+	key, err := n.lockKey(fh)
+	if err != nil {
+		return nil, err
+	}
+	if c := n.Locks.Test(key, client, lk); c != nil {
+		return c, nil
+	}
+	return &api.Lock{
+		Type: syscall.F_UNLCK,
+	}, nil
+}
+
+// Setlk sets lk on the file of the handle, waiting for conflicting locks to
+// be released if wait is set.
+func (n *FileNode) Setlk(ctx context.Context, client string, fh string, lk *api.Lock, wait bool) error {
+	if lk == nil {
+		return syscall.EINVAL
+	}
+	key, err := n.lockKey(fh)
+	if err != nil {
+		return err
+	}
+	return n.Locks.Set(ctx, key, client, fh, lk, wait)
+}
+
+func (n *FileNode) lockKey(fh string) (fileKey, error) {
+	st, err := n.Fstat(fh)
+	if err != nil {
+		return fileKey{}, err
+	}
+	return fileKey{
+		Dev: uint64(st.Dev),
+		Ino: st.Ino,
+	}, nil
+}
+
 func (n *FileNode) Opendir(rel string) error {
-	path := n.abs(rel)
+	path, err := n.path(rel)
+	if err != nil {
+		return err
+	}
 
 	fd, err := syscall.Open(path, syscall.O_DIRECTORY, 0755)
 	if err != nil {
@@ -225,17 +676,80 @@ func (n *FileNode) Opendir(rel string) error {
 }
 
 func (n *FileNode) Readdir(rel string) ([]api.DirEntry, error) {
-	path := n.abs(rel)
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
 
 	ent, err := os.ReadDir(path)
+	if path == n.Root {
+		for i, e := range ent {
+			if e.Name() == stateDir {
+				ent = append(ent[:i], ent[i+1:]...)
+				break
+			}
+		}
+	}
 	return api.ToDirEntry(ent), err
 }
 
+// dirent is a directory entry and the cookie to continue after it.
+type dirent struct {
+	Name string
+	Off  int64
+}
+
+// ReaddirPlus returns a page of at most count entries with their stat after
+// the cookie of the previous page, 0 for the first. Entries removed in
+// between are skipped.
+func (n *FileNode) ReaddirPlus(rel string, cookie int64, count int) (*api.DirPage, error) {
+	if count <= 0 || count > maxDirPage {
+		count = maxDirPage
+	}
+
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	ents, eof, err := readdirPage(path, cookie, count)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &api.DirPage{
+		Entries: make([]api.DirEntryPlus, 0, len(ents)),
+		Cookie:  cookie,
+		EOF:     eof,
+	}
+	for _, v := range ents {
+		page.Cookie = v.Off
+		if path == n.Root && v.Name == stateDir {
+			continue
+		}
+
+		st := syscall.Stat_t{}
+		if err := syscall.Lstat(filepath.Join(path, v.Name), &st); err != nil {
+			if err == syscall.ENOENT {
+				continue
+			}
+			return nil, err
+		}
+		page.Entries = append(page.Entries, api.DirEntryPlus{
+			Name: v.Name,
+			Stat: st,
+		})
+	}
+	return page, nil
+}
+
 func (n *FileNode) Lstat(rel string) (*syscall.Stat_t, error) {
-	path := n.abs(rel)
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
 
 	st := syscall.Stat_t{}
-	err := syscall.Lstat(path, &st)
+	err = syscall.Lstat(path, &st)
 
 	if err != nil {
 		return nil, err
@@ -244,10 +758,13 @@ func (n *FileNode) Lstat(rel string) (*syscall.Stat_t, error) {
 }
 
 func (n *FileNode) Stat(rel string) (*syscall.Stat_t, error) {
-	path := n.abs(rel)
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
 
 	st := syscall.Stat_t{}
-	err := syscall.Stat(path, &st)
+	err = syscall.Stat(path, &st)
 
 	if err != nil {
 		return nil, err
@@ -260,7 +777,10 @@ func (n *FileNode) Chmod(rel string, attr *api.Attr) error {
 		return syscall.EINVAL
 	}
 
-	path := n.abs(rel)
+	path, err := n.writable(rel, true)
+	if err != nil {
+		return err
+	}
 
 	if err := syscall.Chmod(path, *attr.Mode); err != nil {
 		return err
@@ -274,7 +794,10 @@ func (n *FileNode) Chown(rel string, attr *api.Attr) error {
 		return syscall.EINVAL
 	}
 
-	path := n.abs(rel)
+	path, err := n.writable(rel, true)
+	if err != nil {
+		return err
+	}
 	owner := attr.Owner
 	if err := syscall.Chown(path, owner.Uid, owner.Gid); err != nil {
 		return err
@@ -283,12 +806,61 @@ func (n *FileNode) Chown(rel string, attr *api.Attr) error {
 	return nil
 }
 
+// Getxattr returns the value of the extended attribute. Symlinks are not
+// followed as for the other xattr calls.
+func (n *FileNode) Getxattr(rel string, name string) ([]byte, error) {
+	if name == "" {
+		return nil, syscall.EINVAL
+	}
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	return lgetxattr(path, name)
+}
+
+func (n *FileNode) Setxattr(rel string, name string, value []byte, flags int) error {
+	if name == "" {
+		return syscall.EINVAL
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return err
+	}
+	return lsetxattr(path, name, value, flags)
+}
+
+func (n *FileNode) Listxattr(rel string) ([]string, error) {
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	return llistxattr(path)
+}
+
+func (n *FileNode) Removexattr(rel string, name string) error {
+	if name == "" {
+		return syscall.EINVAL
+	}
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return err
+	}
+	return lremovexattr(path, name)
+}
+
 func (n *FileNode) Truncate(rel string, attr *api.Attr) error {
 	if attr == nil || attr.Size == nil {
 		return syscall.EINVAL
 	}
 
-	path := n.abs(rel)
+	path, err := n.writable(rel, true)
+	if err != nil {
+		return err
+	}
 	if err := syscall.Truncate(path, int64(*attr.Size)); err != nil {
 		return err
 	}
@@ -300,7 +872,10 @@ func (n *FileNode) Setattr(rel string, attr *api.Attr) (*syscall.Stat_t, error)
 	if attr == nil {
 		return nil, syscall.EINVAL
 	}
-	path := n.abs(rel)
+	path, err := n.writable(rel, true)
+	if err != nil {
+		return nil, err
+	}
 
 	if attr.Mode != nil {
 		if err := syscall.Chmod(path, *attr.Mode); err != nil {
@@ -330,7 +905,7 @@ func (n *FileNode) Setattr(rel string, attr *api.Attr) (*syscall.Stat_t, error)
 	}
 
 	st := syscall.Stat_t{}
-	err := syscall.Lstat(path, &st)
+	err = syscall.Lstat(path, &st)
 
 	if err != nil {
 		return nil, err
@@ -338,15 +913,138 @@ func (n *FileNode) Setattr(rel string, attr *api.Attr) (*syscall.Stat_t, error)
 	return &st, nil
 }
 
-func (n *FileNode) Read(rel string, attr *api.Attr) (*api.BlobInfo, error) {
-	if attr == nil || attr.Offset == nil || attr.Size == nil {
+// stat returns the stat of the handle if fh is set, otherwise of the path.
+func (n *FileNode) stat(rel string, fh string) (*syscall.Stat_t, error) {
+	if fh != "" {
+		return n.Fstat(fh)
+	}
+	path, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(path, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// File returns the file of the handle if fh is set, otherwise opens the path.
+// done must be called when finished with the file.
+func (n *FileNode) File(rel string, fh string, flag int) (*os.File, func(), error) {
+	if fh != "" {
+		h, err := n.Handles.Get(fh)
+		if err != nil {
+			return nil, nil, err
+		}
+		return h.File, func() {}, nil
+	}
+
+	path, err := n.resolve(rel, flag)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+// Lseek returns the offset of the next data or hole with whence SeekData
+// or SeekHole, other values are as for lseek.
+func (n *FileNode) Lseek(fh string, attr *api.Attr, whence int) (int64, error) {
+	if attr == nil || attr.Offset == nil {
+		return 0, syscall.EINVAL
+	}
+	h, err := n.Handles.Get(fh)
+	if err != nil {
+		return 0, err
+	}
+	// reads and writes are positional, the file offset is not used
+	return lseek(int(h.File.Fd()), *attr.Offset, whence)
+}
+
+// extent returns the length of the data or hole at offset up to size and
+// whether it is a hole. All is data if holes are not supported.
+func (n *FileNode) extent(rel string, fh string, offset int64, size int64) (int64, bool, error) {
+	f, done, err := n.File(rel, fh, os.O_RDONLY)
+	if err != nil {
+		return 0, false, err
+	}
+	defer done()
+
+	fd := int(f.Fd())
+	data, err := lseek(fd, offset, api.SeekData)
+	if err == syscall.ENXIO {
+		// hole up to the end
+		return size, true, nil
+	}
+	if err != nil {
+		return size, false, nil
+	}
+	if data > offset {
+		return min64(data-offset, size), true, nil
+	}
+	hole, err := lseek(fd, offset, api.SeekHole)
+	if err != nil {
+		return size, false, nil
+	}
+	return min64(hole-offset, size), false, nil
+}
+
+// Checksum returns the sums of the ranges of the file with the hash
+// algorithm, sha256 by default. The whole file is summed if no ranges are
+// given.
+func (n *FileNode) Checksum(rel string, fh string, hash string, ranges []api.Range) ([]api.Checksum, error) {
+	newHash, ok := hashes[hash]
+	if !ok {
 		return nil, syscall.EINVAL
 	}
 
-	path := n.abs(rel)
+	f, done, err := n.File(rel, fh, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-	st := syscall.Stat_t{}
-	err := syscall.Stat(path, &st)
+	if len(ranges) == 0 {
+		st := syscall.Stat_t{}
+		if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+			return nil, err
+		}
+		ranges = []api.Range{{Size: st.Size}}
+	}
+
+	sums := make([]api.Checksum, len(ranges))
+	for i, r := range ranges {
+		if r.Offset < 0 || r.Size < 0 {
+			return nil, syscall.EINVAL
+		}
+		h := newHash()
+		size, err := io.Copy(h, io.NewSectionReader(f, r.Offset, r.Size))
+		if err != nil {
+			return nil, err
+		}
+		sums[i] = api.Checksum{
+			Offset: r.Offset,
+			Size:   size,
+			Sum:    hex.EncodeToString(h.Sum(nil)),
+		}
+	}
+	return sums, nil
+}
+
+// Read returns the blob info for reading the file. The data is returned
+// directly if not larger than inline and the server max. If holes is set,
+// the size is cut at the first change between data and hole, a hole is
+// reported without data.
+func (n *FileNode) Read(rel string, fh string, attr *api.Attr, inline int64, holes bool) (*api.BlobInfo, error) {
+	if attr == nil || attr.Offset == nil || attr.Size == nil {
+		return nil, syscall.EINVAL
+	}
+
+	st, err := n.stat(rel, fh)
 	if err != nil {
 		return nil, err
 	}
@@ -369,11 +1067,40 @@ func (n *FileNode) Read(rel string, attr *api.Attr) (*api.BlobInfo, error) {
 	perm := uint32(st.Mode) & (allR)
 	bi := &api.BlobInfo{
 		Path:   rel,
+		Handle: fh,
 		Offset: *attr.Offset,
 		Size:   min(*attr.Size, st.Size-offset),
 		Perm:   perm,
 		Href:   "",
 	}
+
+	if holes && bi.Size > 0 {
+		bi.Size, bi.Hole, err = n.extent(rel, fh, bi.Offset, bi.Size)
+		if err != nil {
+			return nil, err
+		}
+		if bi.Hole {
+			return bi, nil
+		}
+	}
+
+	if bi.Size <= min(inline, n.InlineMax) {
+		f, done, err := n.File(rel, fh, os.O_RDONLY)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+
+		data := make([]byte, bi.Size)
+		sz, err := f.ReadAt(data, bi.Offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		bi.Size = int64(sz)
+		bi.Data = data[:sz]
+		return bi, nil
+	}
+
 	bi.Href, err = EncodeBlobHref(n.baseUrl, bi)
 	if err != nil {
 		return nil, err
@@ -381,15 +1108,20 @@ func (n *FileNode) Read(rel string, attr *api.Attr) (*api.BlobInfo, error) {
 	return bi, nil
 }
 
-func (n *FileNode) Write(rel string, attr *api.Attr) (*api.BlobInfo, error) {
+// Write returns the blob info for writing the file. The data is written
+// directly if provided inline and not larger than the server max.
+// Otherwise the etag precondition if set is checked again on the upload.
+func (n *FileNode) Write(rel string, fh string, attr *api.Attr, data []byte, ifMatch string) (*api.BlobInfo, error) {
 	if attr == nil || attr.Offset == nil || attr.Size == nil {
 		return nil, syscall.EINVAL
 	}
+	if fh == "" {
+		if _, err := n.writable(rel, true); err != nil {
+			return nil, err
+		}
+	}
 
-	path := n.abs(rel)
-
-	st := syscall.Stat_t{}
-	err := syscall.Stat(path, &st)
+	st, err := n.stat(rel, fh)
 	if err != nil {
 		return nil, err
 	}
@@ -398,11 +1130,35 @@ func (n *FileNode) Write(rel string, attr *api.Attr) (*api.BlobInfo, error) {
 	perm := uint32(st.Mode) & (allW)
 	bi := &api.BlobInfo{
 		Path:   rel,
+		Handle: fh,
 		Offset: *attr.Offset,
 		Size:   *attr.Size,
 		Perm:   perm,
 		Href:   "",
+
+		IfMatch: ifMatch,
 	}
+
+	// nothing to upload for size 0, of which the data is omitted
+	if data != nil || bi.Size == 0 {
+		if int64(len(data)) > n.InlineMax {
+			return nil, syscall.E2BIG
+		}
+		f, done, err := n.File(rel, fh, os.O_WRONLY)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+
+		// pwrite appends if the file is opened with O_APPEND
+		sz, err := syscall.Pwrite(int(f.Fd()), data, bi.Offset)
+		if err != nil {
+			return nil, err
+		}
+		bi.Size = int64(sz)
+		return bi, nil
+	}
+
 	bi.Href, err = EncodeBlobHref(n.baseUrl, bi)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,572 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+	"golang.org/x/sys/unix"
+)
+
+func TestReaddirPlus(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 25; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%v", i)), []byte("x"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		count int
+		pages int
+	}{
+		{10, 3},
+		{26, 1},
+		{0, 1},
+	}
+
+	for _, tc := range tests {
+		seen := make(map[string]bool)
+		var cookie int64
+		var pages int
+		for {
+			page, err := n.ReaddirPlus("/", cookie, tc.count)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if len(page.Entries) > 0 {
+				pages++
+			}
+			for _, v := range page.Entries {
+				if seen[v.Name] {
+					t.Fatalf("count %v: duplicate: %v", tc.count, v.Name)
+				}
+				seen[v.Name] = true
+				if v.Name == "d" && v.Stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+					t.Fatalf("mode: %o", v.Stat.Mode)
+				}
+			}
+			if page.EOF {
+				break
+			}
+			cookie = page.Cookie
+		}
+		if len(seen) != 26 || pages != tc.pages {
+			t.Fatalf("count %v: entries: %v pages: %v", tc.count, len(seen), pages)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	sum := func(offset, size int64, s string) api.Checksum {
+		return api.Checksum{Offset: offset, Size: size, Sum: s}
+	}
+	tests := []struct {
+		hash   string
+		ranges []api.Range
+		sums   []api.Checksum
+		err    error
+	}{
+		{"", nil, []api.Checksum{sum(0, 11, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")}, nil},
+		{api.HashXXH64, nil, []api.Checksum{sum(0, 11, "45ab6734b21e6968")}, nil},
+		// the last range is cut at the end of the file
+		{api.HashSHA256, []api.Range{{Offset: 0, Size: 5}, {Offset: 6, Size: 100}}, []api.Checksum{
+			sum(0, 5, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"),
+			sum(6, 5, "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7"),
+		}, nil},
+		{"md5", nil, nil, syscall.EINVAL},
+		{"", []api.Range{{Offset: -1, Size: 1}}, nil, syscall.EINVAL},
+	}
+
+	for _, tc := range tests {
+		sums, err := n.Checksum("/f", "", tc.hash, tc.ranges)
+		if err != tc.err {
+			t.Fatalf("%v: expected: %v got: %v", tc.hash, tc.err, err)
+		}
+		if !reflect.DeepEqual(sums, tc.sums) {
+			t.Fatalf("%v: expected: %v got: %v", tc.hash, tc.sums, sums)
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	v1, err := n.ETag("/f", "", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var writes int
+	write := func() error {
+		writes++
+		return os.WriteFile(filepath.Join(dir, "f"), []byte(fmt.Sprintf("v%v longer", writes)), 0644)
+	}
+
+	tests := []struct {
+		path string
+		etag string
+		err  error
+	}{
+		{"/f", v1, nil},
+		// changed by the previous write
+		{"/f", v1, api.ErrConflict},
+		{"/f", "*", nil},
+		{"/f", "", nil},
+		{"/none", "*", syscall.ENOENT},
+	}
+
+	for i, tc := range tests {
+		if err := n.IfMatch(tc.path, "", tc.etag, true, write); err != tc.err {
+			t.Fatalf("%v: %q expected: %v got: %v", i, tc.etag, tc.err, err)
+		}
+	}
+	if writes != 3 {
+		t.Fatalf("writes: %v", writes)
+	}
+
+	// a symlink is matched itself if not followed, as for unlink
+	if err := os.Symlink("f", filepath.Join(dir, "l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	target, _ := n.ETag("/l", "", true)
+	link, _ := n.ETag("/l", "", false)
+	if cur, _ := n.ETag("/f", "", true); target != cur || link == target {
+		t.Fatalf("symlink etag: %v %v %v", link, target, cur)
+	}
+	nop := func() error { return nil }
+	if err := n.IfMatch("/l", "", target, false, nop); err != api.ErrConflict {
+		t.Fatalf("target etag: %v", err)
+	}
+	if err := n.IfMatch("/l", "", link, false, nop); err != nil {
+		t.Fatalf("link etag: %v", err)
+	}
+}
+
+func TestETag(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for _, name := range []string{"f", "g"} {
+		if err := os.WriteFile(p(name), []byte("v1"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	fi, err := os.Stat(p("f"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func() error
+	}{
+		{"same size, mtime kept", func() error {
+			if err := os.WriteFile(p("f"), []byte("v2"), 0644); err != nil {
+				return err
+			}
+			return os.Chtimes(p("f"), fi.ModTime(), fi.ModTime())
+		}},
+		{"replaced, mtime kept", func() error {
+			if err := os.Chtimes(p("g"), fi.ModTime(), fi.ModTime()); err != nil {
+				return err
+			}
+			return os.Rename(p("g"), p("f"))
+		}},
+	}
+
+	for _, tc := range tests {
+		old, err := n.ETag("/f", "", true)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		// past the granularity of the timestamps
+		time.Sleep(20 * time.Millisecond)
+		if err := tc.change(); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if cur, _ := n.ETag("/f", "", true); cur == old {
+			t.Fatalf("%v: etag unchanged: %v", tc.name, cur)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	if err := os.WriteFile(p("f"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("f", p("l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	flags := uint32(os.O_RDWR | os.O_CREATE)
+	perm := uint32(0644)
+	open := func(name string) string {
+		fh, err := n.Open("c", name, &api.Attr{Mode: &flags, Perm: &perm})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return fh.ID
+	}
+	rng := func(offset, size int64) *api.Attr {
+		return &api.Attr{Offset: &offset, Size: &size}
+	}
+	fh := open("/f")
+	gh := open("/g")
+
+	tests := []struct {
+		path    string
+		fh      string
+		attr    *api.Attr
+		to      string
+		toFh    string
+		toOff   int64
+		written int64
+		err     error
+		file    string
+		want    string
+	}{
+		// same file, also through the symlink and the handle
+		{"/f", "", nil, "/f", "", 0, 0, syscall.EINVAL, "f", "0123456789"},
+		{"/f", "", nil, "/l", "", 0, 0, syscall.EINVAL, "f", "0123456789"},
+		{"/f", "", rng(0, 4), "", fh, 2, 0, syscall.EINVAL, "f", "0123456789"},
+		{"/f", "", rng(0, 4), "/f", "", 6, 4, nil, "f", "0123450123"},
+		// cross handle
+		{"", fh, rng(2, 3), "", gh, 1, 3, nil, "g", "\x00234"},
+		{"/f", "", nil, "/h", "", 0, 10, nil, "h", "0123450123"},
+		// zero length, not to the end
+		{"", fh, rng(2, 0), "", gh, 1, 0, nil, "g", "\x00234"},
+		{"/f", "", rng(2, 0), "/z", "", 0, 0, nil, "z", ""},
+	}
+
+	for i, tc := range tests {
+		written, err := n.Copy(tc.path, tc.fh, tc.attr, tc.to, tc.toFh, tc.toOff)
+		if err != tc.err || written != tc.written {
+			t.Fatalf("%v: expected: %v %v got: %v %v", i, tc.written, tc.err, written, err)
+		}
+		if b, _ := os.ReadFile(p(tc.file)); string(b) != tc.want {
+			t.Fatalf("%v: %q", i, b)
+		}
+	}
+}
+
+func TestStateHidden(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, txDir), 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, txDir, "journal"), []byte("{}"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	mode := uint32(0777)
+	for _, p := range []string{"/.nomad", "/.nomad/tx/journal", "/x/../.nomad/tx"} {
+		if _, err := n.Lstat(p); err != syscall.ENOENT {
+			t.Fatalf("lstat %v: %v", p, err)
+		}
+		if err := n.Chmod(p, &api.Attr{Mode: &mode}); err != syscall.ENOENT {
+			t.Fatalf("chmod %v: %v", p, err)
+		}
+		if _, err := n.RemoveAll(p); err != syscall.ENOENT {
+			t.Fatalf("remove %v: %v", p, err)
+		}
+	}
+	if _, err := n.Symlink("/.nomad/tx", "/l"); err != syscall.ENOENT {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	list, err := n.Readdir("/")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	page, err := n.ReaddirPlus("/", 0, 0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(list) != 1 || list[0].Name != "f" || len(page.Entries) != 1 || page.Entries[0].Name != "f" {
+		t.Fatalf("entries: %v %v", list, page.Entries)
+	}
+
+	job, err := n.ChmodAll("/", &api.Attr{Mode: &mode})
+	waitJob(t, n, job, err)
+	fi, err := os.Stat(filepath.Join(dir, txDir, "journal"))
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("journal: %v %v", fi, err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	n.InlineMax = 4
+
+	tests := []struct {
+		data []byte
+		size int64
+		href bool
+		err  error
+	}{
+		{[]byte("v2"), 2, false, nil},
+		// the data of size 0 is omitted in the args
+		{nil, 0, false, nil},
+		{nil, 8, true, nil},
+		{[]byte("v2 longer"), 9, false, syscall.E2BIG},
+	}
+	for i, tc := range tests {
+		off := int64(0)
+		bi, err := n.Write("/f", "", &api.Attr{Offset: &off, Size: &tc.size}, tc.data, "")
+		if err != tc.err {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if err == nil && (bi.Href != "") != tc.href {
+			t.Fatalf("%v: %+v", i, bi)
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "f")); string(b) != "v2" {
+		t.Fatalf("data: %q", b)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("f", filepath.Join(dir, "l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = n.Setxattr("/f", "user.a", []byte("1"), 0)
+	if err == syscall.ENOTSUP {
+		t.Skip("xattrs not supported")
+	}
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// an empty value is set, not removed
+	if err := n.Setxattr("/f", "user.b", nil, 0); err != nil {
+		t.Fatalf("set empty: %v", err)
+	}
+	if err := n.Setxattr("/f", "user.a", []byte("2"), unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Fatalf("create: %v", err)
+	}
+	if err := n.Setxattr("/f", "user.c", []byte("2"), unix.XATTR_REPLACE); err != syscall.ENODATA {
+		t.Fatalf("replace: %v", err)
+	}
+
+	if v, err := n.Getxattr("/f", "user.a"); err != nil || string(v) != "1" {
+		t.Fatalf("get: %q %v", v, err)
+	}
+	if v, err := n.Getxattr("/f", "user.b"); err != nil || len(v) != 0 {
+		t.Fatalf("get empty: %q %v", v, err)
+	}
+	// symlinks are not followed
+	if _, err := n.Getxattr("/l", "user.a"); err != syscall.ENODATA {
+		t.Fatalf("get link: %v", err)
+	}
+	names, err := n.Listxattr("/f")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"user.a", "user.b"}) {
+		t.Fatalf("list: %v", names)
+	}
+
+	if err := n.Removexattr("/f", "user.a"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := n.Removexattr("/f", "user.a"); err != syscall.ENODATA {
+		t.Fatalf("remove again: %v", err)
+	}
+	if _, err := n.Getxattr("/f", "user.a"); err != syscall.ENODATA {
+		t.Fatalf("get removed: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		name string
+		err  error
+	}{
+		{"/f", "", syscall.EINVAL},
+		{"/missing", "user.a", syscall.ENOENT},
+		{"/" + stateDir, "user.a", syscall.ENOENT},
+	}
+	for i, tc := range tests {
+		if _, err := n.Getxattr(tc.path, tc.name); err != tc.err {
+			t.Fatalf("%v: get: %v", i, err)
+		}
+		if err := n.Setxattr(tc.path, tc.name, []byte("1"), 0); err != tc.err && !(tc.err == syscall.ENOENT && err == syscall.EROFS) {
+			t.Fatalf("%v: set: %v", i, err)
+		}
+		if err := n.Removexattr(tc.path, tc.name); err != tc.err && !(tc.err == syscall.ENOENT && err == syscall.EROFS) {
+			t.Fatalf("%v: remove: %v", i, err)
+		}
+	}
+}
+
+func TestLseek(t *testing.T) {
+	dir := t.TempDir()
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// data, a hole, data and a hole up to the end
+	const block = 1 << 20
+	f, err := os.Create(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := bytes.Repeat([]byte("x"), block)
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := f.WriteAt(data, 2*block); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := f.Truncate(4 * block); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+
+	flags, perm := uint32(os.O_RDONLY), uint32(0)
+	fh, err := n.Open("c", "/f", &api.Attr{Mode: &flags, Perm: &perm})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	at := func(offset int64) *api.Attr {
+		return &api.Attr{Offset: &offset}
+	}
+	if off, err := n.Lseek(fh.ID, at(0), api.SeekHole); err != nil || off == 4*block {
+		t.Skip("holes not supported")
+	}
+
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+		err    error
+	}{
+		{0, api.SeekData, 0, nil},
+		{0, api.SeekHole, block, nil},
+		{block, api.SeekData, 2 * block, nil},
+		{block + 1, api.SeekHole, block + 1, nil},
+		{2 * block, api.SeekHole, 3 * block, nil},
+		{3 * block, api.SeekData, 0, syscall.ENXIO},
+		{3 * block, api.SeekHole, 3 * block, nil},
+		{4 * block, api.SeekHole, 0, syscall.ENXIO},
+		{5, io.SeekStart, 5, nil},
+	}
+	for i, tc := range tests {
+		off, err := n.Lseek(fh.ID, at(tc.offset), tc.whence)
+		if err != tc.err || (err == nil && off != tc.want) {
+			t.Fatalf("%v: expected: %v %v got: %v %v", i, tc.want, tc.err, off, err)
+		}
+	}
+	if _, err := n.Lseek(fh.ID, nil, api.SeekData); err != syscall.EINVAL {
+		t.Fatalf("no offset: %v", err)
+	}
+	if _, err := n.Lseek("missing", at(0), api.SeekData); err == nil {
+		t.Fatalf("no handle")
+	}
+
+	// reads report the holes if asked, up to the next data
+	size := int64(3 * block)
+	reads := []struct {
+		offset int64
+		holes  bool
+		size   int64
+		hole   bool
+	}{
+		{0, true, block, false},
+		{block / 2, true, block / 2, false},
+		{block, true, block, true},
+		{3 * block, true, block, true},
+		{block, false, 3 * block, false},
+	}
+	for i, tc := range reads {
+		bi, err := n.Read("/f", "", &api.Attr{Offset: &tc.offset, Size: &size}, 0, tc.holes)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if bi.Size != tc.size || bi.Hole != tc.hole {
+			t.Fatalf("%v: %+v", i, bi)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+const defaultPutPerm = 0644
+
+// Put replaces the whole file with the content read from r, or of the file
+// opts.From, atomically. The content is written to a temp file in the same
+// directory renamed over the path once complete, so readers see either the
+// old or the new file. verify if set is called after the content is read
+// and fails the put if it returns an error. With opts.Tx the file is staged
+// in the transaction instead, see StagePut.
+func (n *FileNode) Put(rel string, r io.Reader, opts *api.PutOptions, verify func() error) (*syscall.Stat_t, error) {
+	if opts == nil {
+		opts = &api.PutOptions{}
+	}
+	if opts.Tx != "" {
+		return n.StagePut(opts.Tx, rel, r, opts, verify)
+	}
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return nil, err
+	}
+	if path == n.Root {
+		return nil, syscall.EISDIR
+	}
+
+	dir := filepath.Dir(path)
+	f, err := n.writeTemp(dir, path, r, opts, verify)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = n.IfMatch(rel, "", opts.IfMatch, true, func() error {
+		return os.Rename(f.Name(), path)
+	})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if opts.Sync {
+		if err := syncDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// writeTemp writes the content of the put of path to a new temp file in
+// dir. The permissions and owner are those of an existing file at path
+// unless set in opts. The file is removed on errors.
+func (n *FileNode) writeTemp(dir string, path string, r io.Reader, opts *api.PutOptions, verify func() error) (*os.File, error) {
+	perm := uint32(defaultPutPerm)
+	var owner *api.Owner
+	old := syscall.Stat_t{}
+	if err := syscall.Stat(path, &old); err == nil {
+		if isDir(&old) {
+			return nil, syscall.EISDIR
+		}
+		perm = uint32(old.Mode) & 07777
+		owner = &api.Owner{Uid: int(old.Uid), Gid: int(old.Gid)}
+	}
+	if opts.Perm != nil {
+		perm = *opts.Perm
+	}
+
+	if opts.From != "" {
+		from, err := n.path(opts.From)
+		if err != nil {
+			return nil, err
+		}
+		in, err := os.Open(from)
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		r = in
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err := fill(f, r); err != nil {
+		return nil, err
+	}
+	if verify != nil {
+		if err := verify(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := f.Chmod(os.FileMode(perm)); err != nil {
+		return nil, err
+	}
+	if opts.Owner != nil {
+		if err := f.Chown(opts.Owner.Uid, opts.Owner.Gid); err != nil {
+			return nil, err
+		}
+	} else if owner != nil {
+		// kept where permitted
+		f.Chown(owner.Uid, owner.Gid)
+	}
+	if opts.Sync {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	ok = true
+	return f, nil
+}
+
+// fill copies r to the file, in the kernel if r is a file.
+func fill(f *os.File, r io.Reader) error {
+	if in, ok := r.(*os.File); ok {
+		fi, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return syscall.EISDIR
+		}
+		_, err = copyData(in, 0, f, 0, fi.Size())
+		return err
+	}
+	_, err := io.CopyBuffer(f, r, make([]byte, copyBufferSize))
+	return err
+}
+
+// syncDir flushes the entries of the directory.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestPut(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	if err := os.WriteFile(p("f"), []byte("old"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	old, _ := n.ETag("/f", "", true)
+	perm := uint32(0640)
+	errVerify := errors.New("verify")
+
+	tests := []struct {
+		path    string
+		content string
+		opts    *api.PutOptions
+		verify  func() error
+		err     error
+		want    string
+		perm    os.FileMode
+	}{
+		// mode kept
+		{"/f", "new", &api.PutOptions{IfMatch: old, Sync: true}, nil, nil, "new", 0600},
+		{"/f", "newer", &api.PutOptions{IfMatch: old}, nil, api.ErrConflict, "new", 0600},
+		{"/f", "bad", nil, func() error { return errVerify }, errVerify, "new", 0600},
+		{"/g", "", &api.PutOptions{From: "/f", Perm: &perm}, nil, nil, "new", 0640},
+		{"/h", "x", nil, nil, nil, "x", 0644},
+		{"/", "x", nil, nil, syscall.EISDIR, "", 0},
+	}
+
+	for i, tc := range tests {
+		_, err := n.Put(tc.path, strings.NewReader(tc.content), tc.opts, tc.verify)
+		if err != tc.err {
+			t.Fatalf("%v: expected: %v got: %v", i, tc.err, err)
+		}
+		if tc.want == "" {
+			continue
+		}
+		b, _ := os.ReadFile(p(tc.path))
+		fi, _ := os.Stat(p(tc.path))
+		if string(b) != tc.want || fi.Mode().Perm() != tc.perm {
+			t.Fatalf("%v: %q %v", i, b, fi.Mode())
+		}
+	}
+
+	// no temp files left
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Fatalf("entries: %v", entries)
+	}
+}
@@ -0,0 +1,372 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/google/uuid"
+)
+
+// snapshots of the root, a directory for each holding the tree and its meta
+const snapshotDir = stateDir + "/snapshots"
+
+const (
+	snapshotData = "data"
+	snapshotMeta = "meta.json"
+)
+
+// SnapshotsPath is the virtual directory of the snapshots, read only. The
+// tree of a snapshot is at SnapshotsPath/<name>/. It hides a real entry of
+// the name in the root, NewFileNode fails if there is one.
+const SnapshotsPath = "/.snapshots"
+
+// IsSnapshot reports whether the path is in the snapshots.
+func IsSnapshot(rel string) bool {
+	p := filepath.Clean("/" + rel)
+	return p == SnapshotsPath || strings.HasPrefix(p, SnapshotsPath+"/")
+}
+
+// snapshotPath returns the path under the root of the path in the
+// snapshots.
+func (n *FileNode) snapshotPath(rel string) string {
+	p := strings.TrimPrefix(filepath.Clean("/"+rel), SnapshotsPath)
+	name, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if name == "" {
+		return filepath.Join(n.Root, snapshotDir)
+	}
+	return filepath.Join(n.Root, snapshotDir, name, snapshotData, rest)
+}
+
+func validSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// CreateSnapshot starts a job capturing the file or directory tree at rel
+// as the snapshot of the name. The files are copied, cloned by reflink
+// where the file system supports it, or with api.SnapshotReflink only
+// cloned, failing with ENOTSUP on other file systems. Modes, modification
+// times and owners where permitted are kept. The state of the server is
+// left out.
+func (n *FileNode) CreateSnapshot(name string, rel string, method string) (*api.Job, error) {
+	if err := validSnapshotName(name); err != nil {
+		return nil, err
+	}
+	switch method {
+	case "":
+		method = api.SnapshotCopy
+	case api.SnapshotCopy, api.SnapshotReflink:
+	default:
+		return nil, syscall.EINVAL
+	}
+	if IsSnapshot(rel) {
+		return nil, syscall.EINVAL
+	}
+	from := n.abs(rel)
+	if _, err := n.Lstat(rel); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(n.Root, snapshotDir, name)
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, api.ToErrno(err)
+	}
+
+	return n.Jobs.Start("snapshot", rel, name, func(ctx context.Context, j *Job) error {
+		err := n.cloneTree(ctx, j, from, filepath.Join(dir, snapshotData), method == api.SnapshotReflink)
+		if err == nil {
+			info := j.info()
+			b, _ := json.Marshal(&api.Snapshot{
+				Name:    name,
+				Path:    filepath.Clean("/" + rel),
+				Method:  method,
+				Files:   info.Files,
+				Bytes:   info.Bytes,
+				Created: info.Created,
+			})
+			err = os.WriteFile(filepath.Join(dir, snapshotMeta), b, 0600)
+		}
+		if err != nil {
+			removeTree(dir)
+		}
+		return err
+	})
+}
+
+// Snapshot returns the snapshot, ENOENT while it is created.
+func (n *FileNode) Snapshot(name string) (*api.Snapshot, error) {
+	if err := validSnapshotName(name); err != nil {
+		return nil, syscall.ENOENT
+	}
+	b, err := os.ReadFile(filepath.Join(n.Root, snapshotDir, name, snapshotMeta))
+	if err != nil {
+		return nil, api.ToErrno(err)
+	}
+	var s api.Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListSnapshots returns the snapshots, oldest first.
+func (n *FileNode) ListSnapshots() ([]api.Snapshot, error) {
+	dirs, err := os.ReadDir(filepath.Join(n.Root, snapshotDir))
+	if os.IsNotExist(err) {
+		return []api.Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]api.Snapshot, 0, len(dirs))
+	for _, d := range dirs {
+		if s, err := n.Snapshot(d.Name()); err == nil {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+func (n *FileNode) DeleteSnapshot(name string) error {
+	if _, err := n.Snapshot(name); err != nil {
+		return err
+	}
+	return removeTree(filepath.Join(n.Root, snapshotDir, name))
+}
+
+// RestoreSnapshot starts a job restoring the file or tree at rel in the
+// snapshot to its path, or to the path to if set. What is there is replaced
+// as a whole, moved into the trash if enabled.
+func (n *FileNode) RestoreSnapshot(name string, rel string, to string) (*api.Job, error) {
+	s, err := n.Snapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	rel = filepath.Clean("/" + rel)
+	if to == "" {
+		to = filepath.Join(s.Path, rel)
+	}
+	to = filepath.Clean("/" + to)
+	if to != "/" {
+		if _, err := n.clientPath(to); err != nil {
+			return nil, err
+		}
+	}
+	from := filepath.Join(n.Root, snapshotDir, name, snapshotData, rel)
+	if _, err := os.Lstat(from); err != nil {
+		return nil, api.ToErrno(err)
+	}
+
+	return n.Jobs.Start("restoresnapshot", rel, to, func(ctx context.Context, j *Job) error {
+		return n.restoreTree(ctx, j, from, to)
+	})
+}
+
+// restoreTree replaces the entry at to with a copy of the tree at from. The
+// root is restored entry by entry, those missing in the snapshot are
+// removed except the state of the server.
+func (n *FileNode) restoreTree(ctx context.Context, j *Job, from string, to string) error {
+	dst := n.abs(to)
+	if dst != n.Root {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".restore-"+id.String())
+		if err := n.cloneTree(ctx, j, from, tmp, false); err != nil {
+			removeTree(tmp)
+			return err
+		}
+		if err := n.replaceTree(tmp, dst, to); err != nil {
+			removeTree(tmp)
+			return err
+		}
+		return nil
+	}
+
+	fi, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{
+		filepath.Base(stateDir): true,
+	}
+	for _, e := range entries {
+		keep[e.Name()] = true
+		if err := n.restoreTree(ctx, j, filepath.Join(from, e.Name()), "/"+e.Name()); err != nil {
+			return err
+		}
+	}
+	live, err := os.ReadDir(n.Root)
+	if err != nil {
+		return err
+	}
+	for _, e := range live {
+		if keep[e.Name()] {
+			continue
+		}
+		p := filepath.Join(n.Root, e.Name())
+		if _, ok, err := n.moveToTrash("/"+e.Name(), p); ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := removeTree(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceTree renames tmp to dst. An existing file is replaced atomically
+// by a file, otherwise what is there is moved into the trash if enabled or
+// aside and removed.
+func (n *FileNode) replaceTree(tmp string, dst string, to string) error {
+	old := syscall.Stat_t{}
+	if err := syscall.Lstat(dst, &old); err == nil {
+		st := syscall.Stat_t{}
+		if err := syscall.Lstat(tmp, &st); err != nil {
+			return err
+		}
+		if _, ok, err := n.moveToTrash(to, dst); ok {
+			if err != nil {
+				return err
+			}
+		} else if isDir(&old) || isDir(&st) {
+			aside := tmp + ".old"
+			if err := os.Rename(dst, aside); err != nil {
+				return err
+			}
+			defer removeTree(aside)
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+// cloneTree copies the file or the directory tree at from to to, which must
+// not exist. Modes, modification times and owners where permitted are kept.
+// Regular files are only cloned by reflink if reflink is set. The state of
+// the server is skipped.
+func (n *FileNode) cloneTree(ctx context.Context, j *Job, from, to string, reflink bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if from == filepath.Join(n.Root, stateDir) {
+		return nil
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(from, &st); err != nil {
+		return err
+	}
+	mode := uint32(st.Mode)
+
+	var size int64
+	var err error
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		// writable until all entries are cloned
+		if err = os.Mkdir(to, 0700); err != nil {
+			break
+		}
+		var entries []os.DirEntry
+		if entries, err = os.ReadDir(from); err != nil {
+			break
+		}
+		for _, e := range entries {
+			if err := n.cloneTree(ctx, j, filepath.Join(from, e.Name()), filepath.Join(to, e.Name()), reflink); err != nil {
+				return err
+			}
+		}
+		err = syscall.Chmod(to, mode&07777)
+	case syscall.S_IFLNK:
+		var target string
+		if target, err = os.Readlink(from); err == nil {
+			err = os.Symlink(target, to)
+		}
+	case syscall.S_IFREG:
+		if reflink {
+			size, err = reflinkFile(from, to, mode&07777)
+		} else {
+			size, err = copyFile(ctx, from, to, mode&07777)
+		}
+		if err == nil {
+			// not by the umask
+			err = syscall.Chmod(to, mode&07777)
+		}
+	default:
+		err = syscall.Mknod(to, mode, int(st.Rdev))
+	}
+	if err != nil {
+		return &os.PathError{Op: "clone", Path: n.relPath(from), Err: api.ToErrno(err)}
+	}
+
+	os.Lchown(to, int(st.Uid), int(st.Gid))
+	if mode&syscall.S_IFMT != syscall.S_IFLNK {
+		mt := time.Unix(0, syscall.TimespecToNsec(mtime(&st)))
+		os.Chtimes(to, mt, mt)
+	}
+	j.Progress(1, size)
+	return nil
+}
+
+// reflinkFile clones the file, failing where the file system does not
+// support it.
+func reflinkFile(from, to string, perm uint32) (int64, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(perm))
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	if err := cloneFile(int(out.Fd()), int(in.Fd())); err != nil {
+		return 0, err
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// removeTree removes the tree, also directories without write permission.
+func removeTree(path string) error {
+	walkTree(context.Background(), path, false, func(p string, st *syscall.Stat_t) error {
+		if isDir(st) {
+			syscall.Chmod(p, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
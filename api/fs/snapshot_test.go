@@ -0,0 +1,211 @@
+package fs
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(p(name))
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+	if err := os.MkdirAll(p("app/etc"), 0750); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"app/bin", "app/etc/conf"} {
+		if err := os.WriteFile(p(name), []byte("v1"), 0640); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := os.Symlink("etc/conf", p("app/l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	job, err := n.CreateSnapshot("s1", "/app", "")
+	job = waitJob(t, n, job, err)
+	if job.State != api.Done || job.Files != 5 {
+		t.Fatalf("snapshot: %+v", job)
+	}
+	job, err = n.CreateSnapshot("s2", "/", api.SnapshotCopy)
+	job = waitJob(t, n, job, err)
+	if job.State != api.Done {
+		t.Fatalf("snapshot: %+v", job)
+	}
+	if _, err := n.CreateSnapshot("s1", "/app", ""); err != syscall.EEXIST {
+		t.Fatalf("exists: %v", err)
+	}
+	if list, err := n.ListSnapshots(); err != nil || len(list) != 2 || list[0].Path != "/app" || list[0].Bytes != 4 {
+		t.Fatalf("list: %+v %v", list, err)
+	}
+
+	// the live tree changes, the snapshots do not
+	os.WriteFile(p("app/bin"), []byte("v2"), 0640)
+	os.WriteFile(p("app/new"), []byte("v2"), 0640)
+	st, err := n.Lstat("/.snapshots/s1/etc")
+	if err != nil || st.Mode&0777 != 0750 {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if b, err := os.ReadFile(n.abs("/.snapshots/s1/bin")); err != nil || string(b) != "v1" {
+		t.Fatalf("snapshot: %q %v", b, err)
+	}
+	if _, err := n.Lstat("/.snapshots/s2/.nomad"); err != syscall.ENOENT {
+		t.Fatalf("state: %v", err)
+	}
+	if b, err := os.ReadFile(n.abs("/.snapshots/s2/app/bin")); err != nil || string(b) != "v1" {
+		t.Fatalf("snapshot: %q %v", b, err)
+	}
+
+	// a file, then the whole tree
+	job, err = n.RestoreSnapshot("s1", "/bin", "/bin.old")
+	waitJob(t, n, job, err)
+	if read("bin.old") != "v1" || read("app/bin") != "v2" {
+		t.Fatalf("restore: %q", read("bin.old"))
+	}
+	job, err = n.RestoreSnapshot("s1", "/", "")
+	job = waitJob(t, n, job, err)
+	if job.State != api.Done {
+		t.Fatalf("restore: %+v", job)
+	}
+	if read("app/bin") != "v1" {
+		t.Fatalf("restore: %q", read("app/bin"))
+	}
+	if _, err := os.Lstat(p("app/new")); !os.IsNotExist(err) {
+		t.Fatalf("restore: %v", err)
+	}
+	if link, err := os.Readlink(p("app/l")); err != nil || link != "etc/conf" {
+		t.Fatalf("restore: %q %v", link, err)
+	}
+	if _, err := n.RestoreSnapshot("s1", "/", "/.snapshots/x"); err != syscall.EINVAL {
+		t.Fatalf("restore: %v", err)
+	}
+
+	if err := n.DeleteSnapshot("s1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := n.Lstat("/.snapshots/s1"); err != syscall.ENOENT {
+		t.Fatalf("delete: %v", err)
+	}
+}
+
+func TestSnapshotReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	job, err := n.CreateSnapshot("s", "/", "")
+	waitJob(t, n, job, err)
+	if _, err := n.Symlink("/.snapshots/s", "/l"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	mode := uint32(0600)
+	rdonly, rdwr := uint32(os.O_RDONLY), uint32(os.O_RDWR)
+	for _, p := range []string{"/.snapshots/s/f", "/l/f"} {
+		if err := n.Chmod(p, &api.Attr{Mode: &mode}); err != syscall.EROFS {
+			t.Fatalf("chmod %v: %v", p, err)
+		}
+		if _, err := n.Open("c", p, &api.Attr{Mode: &rdwr, Perm: &mode}); err != syscall.EROFS {
+			t.Fatalf("open %v: %v", p, err)
+		}
+		if _, err := n.Mkdir(p+".d", &api.Attr{Mode: &mode}); err != syscall.EROFS {
+			t.Fatalf("mkdir %v: %v", p, err)
+		}
+		if err := n.Setxattr(p, "user.x", nil, 0); err != syscall.EROFS {
+			t.Fatalf("setxattr %v: %v", p, err)
+		}
+		if _, err := n.Put(p, strings.NewReader("v2"), &api.PutOptions{}, nil); err != syscall.EROFS {
+			t.Fatalf("put %v: %v", p, err)
+		}
+		fh, err := n.Open("c", p, &api.Attr{Mode: &rdonly, Perm: &mode})
+		if err != nil {
+			t.Fatalf("open %v: %v", p, err)
+		}
+		if _, err := n.Fsetattr(fh.ID, &api.Attr{Mode: &mode}); err != syscall.EROFS {
+			t.Fatalf("fsetattr %v: %v", p, err)
+		}
+	}
+	if err := n.Unlink("/.snapshots/s/f"); err != syscall.EROFS {
+		t.Fatalf("unlink: %v", err)
+	}
+	if _, err := n.Lstat("/.nomad/snapshots/s/data/f"); err != syscall.ENOENT {
+		t.Fatalf("state: %v", err)
+	}
+	if b, err := os.ReadFile(n.abs("/.snapshots/s/f")); err != nil || string(b) != "v1" {
+		t.Fatalf("snapshot: %q %v", b, err)
+	}
+	// the link itself is not in the snapshots
+	if err := n.Unlink("/l"); err != nil {
+		t.Fatalf("unlink: %v", err)
+	}
+}
+
+func TestSnapshotReflink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	job, err := n.CreateSnapshot("s", "/", api.SnapshotReflink)
+	job = waitJob(t, n, job, err)
+	if job.Status == syscall.ENOTSUP {
+		if _, err := n.Snapshot("s"); err != syscall.ENOENT {
+			t.Fatalf("failed snapshot: %v", err)
+		}
+		t.Skip("reflink not supported")
+	}
+	if job.State != api.Done {
+		t.Fatalf("snapshot: %+v", job)
+	}
+
+	// in place changes of the live file are not seen in the clone
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("v2"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if b, err := os.ReadFile(n.abs("/.snapshots/s/f")); err != nil || string(b) != "v1" {
+		t.Fatalf("snapshot: %q %v", b, err)
+	}
+}
+
+func TestSnapshotsPathTaken(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, SnapshotsPath), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// would be hidden by the snapshots
+	u, _ := url.Parse("http://localhost:58080/")
+	if _, err := NewFileNode(dir, u, NewHandleTable(0)); !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("%v", err)
+	}
+}
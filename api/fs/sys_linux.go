@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func mtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Mtim
+}
+
+func ctime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Ctim
+}
+
+// futimens sets the access and modification times of the open file. See
+// UtimeToTimespec for omitting either.
+func futimens(fd int, ts *[2]syscall.Timespec) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), 0, uintptr(unsafe.Pointer(ts)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lgetxattr returns the value of the attribute of path, not following
+// symlinks.
+func lgetxattr(path string, name string) ([]byte, error) {
+	for {
+		sz, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = unix.Lgetxattr(path, name, buf)
+		if err == unix.ERANGE {
+			// changed in between
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+func lsetxattr(path string, name string, value []byte, flags int) error {
+	return unix.Lsetxattr(path, name, value, flags)
+}
+
+// llistxattr returns the attribute names of path, not following symlinks.
+func llistxattr(path string) ([]string, error) {
+	for {
+		sz, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		names := []string{}
+		for _, v := range strings.Split(string(buf[:sz]), "\x00") {
+			if v != "" {
+				names = append(names, v)
+			}
+		}
+		return names, nil
+	}
+}
+
+func lremovexattr(path string, name string) error {
+	return unix.Lremovexattr(path, name)
+}
+
+func fallocate(fd int, mode uint32, off int64, size int64) error {
+	return unix.Fallocate(fd, mode, off, size)
+}
+
+// cloneFile clones the file by reflink.
+func cloneFile(out int, in int) error {
+	err := unix.IoctlFileClone(out, in)
+	if err == unix.EINVAL || err == unix.EXDEV || err == unix.ENOTTY {
+		return syscall.ENOTSUP
+	}
+	return err
+}
+
+// copyFileRange copies within the kernel. A reflink of the range is tried
+// first, then copy_file_range. The count is 0 on error if nothing could be
+// copied.
+func copyFileRange(in int, offIn int64, out int, offOut int64, size int64) (int64, error) {
+	if size == 0 {
+		// a clone of length 0 is to the end of the source
+		return 0, nil
+	}
+	err := unix.IoctlFileCloneRange(out, &unix.FileCloneRange{
+		Src_fd:      int64(in),
+		Src_offset:  uint64(offIn),
+		Src_length:  uint64(size),
+		Dest_offset: uint64(offOut),
+	})
+	if err == nil {
+		return size, nil
+	}
+
+	var written int64
+	for written < size {
+		n, err := unix.CopyFileRange(in, &offIn, out, &offOut, int(size-written), 0)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			break
+		}
+		written += int64(n)
+	}
+	return written, nil
+}
+
+func lseek(fd int, offset int64, whence int) (int64, error) {
+	return unix.Seek(fd, offset, whence)
+}
+
+// readdirPage reads up to count entries of the directory with getdents
+// after the one of the cookie, which is the d_off of the entry.
+func readdirPage(path string, cookie int64, count int) ([]dirent, bool, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unix.Close(fd)
+
+	if cookie != 0 {
+		if _, err := unix.Seek(fd, cookie, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+	}
+
+	nameOffset := int(unsafe.Offsetof(unix.Dirent{}.Name))
+
+	var ents []dirent
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 {
+			return ents, true, nil
+		}
+		for off := 0; off < n; {
+			d := (*unix.Dirent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+nameOffset : off+int(d.Reclen)]
+			off += int(d.Reclen)
+
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			if len(ents) == count {
+				return ents, false, nil
+			}
+			ents = append(ents, dirent{
+				Name: string(name),
+				Off:  d.Off,
+			})
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build !linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func mtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Mtimespec
+}
+
+func ctime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Ctimespec
+}
+
+func futimens(fd int, ts *[2]syscall.Timespec) error {
+	return syscall.ENOTSUP
+}
+
+func lgetxattr(path string, name string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func lsetxattr(path string, name string, value []byte, flags int) error {
+	return syscall.ENOTSUP
+}
+
+func llistxattr(path string) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func lremovexattr(path string, name string) error {
+	return syscall.ENOTSUP
+}
+
+func fallocate(fd int, mode uint32, off int64, size int64) error {
+	return syscall.ENOTSUP
+}
+
+func cloneFile(out int, in int) error {
+	return syscall.ENOTSUP
+}
+
+func copyFileRange(in int, offIn int64, out int, offOut int64, size int64) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
+
+func lseek(fd int, offset int64, whence int) (int64, error) {
+	if whence == api.SeekData || whence == api.SeekHole {
+		return 0, syscall.ENOTSUP
+	}
+	return syscall.Seek(fd, offset, whence)
+}
+
+// readdirPage reads up to count entries of the directory after the cookie,
+// which is the index of the entry plus one.
+func readdirPage(path string, cookie int64, count int) ([]dirent, bool, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ents []dirent
+	for i := int(cookie); i < len(entries); i++ {
+		if len(ents) == count {
+			return ents, false, nil
+		}
+		ents = append(ents, dirent{
+			Name: entries[i].Name(),
+			Off:  int64(i + 1),
+		})
+	}
+	return ents, true, nil
+}
@@ -0,0 +1,286 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/google/uuid"
+)
+
+// trash of deleted entries, a directory for each holding the entry and its
+// meta
+const trashDir = stateDir + "/trash"
+
+const (
+	trashData = "data"
+	trashMeta = "meta.json"
+)
+
+// how often expired entries are purged
+const trashExpireInterval = time.Minute
+
+// Trash keeps deleted files and directory trees for restore until they
+// expire.
+type Trash struct {
+	// serializes restore, purge and expiry
+	mu sync.Mutex
+
+	dir     string
+	maxAge  time.Duration
+	maxSize int64
+}
+
+// NewTrash returns the trash under the root. Entries older than maxAge are
+// purged and the oldest ones while the total size exceeds maxSize, without
+// limit if 0.
+func NewTrash(root string, maxAge time.Duration, maxSize int64) (*Trash, error) {
+	t := &Trash{
+		dir:     filepath.Join(root, trashDir),
+		maxAge:  maxAge,
+		maxSize: maxSize,
+	}
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return nil, err
+	}
+	if maxAge > 0 || maxSize > 0 {
+		go t.expireLoop()
+	}
+	return t, nil
+}
+
+// Move moves the file or directory tree at path into the trash, rel is the
+// path it is restored to. It fails with EXDEV for entries on another file
+// system than the trash.
+func (t *Trash) Move(rel string, path string) (*api.TrashEntry, error) {
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &st); err != nil {
+		return nil, err
+	}
+	e := &api.TrashEntry{
+		Path:    rel,
+		IsDir:   isDir(&st),
+		Deleted: time.Now(),
+	}
+	err := walkTree(context.Background(), path, false, func(p string, st *syscall.Stat_t) error {
+		e.Files++
+		if !isDir(st) {
+			e.Size += st.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	e.ID = id.String()
+	dir := filepath.Join(t.dir, e.ID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	b, _ := json.Marshal(e)
+	err = os.WriteFile(filepath.Join(dir, trashMeta), b, 0600)
+	if err == nil {
+		err = os.Rename(path, filepath.Join(dir, trashData))
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if t.maxSize > 0 {
+		t.Expire()
+	}
+	return e, nil
+}
+
+// List returns the entries, oldest first.
+func (t *Trash) List() ([]api.TrashEntry, error) {
+	dirs, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]api.TrashEntry, 0, len(dirs))
+	for _, d := range dirs {
+		e, err := t.entry(d.Name())
+		if err != nil {
+			// being moved or purged
+			continue
+		}
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Deleted.Before(list[j].Deleted)
+	})
+	return list, nil
+}
+
+func (t *Trash) entry(id string) (*api.TrashEntry, error) {
+	if id == "" || id != filepath.Base(id) {
+		return nil, syscall.ENOENT
+	}
+	b, err := os.ReadFile(filepath.Join(t.dir, id, trashMeta))
+	if err != nil {
+		return nil, err
+	}
+	var e api.TrashEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Restore moves the entry back to path, creating missing parents. It fails
+// with EEXIST if path exists.
+func (t *Trash) Restore(id string, path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := t.entry(id); err != nil {
+		return api.ToErrno(err)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return syscall.EEXIST
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(t.dir, id)
+	if err := os.Rename(filepath.Join(dir, trashData), path); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Purge removes the entry for good, all for "*".
+func (t *Trash) Purge(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if id != "*" {
+		if _, err := t.entry(id); err != nil {
+			return api.ToErrno(err)
+		}
+		return removeTree(filepath.Join(t.dir, id))
+	}
+	dirs, err := os.ReadDir(t.dir)
+	if err != nil {
+		return err
+	}
+	// the others are purged even if one fails
+	var first error
+	for _, d := range dirs {
+		if err := removeTree(filepath.Join(t.dir, d.Name())); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Expire purges the entries past the max age, then the oldest ones while
+// the total size exceeds the max size. Entries that fail to be removed are
+// logged and skipped.
+func (t *Trash) Expire() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list, err := t.List()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range list {
+		total += e.Size
+	}
+	for _, e := range list {
+		expired := t.maxAge > 0 && time.Since(e.Deleted) > t.maxAge
+		if !expired && (t.maxSize <= 0 || total <= t.maxSize) {
+			continue
+		}
+		if err := removeTree(filepath.Join(t.dir, e.ID)); err != nil {
+			// the size is still taken
+			log.Printf("trash %v: %v", e.ID, err)
+			continue
+		}
+		total -= e.Size
+		log.Printf("trash %v: purged %v", e.ID, e.Path)
+	}
+	return nil
+}
+
+func (t *Trash) expireLoop() {
+	ticker := time.NewTicker(trashExpireInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := t.Expire(); err != nil {
+			log.Printf("trash: %v", err)
+		}
+	}
+}
+
+// moveToTrash moves the entry at path into the trash if enabled and reports
+// whether it did. Entries on another file system than the trash and the
+// state of the server are not kept.
+func (n *FileNode) moveToTrash(rel string, path string) (*api.TrashEntry, bool, error) {
+	if n.Trash == nil {
+		return nil, false, nil
+	}
+	p, err := n.clientPath(rel)
+	if err != nil {
+		return nil, false, nil
+	}
+	e, err := n.Trash.Move(p, path)
+	if errors.Is(err, syscall.EXDEV) {
+		return nil, false, nil
+	}
+	return e, true, err
+}
+
+func (n *FileNode) ListTrash() ([]api.TrashEntry, error) {
+	if n.Trash == nil {
+		return nil, syscall.ENOTSUP
+	}
+	return n.Trash.List()
+}
+
+// RestoreTrash restores the entry to its path, or to rel if set.
+func (n *FileNode) RestoreTrash(id string, rel string) (*syscall.Stat_t, error) {
+	if n.Trash == nil {
+		return nil, syscall.ENOTSUP
+	}
+	if rel == "" {
+		e, err := n.Trash.entry(id)
+		if err != nil {
+			return nil, api.ToErrno(err)
+		}
+		rel = e.Path
+	}
+	p, err := n.clientPath(rel)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Trash.Restore(id, n.abs(p)); err != nil {
+		return nil, err
+	}
+	return n.Lstat(p)
+}
+
+func (n *FileNode) PurgeTrash(id string) error {
+	if n.Trash == nil {
+		return syscall.ENOTSUP
+	}
+	return n.Trash.Purge(id)
+}
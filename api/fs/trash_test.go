@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	if err := os.MkdirAll(p("d/sub"), 0750); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"f", "d/a", "d/sub/b"} {
+		if err := os.WriteFile(p(name), []byte("data"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := os.Mkdir(p("empty"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := n.ListTrash(); err != syscall.ENOTSUP {
+		t.Fatalf("disabled: %v", err)
+	}
+	if n.Trash, err = NewTrash(dir, 0, 0); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := n.Unlink("/f"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := n.Rmdir("/d"); err != syscall.ENOTEMPTY {
+		t.Fatalf("rmdir: %v", err)
+	}
+	if err := n.Rmdir("/empty"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	job, err := n.RemoveAll("/d")
+	job = waitJob(t, n, job, err)
+	if job.Files != 4 {
+		t.Fatalf("remove: %+v", job)
+	}
+
+	list, err := n.ListTrash()
+	if err != nil || len(list) != 3 {
+		t.Fatalf("list: %+v %v", list, err)
+	}
+	if e := list[2]; e.Path != "/d" || !e.IsDir || e.Size != 8 || e.Files != 4 {
+		t.Fatalf("list: %+v", e)
+	}
+	for _, name := range []string{"f", "d", "empty"} {
+		if _, err := os.Lstat(p(name)); !os.IsNotExist(err) {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+
+	// restore in place and to another path
+	if _, err := n.RestoreTrash(list[2].ID, ""); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if b, err := os.ReadFile(p("d/sub/b")); err != nil || string(b) != "data" {
+		t.Fatalf("restore: %q %v", b, err)
+	}
+	os.WriteFile(p("f"), nil, 0644)
+	if _, err := n.RestoreTrash(list[0].ID, ""); err != syscall.EEXIST {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := n.RestoreTrash(list[0].ID, "/x/f"); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := n.RestoreTrash(list[0].ID, ""); err != syscall.ENOENT {
+		t.Fatalf("restored: %v", err)
+	}
+
+	if err := n.PurgeTrash("*"); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if list, _ := n.ListTrash(); len(list) != 0 {
+		t.Fatalf("purge: %+v", list)
+	}
+}
+
+func TestTrashExpire(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := NewTrash(dir, time.Hour, 10)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i, size := range []int{4, 4, 4} {
+		p := filepath.Join(dir, "f")
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := tr.Move("/f", p); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+	}
+
+	// the oldest is purged past the max size
+	list, _ := tr.List()
+	if len(list) != 2 {
+		t.Fatalf("size: %+v", list)
+	}
+
+	// also trees with read only directories
+	if err := os.MkdirAll(filepath.Join(dir, "d/sub"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "d/sub/f"), nil, 0644)
+	os.Chmod(filepath.Join(dir, "d/sub"), 0500)
+	if _, err := tr.Move("/d", filepath.Join(dir, "d")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tr.maxAge = time.Nanosecond
+	if err := tr.Expire(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if list, _ := tr.List(); len(list) != 0 {
+		t.Fatalf("age: %+v", list)
+	}
+}
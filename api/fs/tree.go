@@ -0,0 +1,324 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// MkdirAll creates the directory along with any missing parents.
+func (n *FileNode) MkdirAll(rel string, attr *api.Attr) (*syscall.Stat_t, error) {
+	if attr == nil || attr.Mode == nil {
+		return nil, syscall.EINVAL
+	}
+	path, err := n.writable(rel, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(path, os.FileMode(*attr.Mode)); err != nil {
+		return nil, api.ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// RemoveAll starts a job removing the file or the directory tree, moved
+// into the trash if enabled.
+func (n *FileNode) RemoveAll(rel string) (*api.Job, error) {
+	path, err := n.writable(rel, false)
+	if err != nil {
+		return nil, err
+	}
+	if path == n.Root {
+		return nil, syscall.EBUSY
+	}
+	if _, err := n.Lstat(rel); err != nil {
+		return nil, err
+	}
+
+	return n.Jobs.Start("remove", rel, "", func(ctx context.Context, j *Job) error {
+		if e, ok, err := n.moveToTrash(rel, path); ok {
+			if err == nil {
+				j.Progress(e.Files, 0)
+			}
+			return err
+		}
+		return walkTree(ctx, path, true, func(p string, st *syscall.Stat_t) error {
+			var err error
+			if isDir(st) {
+				err = syscall.Rmdir(p)
+			} else {
+				err = syscall.Unlink(p)
+			}
+			if err != nil {
+				return &os.PathError{Op: "remove", Path: n.relPath(p), Err: err}
+			}
+			j.Progress(1, 0)
+			return nil
+		})
+	})
+}
+
+// CopyAll starts a job copying the file or the directory tree. Existing
+// directories are merged, existing files replaced. Permissions are kept,
+// owners and times are not.
+func (n *FileNode) CopyAll(rel string, to string) (*api.Job, error) {
+	from, err := n.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := n.writable(to, true)
+	if err != nil {
+		return nil, err
+	}
+	if dst == from || strings.HasPrefix(dst, from+"/") {
+		return nil, syscall.EINVAL
+	}
+	if _, err := n.Lstat(rel); err != nil {
+		return nil, err
+	}
+
+	return n.Jobs.Start("copy", rel, to, func(ctx context.Context, j *Job) error {
+		return n.copyTree(ctx, j, from, dst)
+	})
+}
+
+func (n *FileNode) copyTree(ctx context.Context, j *Job, from, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(from, &st); err != nil {
+		return err
+	}
+
+	mode := uint32(st.Mode)
+
+	var size int64
+	var err error
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		// writable until all entries are copied
+		if err := os.Mkdir(to, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		var entries []os.DirEntry
+		if entries, err = os.ReadDir(from); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := n.copyTree(ctx, j, filepath.Join(from, e.Name()), filepath.Join(to, e.Name())); err != nil {
+				return err
+			}
+		}
+		err = syscall.Chmod(to, mode&07777)
+	case syscall.S_IFLNK:
+		var link string
+		if link, err = os.Readlink(from); err == nil {
+			os.Remove(to)
+			err = os.Symlink(link, to)
+		}
+	case syscall.S_IFREG:
+		size, err = copyFile(ctx, from, to, mode&07777)
+	default:
+		os.Remove(to)
+		err = syscall.Mknod(to, mode, int(st.Rdev))
+	}
+	if err != nil {
+		return &os.PathError{Op: "copy", Path: n.relPath(from), Err: api.ToErrno(err)}
+	}
+	j.Progress(1, size)
+	return nil
+}
+
+// copyFile copies the file in chunks, it stops between them once ctx is
+// done.
+func copyFile(ctx context.Context, from, to string, perm uint32) (int64, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(perm))
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var written int64
+	for size := fi.Size(); written < size; {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := copyData(in, written, out, written, min64(copyChunkSize, size-written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			// truncated meanwhile
+			break
+		}
+	}
+	return written, nil
+}
+
+// ChmodAll starts a job changing the mode of the tree. Symlinks are skipped.
+func (n *FileNode) ChmodAll(rel string, attr *api.Attr) (*api.Job, error) {
+	if attr == nil || attr.Mode == nil {
+		return nil, syscall.EINVAL
+	}
+	if _, err := n.writable(rel, false); err != nil {
+		return nil, err
+	}
+	if _, err := n.Lstat(rel); err != nil {
+		return nil, err
+	}
+	mode := *attr.Mode
+
+	return n.Jobs.Start("chmod", rel, "", func(ctx context.Context, j *Job) error {
+		return walkTree(ctx, n.abs(rel), false, func(p string, st *syscall.Stat_t) error {
+			if p == filepath.Join(n.Root, stateDir) {
+				return filepath.SkipDir
+			}
+			if uint32(st.Mode)&syscall.S_IFMT == syscall.S_IFLNK {
+				return nil
+			}
+			if err := syscall.Chmod(p, mode); err != nil {
+				return &os.PathError{Op: "chmod", Path: n.relPath(p), Err: err}
+			}
+			j.Progress(1, 0)
+			return nil
+		})
+	})
+}
+
+// ChownAll starts a job changing the owner of the tree, symlinks themselves
+// are changed.
+func (n *FileNode) ChownAll(rel string, attr *api.Attr) (*api.Job, error) {
+	if attr == nil || attr.Owner == nil {
+		return nil, syscall.EINVAL
+	}
+	if _, err := n.writable(rel, false); err != nil {
+		return nil, err
+	}
+	if _, err := n.Lstat(rel); err != nil {
+		return nil, err
+	}
+	owner := *attr.Owner
+
+	return n.Jobs.Start("chown", rel, "", func(ctx context.Context, j *Job) error {
+		return walkTree(ctx, n.abs(rel), false, func(p string, st *syscall.Stat_t) error {
+			if p == filepath.Join(n.Root, stateDir) {
+				return filepath.SkipDir
+			}
+			if err := syscall.Lchown(p, owner.Uid, owner.Gid); err != nil {
+				return &os.PathError{Op: "chown", Path: n.relPath(p), Err: err}
+			}
+			j.Progress(1, 0)
+			return nil
+		})
+	})
+}
+
+func (n *FileNode) Job(id string) (*api.Job, error) {
+	return n.Jobs.Get(id)
+}
+
+func (n *FileNode) ListJobs() []api.Job {
+	return n.Jobs.List()
+}
+
+func (n *FileNode) CancelJob(id string) error {
+	return n.Jobs.Cancel(id)
+}
+
+// relPath returns the path of the error messages relative to the root.
+func (n *FileNode) relPath(p string) string {
+	if rel, err := n.rel(p); err == nil {
+		return filepath.Join("/", rel)
+	}
+	return p
+}
+
+// walkTree calls fn for the file or each entry of the directory tree at
+// path, depth first. Directories are visited after their entries if post is
+// set, otherwise the entries are skipped if fn returns filepath.SkipDir.
+// Symlinks are not followed. It stops at the first error or when ctx is
+// done.
+func walkTree(ctx context.Context, path string, post bool, fn func(p string, st *syscall.Stat_t) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &st); err != nil {
+		return err
+	}
+	if !isDir(&st) {
+		return fn(path, &st)
+	}
+
+	if !post {
+		if err := fn(path, &st); err == filepath.SkipDir {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := walkTree(ctx, filepath.Join(path, e.Name()), post, fn); err != nil {
+			return err
+		}
+	}
+	if post {
+		return fn(path, &st)
+	}
+	return nil
+}
+
+// isEmptyDir fails with ENOTDIR or ENOTEMPTY unless path is an empty
+// directory.
+func isEmptyDir(path string) error {
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &st); err != nil {
+		return err
+	}
+	if !isDir(&st) {
+		return syscall.ENOTDIR
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		if err == nil {
+			return syscall.ENOTEMPTY
+		}
+		return err
+	}
+	return nil
+}
+
+func isDir(st *syscall.Stat_t) bool {
+	return uint32(st.Mode)&syscall.S_IFMT == syscall.S_IFDIR
+}
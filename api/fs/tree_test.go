@@ -0,0 +1,155 @@
+package fs
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func waitJob(t *testing.T, n *FileNode, job *api.Job, err error) *api.Job {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 100; i++ {
+		job, err = n.Job(job.ID)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if job.State != api.Running {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %v still running", job.ID)
+	return nil
+}
+
+func TestTree(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	mode := uint32(0750)
+	if _, err := n.MkdirAll("/a/b/c", &api.Attr{Mode: &mode}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(p("a/b/f"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("f", p("a/b/l")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err := n.CopyAll("/a", "/a/b/x"); err != syscall.EINVAL {
+		t.Fatalf("copy into itself: %v", err)
+	}
+	job, err := n.CopyAll("/a", "/x")
+	job = waitJob(t, n, job, err)
+	if job.State != api.Done || job.Files != 5 || job.Bytes != 5 {
+		t.Fatalf("copy: %+v", job)
+	}
+	if b, err := os.ReadFile(p("x/b/l")); err != nil || string(b) != "hello" {
+		t.Fatalf("copy: %q %v", b, err)
+	}
+	if fi, err := os.Stat(p("x/b/c")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("copy: %v %v", fi.Mode(), err)
+	}
+
+	mode = 0700
+	job, err = n.ChmodAll("/x", &api.Attr{Mode: &mode})
+	job = waitJob(t, n, job, err)
+	if job.State != api.Done || job.Files != 4 {
+		t.Fatalf("chmod: %+v", job)
+	}
+	if fi, err := os.Stat(p("x/b/f")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("chmod: %v %v", fi.Mode(), err)
+	}
+
+	job, err = n.RemoveAll("/x")
+	job = waitJob(t, n, job, err)
+	if job.State != api.Done || job.Files != 5 {
+		t.Fatalf("remove: %+v", job)
+	}
+	if _, err := os.Lstat(p("x")); !os.IsNotExist(err) {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := n.RemoveAll("/"); err != syscall.EBUSY {
+		t.Fatalf("remove root: %v", err)
+	}
+	if _, err := n.RemoveAll("/x"); err != syscall.ENOENT {
+		t.Fatalf("remove missing: %v", err)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	jt := NewJobTable(0)
+
+	job, err := jt.Start("test", "/", "", func(ctx context.Context, j *Job) error {
+		j.Progress(1, 0)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := jt.Cancel(job.ID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 100 && job.State == api.Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = jt.Get(job.ID)
+	}
+	if job.State != api.Failed || job.Status != syscall.ECANCELED || job.Files != 1 {
+		t.Fatalf("cancel: %+v", job)
+	}
+	if err := jt.Cancel("x"); err != syscall.ENOENT {
+		t.Fatalf("cancel: %v", err)
+	}
+}
+
+// checksCtx is done after its Err is checked n times.
+type checksCtx struct {
+	context.Context
+	n int
+}
+
+func (c *checksCtx) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestCopyFileCancel(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "f"), filepath.Join(dir, "g")
+	if err := os.WriteFile(from, []byte("x"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Truncate(from, copyChunkSize+1); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// stopped after the first chunk
+	written, err := copyFile(&checksCtx{context.Background(), 1}, from, to, 0644)
+	if err != context.Canceled || written != copyChunkSize {
+		t.Fatalf("canceled: %v %v", written, err)
+	}
+	written, err = copyFile(context.Background(), from, to, 0644)
+	if err != nil || written != copyChunkSize+1 {
+		t.Fatalf("copy: %v %v", written, err)
+	}
+}
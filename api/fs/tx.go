@@ -0,0 +1,573 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/google/uuid"
+)
+
+// state of the server under the root, not for clients
+const stateDir = ".nomad"
+
+// staging area of transactions, a directory for each
+const txDir = stateDir + "/tx"
+
+// journal of the commit in the directory of a transaction
+const journalFile = "journal"
+
+// DefaultTxLease is how long an open transaction is kept without staging.
+const DefaultTxLease = time.Minute * 10
+
+// states of the journal
+const (
+	txCommitting = "committing"
+	txCommitted  = "committed"
+)
+
+// txOp is a staged put or delete. The put file is named by the sequence
+// number in the staging area, the replaced file is kept as its backup until
+// the commit is done.
+type txOp struct {
+	Path    string `json:"path"`
+	Seq     int    `json:"seq"`
+	Delete  bool   `json:"delete,omitempty"`
+	Existed bool   `json:"existed,omitempty"`
+
+	size    int64
+	ifMatch string
+}
+
+type txJournal struct {
+	ID    string  `json:"id"`
+	State string  `json:"state"`
+	Ops   []*txOp `json:"ops"`
+}
+
+// Tx is an open transaction, see BeginTx.
+type Tx struct {
+	mu sync.Mutex
+
+	id      string
+	dir     string
+	created time.Time
+	// last staged or looked up, renews the lease
+	used time.Time
+
+	seq  int
+	ops  []*txOp
+	done bool
+}
+
+func (tx *Tx) info(lease time.Duration) api.Tx {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	v := api.Tx{
+		ID:      tx.id,
+		Ops:     make([]api.TxOp, 0, len(tx.ops)),
+		Created: tx.created,
+		Expires: tx.used.Add(lease),
+	}
+	for _, op := range tx.ops {
+		v.Ops = append(v.Ops, api.TxOp{
+			Path:   op.Path,
+			Delete: op.Delete,
+			Size:   op.size,
+		})
+	}
+	return v
+}
+
+// unlock renews the lease and unlocks the transaction locked by lockTx.
+func (tx *Tx) unlock() {
+	tx.used = time.Now()
+	tx.mu.Unlock()
+}
+
+// set adds the op, replacing a staged one of the same path.
+func (tx *Tx) set(op *txOp) {
+	for i, v := range tx.ops {
+		if v.Path == op.Path {
+			if !v.Delete {
+				os.Remove(stagedFile(tx.dir, v))
+			}
+			tx.ops[i] = op
+			return
+		}
+	}
+	tx.ops = append(tx.ops, op)
+}
+
+func stagedFile(dir string, op *txOp) string {
+	return filepath.Join(dir, strconv.Itoa(op.Seq))
+}
+
+func backupFile(dir string, op *txOp) string {
+	return filepath.Join(dir, strconv.Itoa(op.Seq)+".old")
+}
+
+// clientPath returns the clean path of a change. The root and the state of
+// the server can not be changed by clients, also not through symlinks.
+func (n *FileNode) clientPath(rel string) (string, error) {
+	p := filepath.Clean("/" + rel)
+	if p == "/" || IsState(p) || IsSnapshot(p) {
+		return "", syscall.EINVAL
+	}
+	if _, err := n.writable(p, false); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// txLease returns the lease of open transactions.
+func (n *FileNode) txLease() time.Duration {
+	if n.TxLease <= 0 {
+		return DefaultTxLease
+	}
+	return n.TxLease
+}
+
+// BeginTx opens a transaction. Puts and deletes are staged in a directory
+// of the staging area under the root and applied together by CommitTx. It
+// is aborted if neither staged to nor looked up within the lease.
+func (n *FileNode) BeginTx() (*api.Tx, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tx := &Tx{
+		id:      id.String(),
+		dir:     filepath.Join(n.Root, txDir, id.String()),
+		created: now,
+		used:    now,
+	}
+	if err := os.MkdirAll(tx.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	n.txOnce.Do(func() {
+		go n.expireTxLoop()
+	})
+
+	n.txMu.Lock()
+	n.txs[tx.id] = tx
+	n.txMu.Unlock()
+
+	info := tx.info(n.txLease())
+	return &info, nil
+}
+
+// Tx returns the open transaction of id and renews its lease.
+func (n *FileNode) Tx(id string) (*api.Tx, error) {
+	tx, err := n.lockTx(id)
+	if err != nil {
+		return nil, err
+	}
+	tx.unlock()
+	info := tx.info(n.txLease())
+	return &info, nil
+}
+
+// ListTxs returns the open transactions, oldest first.
+func (n *FileNode) ListTxs() []api.Tx {
+	n.txMu.Lock()
+	txs := make([]*Tx, 0, len(n.txs))
+	for _, tx := range n.txs {
+		txs = append(txs, tx)
+	}
+	n.txMu.Unlock()
+
+	list := make([]api.Tx, 0, len(txs))
+	for _, tx := range txs {
+		list = append(list, tx.info(n.txLease()))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// lockTx returns the open transaction locked for staging, see unlock.
+func (n *FileNode) lockTx(id string) (*Tx, error) {
+	n.txMu.Lock()
+	tx, ok := n.txs[id]
+	n.txMu.Unlock()
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	tx.mu.Lock()
+	if tx.done {
+		tx.mu.Unlock()
+		return nil, syscall.ENOENT
+	}
+	return tx, nil
+}
+
+// takeTx closes the transaction for staging, waiting for a staging put.
+func (n *FileNode) takeTx(id string) (*Tx, error) {
+	n.txMu.Lock()
+	tx, ok := n.txs[id]
+	delete(n.txs, id)
+	n.txMu.Unlock()
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	tx.mu.Lock()
+	tx.done = true
+	tx.mu.Unlock()
+	return tx, nil
+}
+
+// StagePut stages the put of the file in the transaction, replacing one
+// staged before. The content is written as by Put and synced, as it must
+// survive a crash once committed. The mode and owner of an existing file
+// are those at staging. The if_match precondition is checked on commit.
+func (n *FileNode) StagePut(id string, rel string, r io.Reader, opts *api.PutOptions, verify func() error) (*syscall.Stat_t, error) {
+	p, err := n.clientPath(rel)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := n.lockTx(id)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.unlock()
+
+	o := *opts
+	o.Sync = true
+	f, err := n.writeTemp(tx.dir, n.abs(p), r, &o, verify)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tx.seq++
+	op := &txOp{
+		Path:    p,
+		Seq:     tx.seq,
+		ifMatch: opts.IfMatch,
+	}
+	if err := os.Rename(f.Name(), stagedFile(tx.dir, op)); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+	op.size = st.Size
+	tx.set(op)
+	return &st, nil
+}
+
+// StageDelete stages the removal of the file or directory tree in the
+// transaction, replacing an op staged before.
+func (n *FileNode) StageDelete(id string, rel string, ifMatch string) error {
+	p, err := n.clientPath(rel)
+	if err != nil {
+		return err
+	}
+	tx, err := n.lockTx(id)
+	if err != nil {
+		return err
+	}
+	defer tx.unlock()
+
+	tx.seq++
+	tx.set(&txOp{
+		Path:    p,
+		Seq:     tx.seq,
+		Delete:  true,
+		ifMatch: ifMatch,
+	})
+	return nil
+}
+
+// AbortTx discards the transaction and its staged files.
+func (n *FileNode) AbortTx(id string) error {
+	tx, err := n.takeTx(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(tx.dir)
+}
+
+// ExpireTxs aborts the open transactions not used within the lease and
+// returns the count. Transactions being staged to are kept.
+func (n *FileNode) ExpireTxs() int {
+	lease := n.txLease()
+	now := time.Now()
+
+	var expired []*Tx
+	n.txMu.Lock()
+	for id, tx := range n.txs {
+		if !tx.mu.TryLock() {
+			continue
+		}
+		if !tx.done && now.Sub(tx.used) > lease {
+			tx.done = true
+			delete(n.txs, id)
+			expired = append(expired, tx)
+		}
+		tx.mu.Unlock()
+	}
+	n.txMu.Unlock()
+
+	for _, tx := range expired {
+		if err := removeTree(tx.dir); err != nil {
+			log.Printf("tx %v: %v", tx.id, err)
+		}
+	}
+	return len(expired)
+}
+
+func (n *FileNode) expireTxLoop() {
+	ticker := time.NewTicker(n.txLease() / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if c := n.ExpireTxs(); c > 0 {
+			log.Printf("expired transactions: %v", c)
+		}
+	}
+}
+
+// CommitTx applies the staged ops of the transaction in order, each by
+// renames. Nothing is changed if a deleted path is missing, a put path is a
+// directory or an if_match precondition fails. The replaced files are kept
+// until all ops are done and restored if one fails. Parents created for new
+// files are left. A commit interrupted by a crash is rolled back from its
+// journal by RecoverTxs. The transaction is closed whether the commit
+// succeeds or not.
+func (n *FileNode) CommitTx(id string) error {
+	tx, err := n.takeTx(id)
+	if err != nil {
+		return err
+	}
+
+	n.condMu.Lock()
+	defer n.condMu.Unlock()
+
+	if err := n.checkTx(tx.ops); err != nil {
+		os.RemoveAll(tx.dir)
+		return err
+	}
+	j := &txJournal{
+		ID:    tx.id,
+		State: txCommitting,
+		Ops:   tx.ops,
+	}
+	if err := writeJournal(tx.dir, j); err != nil {
+		os.RemoveAll(tx.dir)
+		return err
+	}
+
+	err = n.applyTx(tx.dir, tx.ops)
+	if err == nil {
+		j.State = txCommitted
+		err = writeJournal(tx.dir, j)
+	}
+	if err != nil {
+		if rerr := n.rollbackTx(tx.dir, tx.ops); rerr != nil {
+			// left to recover on restart
+			log.Printf("tx %v rollback: %v", tx.id, rerr)
+			return err
+		}
+	} else {
+		n.trashTx(tx.dir, tx.ops)
+	}
+	removeTree(tx.dir)
+	return err
+}
+
+// checkTx checks the preconditions of the ops and records whether their
+// paths exist. The paths are checked again as at staging, as symlinks may
+// have changed since.
+func (n *FileNode) checkTx(ops []*txOp) error {
+	for _, op := range ops {
+		if _, err := n.clientPath(op.Path); err != nil {
+			return &os.PathError{Op: "commit", Path: op.Path, Err: err}
+		}
+		st := syscall.Stat_t{}
+		err := syscall.Lstat(n.abs(op.Path), &st)
+		if err != nil && err != syscall.ENOENT {
+			return &os.PathError{Op: "commit", Path: op.Path, Err: err}
+		}
+		op.Existed = err == nil
+
+		switch {
+		case op.Delete && !op.Existed:
+			return &os.PathError{Op: "commit", Path: op.Path, Err: syscall.ENOENT}
+		case !op.Delete && op.Existed && isDir(&st):
+			return &os.PathError{Op: "commit", Path: op.Path, Err: syscall.EISDIR}
+		}
+		if op.ifMatch != "" {
+			// a deleted symlink is matched itself as for unlink
+			if err := n.match(op.Path, "", op.ifMatch, !op.Delete); err != nil {
+				return &os.PathError{Op: "commit", Path: op.Path, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// applyTx applies the ops. A replaced file is linked as backup before the
+// put file is renamed over it, a deleted one is moved to the backup.
+func (n *FileNode) applyTx(dir string, ops []*txOp) error {
+	for _, op := range ops {
+		path := n.abs(op.Path)
+		var err error
+		switch {
+		case op.Delete:
+			err = os.Rename(path, backupFile(dir, op))
+		case op.Existed:
+			err = os.Link(path, backupFile(dir, op))
+		default:
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+		}
+		if err == nil && !op.Delete {
+			err = os.Rename(stagedFile(dir, op), path)
+		}
+		if err == nil {
+			err = syncDir(filepath.Dir(path))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashTx moves the files deleted by the committed ops from their backups
+// into the trash if enabled.
+func (n *FileNode) trashTx(dir string, ops []*txOp) {
+	for _, op := range ops {
+		backup := backupFile(dir, op)
+		if !op.Delete {
+			continue
+		}
+		if _, err := os.Lstat(backup); err != nil {
+			continue
+		}
+		if _, _, err := n.moveToTrash(op.Path, backup); err != nil {
+			log.Printf("trash %v: %v", op.Path, err)
+		}
+	}
+}
+
+// rollbackTx restores the paths of the ops applied before a failure, in
+// reverse order. Whether an op was applied is told by its files, the backup
+// exists once the replaced file is kept and the put file is gone from the
+// staging area once renamed.
+func (n *FileNode) rollbackTx(dir string, ops []*txOp) error {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		path := n.abs(op.Path)
+
+		backup := backupFile(dir, op)
+		if _, err := os.Lstat(backup); err == nil {
+			if err := os.Rename(backup, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if op.Delete || op.Existed {
+			continue
+		}
+		if _, err := os.Lstat(stagedFile(dir, op)); os.IsNotExist(err) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RecoverTxs cleans up the staging area after a restart of the server.
+// Commits interrupted by a crash are rolled back and transactions left
+// open are discarded. It must be called before transactions are begun and
+// returns the count of transactions recovered.
+func (n *FileNode) RecoverTxs() (int, error) {
+	root := filepath.Join(n.Root, txDir)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		j, err := readJournal(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return count, fmt.Errorf("tx %v: %w", e.Name(), err)
+		}
+		if j != nil && j.State == txCommitting {
+			if err := n.rollbackTx(dir, j.Ops); err != nil {
+				return count, fmt.Errorf("tx %v: %w", e.Name(), err)
+			}
+			log.Printf("tx %v: commit rolled back", e.Name())
+		}
+		if j != nil && j.State == txCommitted {
+			n.trashTx(dir, j.Ops)
+		}
+		if err := removeTree(dir); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// writeJournal replaces the journal atomically and durably.
+func writeJournal(dir string, j *txJournal) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, journalFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, journalFile))
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func readJournal(dir string) (*txJournal, error) {
+	b, err := os.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		return nil, err
+	}
+	var j txJournal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
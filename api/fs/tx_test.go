@@ -0,0 +1,234 @@
+package fs
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestTx(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(p(name))
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+	if err := os.WriteFile(p("bin"), []byte("v1"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(p("old.conf"), []byte("old"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stage := func(id string) {
+		for _, name := range []string{"/bin", "/etc/app.conf"} {
+			if _, err := n.Put(name, strings.NewReader("v2"), &api.PutOptions{Tx: id}, nil); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+		if err := n.StageDelete(id, "/old.conf", ""); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// nothing changed before commit, nothing after abort
+	tx, _ := n.BeginTx()
+	stage(tx.ID)
+	if info, err := n.Tx(tx.ID); err != nil || len(info.Ops) != 3 || info.Ops[0].Size != 2 {
+		t.Fatalf("tx: %+v %v", info, err)
+	}
+	if read("bin") != "v1" {
+		t.Fatalf("staged: %q", read("bin"))
+	}
+	if err := n.AbortTx(tx.ID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if read("bin") != "v1" || read("old.conf") != "old" {
+		t.Fatalf("abort: %q", read("bin"))
+	}
+
+	// failed precondition
+	tx, _ = n.BeginTx()
+	stage(tx.ID)
+	n.Put("/bin", strings.NewReader("v3"), &api.PutOptions{Tx: tx.ID, IfMatch: `"x"`}, nil)
+	if err := n.CommitTx(tx.ID); api.ToErrno(err) != api.ErrConflict {
+		t.Fatalf("commit: %v", err)
+	}
+	if read("bin") != "v1" || read("old.conf") != "old" {
+		t.Fatalf("conflict: %q", read("bin"))
+	}
+
+	// commit, the deleted file into the trash
+	if n.Trash, err = NewTrash(dir, 0, 0); err != nil {
+		t.Fatalf("%v", err)
+	}
+	tx, _ = n.BeginTx()
+	stage(tx.ID)
+	if err := n.CommitTx(tx.ID); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if list, _ := n.ListTrash(); len(list) != 1 || list[0].Path != "/old.conf" {
+		t.Fatalf("trash: %+v", list)
+	}
+	if read("bin") != "v2" || read("etc/app.conf") != "v2" {
+		t.Fatalf("commit: %q %q", read("bin"), read("etc/app.conf"))
+	}
+	if fi, err := os.Stat(p("bin")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Fatalf("commit: %v %v", fi.Mode(), err)
+	}
+	if _, err := os.Lstat(p("old.conf")); !os.IsNotExist(err) {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := n.CommitTx(tx.ID); err != syscall.ENOENT {
+		t.Fatalf("closed: %v", err)
+	}
+	if _, err := n.Put("/.nomad/x", strings.NewReader(""), &api.PutOptions{Tx: tx.ID}, nil); err != syscall.EINVAL {
+		t.Fatalf("state: %v", err)
+	}
+	if entries, _ := os.ReadDir(p(txDir)); len(entries) != 0 {
+		t.Fatalf("staging: %v", entries)
+	}
+}
+
+func TestRecoverTxs(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(p(name), []byte("v1"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// crash after the first ops of a commit were applied
+	tx, _ := n.BeginTx()
+	for _, name := range []string{"/a", "/new", "/b"} {
+		if _, err := n.Put(name, strings.NewReader("v2"), &api.PutOptions{Tx: tx.ID}, nil); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := n.StageDelete(tx.ID, "/b", ""); err != nil {
+		t.Fatalf("%v", err)
+	}
+	txn, _ := n.takeTx(tx.ID)
+	if err := n.checkTx(txn.ops); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := writeJournal(txn.dir, &txJournal{ID: txn.id, State: txCommitting, Ops: txn.ops}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := n.applyTx(txn.dir, txn.ops[:2]); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// left open
+	n.BeginTx()
+
+	n, _ = NewFileNode(dir, u, NewHandleTable(0))
+	if count, err := n.RecoverTxs(); err != nil || count != 2 {
+		t.Fatalf("recover: %v %v", count, err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if b, err := os.ReadFile(p(name)); err != nil || string(b) != "v1" {
+			t.Fatalf("recover: %v: %q %v", name, b, err)
+		}
+	}
+	if _, err := os.Lstat(p("new")); !os.IsNotExist(err) {
+		t.Fatalf("recover: %v", err)
+	}
+	if entries, _ := os.ReadDir(p(txDir)); len(entries) != 0 {
+		t.Fatalf("staging: %v", entries)
+	}
+}
+
+func TestTxExpire(t *testing.T) {
+	dir := t.TempDir()
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	n.TxLease = 200 * time.Millisecond
+
+	// expired unless staged to or looked up within the lease
+	a, _ := n.BeginTx()
+	b, _ := n.BeginTx()
+	if a.Expires.Sub(a.Created) != n.TxLease {
+		t.Fatalf("expires: %+v", a)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if _, err := n.Put("/f", strings.NewReader("v"), &api.PutOptions{Tx: b.ID}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	time.Sleep(130 * time.Millisecond)
+	n.ExpireTxs()
+
+	if _, err := n.Tx(a.ID); err != syscall.ENOENT {
+		t.Fatalf("expired: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, txDir, a.ID)); !os.IsNotExist(err) {
+		t.Fatalf("staging: %v", err)
+	}
+	if err := n.CommitTx(b.ID); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "f")); err != nil || string(b) != "v" {
+		t.Fatalf("commit: %q %v", b, err)
+	}
+}
+
+func TestTxCommitPaths(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, stateDir), 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the parent is a symlink into the state once committed
+	tx, _ := n.BeginTx()
+	if _, err := n.Put("/d/f", strings.NewReader("v"), &api.PutOptions{Tx: tx.ID}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "d")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink(stateDir, filepath.Join(dir, "d")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := n.CommitTx(tx.ID); err == nil {
+		t.Fatalf("commit into the state")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, stateDir, "f")); !os.IsNotExist(err) {
+		t.Fatalf("state: %v", err)
+	}
+}
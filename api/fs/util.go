@@ -34,10 +34,12 @@ type blobInfoHref struct {
 	S int64
 	M uint32
 	P string
+	H string `json:",omitempty"`
+	I string `json:",omitempty"`
 }
 
 func EncodeBlobHref(base *url.URL, bi *api.BlobInfo) (string, error) {
-	b, err := json.Marshal(blobInfoHref{bi.Offset, bi.Size, bi.Perm, bi.Path})
+	b, err := json.Marshal(blobInfoHref{bi.Offset, bi.Size, bi.Perm, bi.Path, bi.Handle, bi.IfMatch})
 	if err != nil {
 		return "", err
 	}
@@ -64,6 +66,9 @@ func DecodeBlobHref(base *url.URL, href string) (*api.BlobInfo, error) {
 		Size:   bi.S,
 		Perm:   bi.M,
 		Path:   bi.P,
+		Handle: bi.H,
+
+		IfMatch: bi.I,
 	}, nil
 }
 
@@ -88,3 +93,10 @@ func Create(path string, mode uint32, perm uint32) error {
 
 	return nil
 }
+
+func min64(x, y int64) int64 {
+	if x > y {
+		return y
+	}
+	return x
+}
@@ -0,0 +1,261 @@
+package fs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/dhnt/nomad/api"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_DELETE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// Watch reports the changes of a file or directory with inotify. It must be
+// closed after use.
+type Watch struct {
+	n *FileNode
+
+	// watched path and whether subdirectories are watched
+	rel       string
+	recursive bool
+
+	f   *os.File
+	fd  int
+	wds map[int]string
+	max int
+}
+
+type move struct {
+	path  string
+	isDir bool
+}
+
+// NewWatch starts watching the path, a directory is watched with its
+// subdirectories if recursive is set. It fails with ENOSPC if there are more
+// directories than MaxWatches or the inotify limits of the user allow.
+func (n *FileNode) NewWatch(rel string, recursive bool) (*Watch, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watch{
+		n:         n,
+		rel:       filepath.Join("/", rel),
+		recursive: recursive,
+		// non blocking for Close to interrupt Run
+		f:   os.NewFile(uintptr(fd), "inotify"),
+		fd:  fd,
+		wds: make(map[int]string),
+		max: n.maxWatches(),
+	}
+
+	path, err := n.path(w.rel)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &st); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if recursive && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		err = w.addTree(w.rel, nil)
+	} else {
+		err = w.add(w.rel)
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Watch) Close() error {
+	return w.f.Close()
+}
+
+// Run calls fn for the events until ctx is done or the watch is closed. It
+// fails with ENOSPC once the created directories can no longer be watched.
+func (w *Watch) Run(ctx context.Context, fn func(e *api.Event)) error {
+	go func() {
+		<-ctx.Done()
+		w.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := w.dispatch(buf[:n], fn); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *FileNode) maxWatches() int {
+	if n.MaxWatches <= 0 {
+		return DefaultMaxWatches
+	}
+	return n.MaxWatches
+}
+
+func (w *Watch) add(rel string) error {
+	if len(w.wds) >= w.max {
+		return &os.PathError{Op: "watch", Path: rel, Err: syscall.ENOSPC}
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, w.n.abs(rel), watchMask)
+	if err != nil {
+		return err
+	}
+	w.wds[wd] = rel
+	return nil
+}
+
+// addTree watches the directory and its subdirectories. The entries found
+// are reported as created if fn is set, they may be missed otherwise.
+func (w *Watch) addTree(rel string, fn func(e *api.Event)) error {
+	root := w.n.abs(rel)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// removed in between
+			return nil
+		}
+		sub := filepath.Join(rel, strings.TrimPrefix(p, root))
+		if IsState(sub) && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if fn != nil && p != root {
+			fn(&api.Event{
+				Op:    api.EventCreate,
+				Path:  sub,
+				IsDir: d.IsDir(),
+			})
+		}
+		if d.IsDir() {
+			return w.add(sub)
+		}
+		return nil
+	})
+}
+
+// removeTree stops watching the directory and its subdirectories.
+func (w *Watch) removeTree(rel string) {
+	for wd, p := range w.wds {
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, wd)
+		}
+	}
+}
+
+// renameTree updates the paths of the watches of a moved directory.
+func (w *Watch) renameTree(from, to string) {
+	for wd, p := range w.wds {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			w.wds[wd] = to + strings.TrimPrefix(p, from)
+		}
+	}
+}
+
+// dispatch reports the events in buf, it fails if a created directory cannot
+// be watched.
+func (w *Watch) dispatch(buf []byte, fn func(e *api.Event)) error {
+	moves := make(map[uint32]move)
+	var cookies []uint32
+
+	for off := 0; off+unix.SizeofInotifyEvent <= len(buf); {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+		off += unix.SizeofInotifyEvent + int(ev.Len)
+
+		if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+			fn(&api.Event{Op: api.EventOverflow, Path: w.rel})
+			continue
+		}
+		dir, ok := w.wds[int(ev.Wd)]
+		if !ok {
+			continue
+		}
+		if ev.Mask&unix.IN_IGNORED != 0 {
+			delete(w.wds, int(ev.Wd))
+			continue
+		}
+
+		p := dir
+		if i := strings.IndexByte(string(name), 0); i >= 0 {
+			name = name[:i]
+		}
+		if len(name) > 0 {
+			p = filepath.Join(dir, string(name))
+		}
+		if IsState(p) {
+			continue
+		}
+		isDir := ev.Mask&unix.IN_ISDIR != 0
+
+		switch {
+		case ev.Mask&unix.IN_CREATE != 0:
+			fn(&api.Event{Op: api.EventCreate, Path: p, IsDir: isDir})
+			if isDir && w.recursive {
+				if err := w.addTree(p, fn); err != nil {
+					return err
+				}
+			}
+		case ev.Mask&unix.IN_MODIFY != 0:
+			fn(&api.Event{Op: api.EventModify, Path: p, IsDir: isDir})
+		case ev.Mask&unix.IN_ATTRIB != 0:
+			fn(&api.Event{Op: api.EventAttrib, Path: p, IsDir: isDir})
+		case ev.Mask&unix.IN_DELETE != 0:
+			fn(&api.Event{Op: api.EventDelete, Path: p, IsDir: isDir})
+		case ev.Mask&unix.IN_DELETE_SELF != 0:
+			// reported by the parent unless it is the watched path
+			if p == w.rel {
+				fn(&api.Event{Op: api.EventDelete, Path: p})
+			}
+		case ev.Mask&unix.IN_MOVED_FROM != 0:
+			moves[ev.Cookie] = move{path: p, isDir: isDir}
+			cookies = append(cookies, ev.Cookie)
+		case ev.Mask&unix.IN_MOVED_TO != 0:
+			from, ok := moves[ev.Cookie]
+			if !ok {
+				// moved in from outside the watch
+				fn(&api.Event{Op: api.EventCreate, Path: p, IsDir: isDir})
+				if isDir && w.recursive {
+					if err := w.addTree(p, fn); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			delete(moves, ev.Cookie)
+			if isDir && w.recursive {
+				w.renameTree(from.path, p)
+			}
+			fn(&api.Event{Op: api.EventRename, Path: from.path, To: p, IsDir: isDir})
+		}
+	}
+
+	// moved out of the watch
+	for _, c := range cookies {
+		if m, ok := moves[c]; ok {
+			if m.isDir {
+				w.removeTree(m.path)
+			}
+			fn(&api.Event{Op: api.EventDelete, Path: m.path, IsDir: m.isDir})
+		}
+	}
+	return nil
+}
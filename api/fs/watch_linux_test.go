@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	wt, err := n.NewWatch("/", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer wt.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan api.Event, 16)
+	go wt.Run(ctx, func(e *api.Event) {
+		events <- *e
+	})
+
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	tests := []struct {
+		fn func() error
+		e  api.Event
+	}{
+		{func() error { return os.WriteFile(p("sub/a"), nil, 0644) }, api.Event{Op: api.EventCreate, Path: "/sub/a"}},
+		{func() error { return os.Chmod(p("sub/a"), 0600) }, api.Event{Op: api.EventAttrib, Path: "/sub/a"}},
+		{func() error { return os.Rename(p("sub/a"), p("b")) }, api.Event{Op: api.EventRename, Path: "/sub/a", To: "/b"}},
+		{func() error { return os.Rename(p("sub"), p("sub2")) }, api.Event{Op: api.EventRename, Path: "/sub", To: "/sub2", IsDir: true}},
+		{func() error { return os.Mkdir(p("sub2/d"), 0755) }, api.Event{Op: api.EventCreate, Path: "/sub2/d", IsDir: true}},
+		{func() error { return os.Remove(p("b")) }, api.Event{Op: api.EventDelete, Path: "/b"}},
+	}
+
+	for _, tc := range tests {
+		if err := tc.fn(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		select {
+		case e := <-events:
+			if !reflect.DeepEqual(e, tc.e) {
+				t.Fatalf("expected: %v got: %v", tc.e, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected: %v got none", tc.e)
+		}
+	}
+}
+
+func TestWatchLimit(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := NewFileNode(dir, u, NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the root and both subdirectories are watched
+	n.MaxWatches = 2
+	if _, err := n.NewWatch("/", true); api.ToErrno(err) != syscall.ENOSPC {
+		t.Fatalf("expected ENOSPC got: %v", err)
+	}
+
+	n.MaxWatches = 3
+	wt, err := n.NewWatch("/", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer wt.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- wt.Run(context.Background(), func(e *api.Event) {})
+	}()
+	if err := os.Mkdir(filepath.Join(dir, "a", "c"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	select {
+	case err := <-errc:
+		if api.ToErrno(err) != syscall.ENOSPC {
+			t.Fatalf("expected ENOSPC got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("still running")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+)
+
+type Watch struct{}
+
+func (n *FileNode) NewWatch(rel string, recursive bool) (*Watch, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (w *Watch) Close() error {
+	return nil
+}
+
+func (w *Watch) Run(ctx context.Context, fn func(e *api.Event)) error {
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/dhnt/nomad/api/fs"
+)
+
+var (
+	archiveRe = regexp.MustCompile(`^\/archive(\/.*)?$`)
+)
+
+var archiveTypes = map[string]string{
+	api.ArchiveTar: "application/x-tar",
+	api.ArchiveTgz: "application/gzip",
+	api.ArchiveZip: "application/zip",
+}
+
+var archiveExts = map[string]string{
+	api.ArchiveTar: ".tar",
+	api.ArchiveTgz: ".tar.gz",
+	api.ArchiveZip: ".zip",
+}
+
+type archiveHandler struct {
+	prefix string
+	node   *fs.FileNode
+}
+
+func NewArchiveHandler(prefix string, node *fs.FileNode) *archiveHandler {
+	return &archiveHandler{
+		prefix: prefix,
+		node:   node,
+	}
+}
+
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && archiveRe.MatchString(r.URL.Path):
+		h.Download(w, r)
+		return
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && archiveRe.MatchString(r.URL.Path):
+		h.Extract(w, r)
+		return
+	default:
+		notSupported(w, r, r.URL.Path)
+		return
+	}
+}
+
+// resolvePath returns the path of the file node of the request path.
+func (h *archiveHandler) resolvePath(r *http.Request) string {
+	matches := archiveRe.FindStringSubmatch(r.URL.Path)
+	return path.Clean("/" + matches[1])
+}
+
+// Download streams the file or directory tree as archive of the format
+// query param. The include and exclude params select the entries by glob.
+func (h *archiveHandler) Download(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format, err := fs.ParseArchiveFormat(q.Get("format"))
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+	filter := &fs.ArchiveFilter{
+		Include: q["include"],
+		Exclude: q["exclude"],
+	}
+	if err := filter.Validate(); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	p := h.resolvePath(r)
+	if _, err := h.node.Lstat(p); err != nil {
+		notFound(w, r, p)
+		return
+	}
+
+	name := path.Base(p)
+	if p == "/" {
+		name = "root"
+	}
+	w.Header().Set("Content-Type", archiveTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+archiveExts[format]))
+	w.WriteHeader(http.StatusOK)
+
+	// the response is committed, errors cut the archive short
+	if err := h.node.Archive(w, p, format, filter); err != nil {
+		log.Printf("archive %v: %v", p, err)
+	}
+}
+
+// Extract extracts the archive of the request body into the directory,
+// created if missing.
+func (h *archiveHandler) Extract(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	format, err := fs.ParseArchiveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	p := h.resolvePath(r)
+	info, err := h.node.Extract(r.Body, p, format)
+	if err != nil {
+		switch {
+		case isArchiveError(err):
+			badRequest(w, r, err)
+		case errors.Is(err, syscall.ENOENT):
+			notFound(w, r, p)
+		case errors.Is(err, syscall.EROFS), errors.Is(err, syscall.EACCES):
+			forbidden(w, r, err)
+		default:
+			internalServerError(w, r, err)
+		}
+		return
+	}
+	log.Printf("extracted %v: files: %v bytes: %v", p, info.Files, info.Bytes)
+
+	jsonResponse(w, r, info)
+}
+
+// isArchiveError reports whether err is caused by an invalid archive.
+func isArchiveError(err error) bool {
+	return errors.Is(err, fs.ErrArchivePath) ||
+		errors.Is(err, tar.ErrHeader) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, zip.ErrFormat) ||
+		errors.Is(err, zip.ErrChecksum)
+}
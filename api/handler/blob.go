@@ -1,15 +1,18 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
-	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/dhnt/nomad/api"
 	"github.com/dhnt/nomad/api/fs"
@@ -17,6 +20,7 @@ import (
 
 const maxUploadSize = 100 * 1024 * 1024
 const blobFilename = "blob"
+const blobBufferSize = 1024 * 1024
 
 var (
 	blobRe = regexp.MustCompile(`^\/blob\/(.+)$`)
@@ -24,77 +28,59 @@ var (
 
 type blobHandler struct {
 	prefix string
-	root   string
+	node   *fs.FileNode
 }
 
-func NewBlobHandler(prefix string, root string) *blobHandler {
+func NewBlobHandler(prefix string, node *fs.FileNode) *blobHandler {
 	return &blobHandler{
 		prefix: prefix,
-		root:   root,
+		node:   node,
 	}
 }
 
 func (h *blobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	switch {
-	case r.Method == http.MethodGet && blobRe.MatchString(r.URL.Path):
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && blobRe.MatchString(r.URL.Path):
 		h.Download(w, r)
 		return
 	case r.Method == http.MethodPost && blobRe.MatchString(r.URL.Path):
 		h.Upload(w, r)
 		return
+	case r.Method == http.MethodPut && blobRe.MatchString(r.URL.Path):
+		h.Put(w, r)
+		return
 	default:
 		notSupported(w, r, r.URL.Path)
 		return
 	}
 }
 
-func (h *blobHandler) resolvePath(name string) string {
-	return filepath.Join(h.root, name)
-}
-
 func (h *blobHandler) Download(w http.ResponseWriter, r *http.Request) {
 	bi, err := h.readBlobInfo(r)
 	if err != nil {
 		internalServerError(w, r, err)
+		return
 	}
 	log.Printf("blob info offset: %v size: %v path: %v", bi.Offset, bi.Size, bi.Path)
 
-	p := h.resolvePath(bi.Path)
-
-	f, err := os.Open(p)
-	defer f.Close()
-
+	f, done, err := h.open(bi, os.O_RDONLY)
 	if err != nil {
-		notFound(w, r, p)
+		notFound(w, r, bi.Path)
 		return
 	}
+	defer done()
 
-	buf := make([]byte, 512)
-	f.Read(buf)
-	contentType := http.DetectContentType(buf)
-
-	s, _ := f.Stat()
-	size := strconv.FormatInt(s.Size(), 10)
-
-	//
-	w.Header().Set("Content-Type", contentType+";"+filepath.Base(p))
-	w.Header().Set("Content-Length", size)
-
-	f.Seek(bi.Offset, 0)
-
-	n, err := io.CopyN(w, f, bi.Size)
-	if err != nil {
-		internalServerError(w, r, err)
-	}
-
-	log.Printf("bytes read: %v", n)
+	// the file may be shared by concurrent requests of the handle, reads
+	// are positional
+	ServeContent(w, r, bi.Path, f, bi.Offset, bi.Size)
 }
 
 func (h *blobHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	bi, err := h.readBlobInfo(r)
 	if err != nil {
 		internalServerError(w, r, err)
+		return
 	}
 	log.Printf("blob info offset: %v size: %v path: %v", bi.Offset, bi.Size, bi.Path)
 
@@ -119,16 +105,123 @@ func (h *blobHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	n, err := h.write(bi, data)
+	if err == api.ErrConflict {
+		preconditionFailed(w, r, err)
+		return
+	}
+	if err == syscall.EACCES {
+		forbidden(w, r, err)
+		return
+	}
 	if err != nil {
 		internalServerError(w, r, err)
+		return
 	}
 
 	log.Printf("data read: %v written: %v", len(data), n)
-	type BlobResult struct {
-		N int
+	jsonResponse(w, r, api.BlobResult{
+		N: int64(n),
+	})
+}
+
+// Put writes the raw request body to the file at the blob offset. The body
+// is placed at the first position of the Content-Range relative to the blob
+// offset if provided, otherwise it must be the whole blob. The body is
+// staged and the sha256 in the checksum header or trailer verified before
+// the file is written, the client should retry on mismatch.
+func (h *blobHandler) Put(w http.ResponseWriter, r *http.Request) {
+	bi, err := h.readBlobInfo(r)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
 	}
-	jsonResponse(w, r, BlobResult{
-		N: n,
+	log.Printf("blob info offset: %v size: %v path: %v", bi.Offset, bi.Size, bi.Path)
+
+	if err := checkPerm(bi); err != nil {
+		forbidden(w, r, err)
+		return
+	}
+	var start int64
+	length := bi.Size
+	if v := r.Header.Get("Content-Range"); v != "" {
+		if start, length, err = parseContentRange(v); err != nil {
+			badRequest(w, r, err)
+			return
+		}
+	}
+	if start+length > bi.Size {
+		badRequest(w, r, fmt.Errorf("range: %v-%v beyond the blob size: %v", start, start+length, bi.Size))
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		badRequest(w, r, fmt.Errorf("content length: %v does not match range: %v", r.ContentLength, length))
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "nomad-blob-*")
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(tmp, hash), io.LimitReader(r.Body, length+1), make([]byte, blobBufferSize))
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if n != length {
+		badRequest(w, r, fmt.Errorf("body: %v bytes for range: %v", n, length))
+		return
+	}
+
+	// the trailer is available once the body is read
+	sum := r.Header.Get(api.ChecksumHeader)
+	if sum == "" {
+		sum = r.Trailer.Get(api.ChecksumHeader)
+	}
+	if sum != "" && !strings.EqualFold(sum, hex.EncodeToString(hash.Sum(nil))) {
+		badRequest(w, r, fmt.Errorf("checksum mismatch: %v", sum))
+		return
+	}
+
+	f, done, err := h.open(bi, os.O_RDWR)
+	if err != nil {
+		notFound(w, r, bi.Path)
+		return
+	}
+	defer done()
+
+	// later ranges of the upload see the changes of the first
+	ifMatch := bi.IfMatch
+	if start > 0 {
+		ifMatch = ""
+	}
+	offset := bi.Offset + start
+	var etag string
+	err = h.node.IfMatch(bi.Path, bi.Handle, ifMatch, true, func() error {
+		pw := &pwriter{fd: int(f.Fd()), off: offset}
+		if _, err := io.CopyBuffer(pw, io.NewSectionReader(tmp, 0, n), make([]byte, blobBufferSize)); err != nil {
+			return err
+		}
+		etag, err = fileETag(f)
+		return err
+	})
+	if err == api.ErrConflict {
+		preconditionFailed(w, r, err)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	log.Printf("data written: %v at: %v", n, offset)
+	jsonResponse(w, r, api.BlobResult{
+		N:    n,
+		ETag: etag,
 	})
 }
 
@@ -138,21 +231,68 @@ func (h *blobHandler) readBlobInfo(r *http.Request) (*api.BlobInfo, error) {
 	return bi, err
 }
 
-func (h *blobHandler) write(bi *api.BlobInfo, data []byte) (int, error) {
-	p := h.resolvePath(bi.Path)
+// open returns the file of the handle if set in bi, otherwise opens the
+// path. done must be called when finished with the file.
+func (h *blobHandler) open(bi *api.BlobInfo, flag int) (*os.File, func(), error) {
+	return h.node.File(bi.Path, bi.Handle, flag)
+}
 
-	f, err := os.OpenFile(p, os.O_RDWR, 0644)
-	if err != nil {
+func (h *blobHandler) write(bi *api.BlobInfo, data []byte) (int, error) {
+	if err := checkPerm(bi); err != nil {
 		return 0, err
 	}
-	defer f.Close()
-
-	if _, err := f.Seek(bi.Offset, 0); err != nil {
-		return 0, err
+	if int64(len(data)) > bi.Size {
+		return 0, syscall.EFBIG
 	}
-	n, err := f.WriteAt(data, bi.Offset)
+	f, done, err := h.open(bi, os.O_RDWR)
 	if err != nil {
 		return 0, err
 	}
-	return n, nil
+	defer done()
+
+	var n int
+	err = h.node.IfMatch(bi.Path, bi.Handle, bi.IfMatch, true, func() error {
+		// pwrite appends if the file is opened with O_APPEND
+		n, err = syscall.Pwrite(int(f.Fd()), data, bi.Offset)
+		return err
+	})
+	return n, err
+}
+
+// checkPerm fails with EACCES if the file of the blob path has no write
+// permission. Open handles are checked on open.
+func checkPerm(bi *api.BlobInfo) error {
+	if bi.Handle == "" && bi.Perm&(syscall.S_IWUSR|syscall.S_IWGRP|syscall.S_IWOTH) == 0 {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+// fileETag returns the etag of the open file.
+func fileETag(f *os.File) (string, error) {
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return "", err
+	}
+	return fs.ETag(&st), nil
+}
+
+// pwriter writes sequentially from the offset with pwrite, which unlike
+// WriteAt is allowed on files opened with O_APPEND.
+type pwriter struct {
+	fd  int
+	off int64
+}
+
+func (p *pwriter) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := syscall.Pwrite(p.fd, b[written:], p.off)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p.off += int64(n)
+	}
+	return written, nil
 }
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/dhnt/nomad/api/fs"
+)
+
+func TestBlobPut(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := fs.NewFileNode(dir, u, fs.NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := NewBlobHandler("/blob/", n)
+
+	sum := func(s string) string {
+		b := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(b[:])
+	}
+	tests := []struct {
+		body   string
+		rng    string
+		sum    string
+		perm   uint32
+		status int
+		data   string
+	}{
+		{"abc", "", sum("abc"), 0200, http.StatusOK, "0abc456789"},
+		{"abc", "", sum("xyz"), 0200, http.StatusBadRequest, "0123456789"},
+		{"ab", "", "", 0200, http.StatusBadRequest, "0123456789"},
+		{"abcd", "", "", 0200, http.StatusBadRequest, "0123456789"},
+		{"c", "bytes 2-2/*", "", 0200, http.StatusOK, "012c456789"},
+		{"cd", "bytes 2-3/*", "", 0200, http.StatusBadRequest, "0123456789"},
+		{"abc", "", "", 0444, http.StatusForbidden, "0123456789"},
+	}
+
+	for i, tc := range tests {
+		if err := os.WriteFile(filepath.Join(dir, "f"), []byte("0123456789"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		href, err := fs.EncodeBlobHref(u, &api.BlobInfo{Path: "/f", Offset: 1, Size: 3, Perm: tc.perm})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		r := httptest.NewRequest(http.MethodPut, href, strings.NewReader(tc.body))
+		if tc.rng != "" {
+			r.Header.Set("Content-Range", tc.rng)
+		}
+		if tc.sum != "" {
+			r.Header.Set(api.ChecksumHeader, tc.sum)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Fatalf("%v: status: %v %s", i, w.Code, w.Body)
+		}
+		if b, _ := os.ReadFile(filepath.Join(dir, "f")); string(b) != tc.data {
+			t.Fatalf("%v: data: %q", i, b)
+		}
+	}
+
+	// the precondition is checked and the etag after the write returned
+	old, _ := n.ETag("/f", "", true)
+	for i, etag := range []string{old, old} {
+		href, _ := fs.EncodeBlobHref(u, &api.BlobInfo{Path: "/f", Size: 2, Perm: 0200, IfMatch: etag})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, href, strings.NewReader("ab")))
+		if i == 1 {
+			if w.Code != http.StatusPreconditionFailed {
+				t.Fatalf("conflict: %v", w.Code)
+			}
+			continue
+		}
+		var res api.BlobResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		if cur, _ := n.ETag("/f", "", true); res.N != 2 || res.ETag != cur || cur == old {
+			t.Fatalf("etag: %+v %v", res, cur)
+		}
+	}
+}
+
+func TestBlobBadHref(t *testing.T) {
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := fs.NewFileNode(t.TempDir(), u, fs.NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := NewBlobHandler("/blob/", n)
+
+	// replied as error without a blob info
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/blob/!bad", strings.NewReader("abc")))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("%v: %v %s", method, w.Code, w.Body)
+		}
+	}
+}
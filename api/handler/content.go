@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServeContent replies with size bytes of f from offset, the whole file if
+// size is negative. Range requests, HEAD and the conditional headers are
+// handled by http.ServeContent with the ETag of the file. The ETag of a
+// section of the file also includes the offset and size.
+func ServeContent(w http.ResponseWriter, r *http.Request, name string, f *os.File, offset, size int64) {
+	fi, err := f.Stat()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if fi.IsDir() {
+		notFound(w, r, name)
+		return
+	}
+
+	whole := offset == 0 && (size < 0 || size >= fi.Size())
+	if size < 0 || offset+size > fi.Size() {
+		size = fi.Size() - offset
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	etag, err := findETag(r.Context(), fi)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if !whole {
+		etag = fmt.Sprintf(`%s-%x-%x"`, strings.TrimSuffix(etag, `"`), offset, size)
+	}
+
+	sr := io.NewSectionReader(f, offset, size)
+
+	buf := make([]byte, 512)
+	n, _ := sr.ReadAt(buf, 0)
+	contentType := http.DetectContentType(buf[:n])
+
+	w.Header().Set("Content-Type", contentType+";"+filepath.Base(name))
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r, name, fi.ModTime(), sr)
+}
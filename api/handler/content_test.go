@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeContent(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(name, []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+
+	serve := func(method string, offset, size int64, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/f.txt", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		ServeContent(w, r, "/f.txt", f, offset, size)
+		return w
+	}
+
+	etag := serve(http.MethodGet, 0, -1).Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("no etag")
+	}
+	modified := fi.ModTime().UTC().Format(http.TimeFormat)
+	before := fi.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		method string
+		offset int64
+		size   int64
+		header []string
+		status int
+		rng    string
+		body   string
+	}{
+		{http.MethodGet, 0, -1, nil, http.StatusOK, "", "0123456789"},
+		{http.MethodGet, 0, 100, nil, http.StatusOK, "", "0123456789"},
+		{http.MethodGet, 2, 5, nil, http.StatusOK, "", "23456"},
+		{http.MethodGet, 8, -1, nil, http.StatusOK, "", "89"},
+		{http.MethodGet, 0, -1, []string{"Range", "bytes=2-4"}, http.StatusPartialContent, "bytes 2-4/10", "234"},
+		{http.MethodGet, 0, -1, []string{"Range", "bytes=-3"}, http.StatusPartialContent, "bytes 7-9/10", "789"},
+		{http.MethodGet, 2, 5, []string{"Range", "bytes=1-"}, http.StatusPartialContent, "bytes 1-4/5", "3456"},
+		{http.MethodGet, 0, -1, []string{"Range", "bytes=10-"}, http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{http.MethodGet, 2, 5, []string{"Range", "bytes=5-"}, http.StatusRequestedRangeNotSatisfiable, "bytes */5", ""},
+		{http.MethodHead, 0, -1, nil, http.StatusOK, "", ""},
+		{http.MethodHead, 0, -1, []string{"Range", "bytes=2-4"}, http.StatusPartialContent, "bytes 2-4/10", ""},
+		{http.MethodGet, 0, -1, []string{"If-None-Match", etag}, http.StatusNotModified, "", ""},
+		{http.MethodGet, 0, -1, []string{"If-None-Match", `"other"`}, http.StatusOK, "", "0123456789"},
+		{http.MethodGet, 2, 5, []string{"If-None-Match", etag}, http.StatusOK, "", "23456"},
+		{http.MethodGet, 0, -1, []string{"If-Modified-Since", modified}, http.StatusNotModified, "", ""},
+		{http.MethodGet, 0, -1, []string{"If-Modified-Since", before}, http.StatusOK, "", "0123456789"},
+		{http.MethodGet, 0, -1, []string{"If-Range", etag, "Range", "bytes=0-0"}, http.StatusPartialContent, "bytes 0-0/10", "0"},
+		{http.MethodGet, 0, -1, []string{"If-Range", `"other"`, "Range", "bytes=0-0"}, http.StatusOK, "", "0123456789"},
+	}
+
+	for i, tc := range tests {
+		w := serve(tc.method, tc.offset, tc.size, tc.header...)
+		if w.Code != tc.status {
+			t.Fatalf("%v: status: %v %s", i, w.Code, w.Body)
+		}
+		if rng := w.Header().Get("Content-Range"); rng != tc.rng {
+			t.Fatalf("%v: range: %q", i, rng)
+		}
+		if w.Code < 300 && w.Body.String() != tc.body {
+			t.Fatalf("%v: body: %q", i, w.Body)
+		}
+		if w.Code == http.StatusOK && tc.method == http.MethodHead && w.Header().Get("Content-Length") != "10" {
+			t.Fatalf("%v: length: %q", i, w.Header().Get("Content-Length"))
+		}
+	}
+
+	// a section has its own etag
+	if e := serve(http.MethodGet, 2, 5).Header().Get("ETag"); e == etag || !strings.HasPrefix(e, `"`) || !strings.HasSuffix(e, `"`) {
+		t.Fatalf("section etag: %v %v", e, etag)
+	}
+
+	// multiple ranges are replied as multipart/byteranges
+	w := serve(http.MethodGet, 0, -1, "Range", "bytes=0-1,5-6")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("multipart: status: %v", w.Code)
+	}
+	mt, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("multipart: %q %v", mt, err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, part := range []struct{ rng, body string }{{"bytes 0-1/10", "01"}, {"bytes 5-6/10", "56"}} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("multipart: %v", err)
+		}
+		b, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Range") != part.rng || string(b) != part.body {
+			t.Fatalf("multipart: %q %q", p.Header.Get("Content-Range"), b)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("multipart: %v", err)
+	}
+
+	// directories are not served
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer d.Close()
+	w = httptest.NewRecorder()
+	ServeContent(w, httptest.NewRequest(http.MethodGet, "/", nil), "/", d, 0, -1)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("dir: %v", w.Code)
+	}
+}
@@ -2,34 +2,40 @@ package handler
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dhnt/nomad/api"
 	"github.com/dhnt/nomad/api/fs"
 )
 
+const watchPingInterval = time.Second * 30
+
+// reference to a field of the result of an earlier call of a batch
+var resultRefRe = regexp.MustCompile(`^\$(\d+)((?:\.\w+)+)$`)
+
 type FileHandler struct {
 	prefix string
 	node   *fs.FileNode
 }
 
-func NewFileHandler(prefix string, root string, baseUrl *url.URL) (*FileHandler, error) {
-	node, err := fs.NewFileNode(root, baseUrl)
-	if err != nil {
-		return nil, err
-	}
+func NewFileHandler(prefix string, node *fs.FileNode) *FileHandler {
 	return &FileHandler{
 		prefix: prefix,
 		node:   node,
-	}, nil
+	}
 }
 
 func StatusText(code int) string {
@@ -43,6 +49,7 @@ var (
 	errPrefixMismatch          = errors.New("prefix mismatch")
 	errUnsupportedMethod       = errors.New("unsupported method")
 	errNotImplemented          = errors.New("not implemented")
+	errChecksumMismatch        = errors.New("checksum mismatch")
 )
 
 type ETager interface {
@@ -105,6 +112,7 @@ func (h *FileHandler) handleOptions(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Allow", allow)
 	w.Header().Set("X-Web-FS", "1.0.0")
+	w.Header().Set(api.InlineHeader, strconv.FormatInt(h.node.InlineMax, 10))
 
 	return
 }
@@ -142,6 +150,21 @@ func (h *FileHandler) handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	client := r.Header.Get(api.ClientHeader)
+	h.node.Keepalive(client)
+
+	switch call {
+	case "batch":
+		h.batch(w, r, client)
+		return
+	case "watch":
+		h.watch(w, r)
+		return
+	case "put":
+		h.put(w, r)
+		return
+	}
+
 	var args api.CallArgs
 
 	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
@@ -151,31 +174,341 @@ func (h *FileHandler) handle(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("%s %v", call, args)
 
+	res, err := h.run(r.Context(), client, call, &args)
+	if err == errUnsupportedMethod {
+		notSupported(w, r, r.URL.Path)
+		return
+	}
+
+	jsonResponse(w, r, res)
+}
+
+// batch runs the calls in order in one request and replies with the result
+// of each. Calls after the first failure are not run if requested. Args may
+// refer to the results of earlier calls, see resolveRefs.
+func (h *FileHandler) batch(w http.ResponseWriter, r *http.Request, client string) {
+	var req api.BatchReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	log.Printf("batch %v calls stop on error: %v", len(req.Calls), req.StopOnError)
+
+	results := make([]api.CallResult, 0, len(req.Calls))
+	for _, v := range req.Calls {
+		args := v.Args
+		if args == nil {
+			args = &api.CallArgs{}
+		}
+		var res api.CallResult
+		if err := resolveRefs(args, results); err != nil {
+			res = toResult(nil, err)
+		} else if res, err = h.run(r.Context(), client, v.Call, args); err != nil {
+			res = toResult(nil, syscall.ENOSYS)
+		}
+		results = append(results, res)
+		if res.Status != 0 && req.StopOnError {
+			break
+		}
+	}
+
+	jsonResponse(w, r, toResult(results, nil))
+}
+
+// resolveRefs replaces the string args of the form $<i>.<field>[.<field>...]
+// with the field of the result of the earlier call i, e.g. "$0.data.id" for
+// the handle opened by the first call. It fails with EINVAL for refs to
+// calls not run before or fields missing, with the status of a failed call.
+func resolveRefs(args *api.CallArgs, results []api.CallResult) error {
+	for _, p := range []*string{&args.Path, &args.Link, &args.To, &args.Handle, &args.ToHandle, &args.Name, &args.Job, &args.IfMatch} {
+		m := resultRefRe.FindStringSubmatch(*p)
+		if m == nil {
+			continue
+		}
+		i, err := strconv.Atoi(m[1])
+		if err != nil || i >= len(results) {
+			return &os.PathError{Op: "ref", Path: *p, Err: syscall.EINVAL}
+		}
+		if results[i].Status != 0 {
+			return results[i].Status
+		}
+
+		// the fields as in the reply
+		b, err := json.Marshal(results[i])
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		for _, name := range strings.Split(m[2][1:], ".") {
+			obj, _ := v.(map[string]interface{})
+			v = obj[name]
+		}
+		switch v := v.(type) {
+		case string:
+			*p = v
+		case float64:
+			*p = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return &os.PathError{Op: "ref", Path: *p, Err: syscall.EINVAL}
+		}
+	}
+	return nil
+}
+
+// put atomically replaces the file of the path query param with the request
+// body or the file of the from param. The perm (octal), uid, gid, sync and
+// tx params and the If-Match header are as for api.PutOptions. The sha256 in
+// the checksum header or trailer is verified before the file is replaced.
+func (h *FileHandler) put(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rel := q.Get("path")
+	opts := &api.PutOptions{
+		IfMatch: r.Header.Get("If-Match"),
+		From:    q.Get("from"),
+		Tx:      q.Get("tx"),
+	}
+	if v := q.Get("perm"); v != "" {
+		perm, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			badRequest(w, r, err)
+			return
+		}
+		p := uint32(perm)
+		opts.Perm = &p
+	}
+	if q.Has("uid") || q.Has("gid") {
+		uid, err := strconv.Atoi(q.Get("uid"))
+		if err != nil {
+			badRequest(w, r, err)
+			return
+		}
+		gid, err := strconv.Atoi(q.Get("gid"))
+		if err != nil {
+			badRequest(w, r, err)
+			return
+		}
+		opts.Owner = &api.Owner{Uid: uid, Gid: gid}
+	}
+	opts.Sync, _ = strconv.ParseBool(q.Get("sync"))
+
+	log.Printf("put %v %+v", rel, opts)
+
+	hash := sha256.New()
+	verify := func() error {
+		// the trailer is available once the body is read
+		sum := r.Header.Get(api.ChecksumHeader)
+		if sum == "" {
+			sum = r.Trailer.Get(api.ChecksumHeader)
+		}
+		if sum != "" && !strings.EqualFold(sum, hex.EncodeToString(hash.Sum(nil))) {
+			return fmt.Errorf("%w: %v", errChecksumMismatch, sum)
+		}
+		return nil
+	}
+	if opts.From != "" {
+		verify = nil
+	}
+
+	st, err := h.node.Put(rel, io.TeeReader(r.Body, hash), opts, verify)
+	if errors.Is(err, errChecksumMismatch) {
+		badRequest(w, r, err)
+		return
+	}
+
+	res := toResult(st, err)
+	if err == nil {
+		res.ETag = fs.ETag(st)
+	}
+	jsonResponse(w, r, res)
+}
+
+// watch streams the change events of the path in the query as server sent
+// events, including subdirectories if recursive is set.
+func (h *FileHandler) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		notSupported(w, r, r.URL.Path)
+		return
+	}
+
+	q := r.URL.Query()
+	rel := q.Get("path")
+	recursive, _ := strconv.ParseBool(q.Get("recursive"))
+
+	wt, err := h.node.NewWatch(rel, recursive)
+	if err != nil {
+		switch api.ToErrno(err) {
+		case syscall.ENOENT:
+			notFound(w, r, rel)
+		case syscall.ENOSPC:
+			// too many directories, the client stops watching
+			insufficientStorage(w, r, err)
+		default:
+			internalServerError(w, r, err)
+		}
+		return
+	}
+	defer wt.Close()
+
+	log.Printf("watch %v recursive: %v", rel, recursive)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	events := make(chan api.Event, 64)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- wt.Run(ctx, func(e *api.Event) {
+			select {
+			case events <- *e:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(watchPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			b, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		case <-ticker.C:
+			// keeps proxies from closing the idle stream
+			fmt.Fprintf(w, ": ping\n\n")
+		case err := <-errc:
+			log.Printf("watch %v: %v", rel, err)
+			if api.ToErrno(err) == syscall.ENOSPC {
+				b, _ := json.Marshal(&api.Event{Op: api.EventLimit, Path: rel})
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// calls with the if_match precondition
+var conditionalCalls = map[string]bool{
+	"write":    true,
+	"truncate": true,
+	"setattr":  true,
+	"rename":   true,
+	"unlink":   true,
+	"rmdir":    true,
+}
+
+// conditional calls on the entry itself, a symlink is not followed
+var namespaceCalls = map[string]bool{
+	"rename": true,
+	"unlink": true,
+	"rmdir":  true,
+}
+
+// calls returning the etag of the file
+var etagCalls = map[string]bool{
+	"stat":     true,
+	"lstat":    true,
+	"open":     true,
+	"create":   true,
+	"read":     true,
+	"write":    true,
+	"truncate": true,
+	"setattr":  true,
+	"rename":   true,
+}
+
+// run runs the call if its precondition holds and returns the result with
+// the etag of the file. It returns errUnsupportedMethod for unknown calls.
+func (h *FileHandler) run(ctx context.Context, client string, call string, args *api.CallArgs) (api.CallResult, error) {
+	var data interface{}
+	var etag, ifMatch string
+	if conditionalCalls[call] {
+		ifMatch = args.IfMatch
+	}
+	// the etag is taken under the same precondition check
+	sterr := h.node.IfMatch(args.Path, args.Handle, ifMatch, !namespaceCalls[call], func() error {
+		var err error
+		data, err = h.call(ctx, client, call, args)
+		if err == nil && etagCalls[call] {
+			etag = h.etag(call, args, data)
+		}
+		return err
+	})
+	if sterr == errUnsupportedMethod {
+		return api.CallResult{}, sterr
+	}
+
+	res := toResult(data, sterr)
+	res.ETag = etag
+	return res, nil
+}
+
+// etag returns the etag of the file of the call result, empty if the file
+// is gone.
+func (h *FileHandler) etag(call string, args *api.CallArgs, data interface{}) string {
+	switch v := data.(type) {
+	case *syscall.Stat_t:
+		return fs.ETag(v)
+	case *api.FileHandle:
+		return fs.ETag(v.Stat)
+	}
+	p := args.Path
+	if call == "rename" {
+		p = args.To
+	}
+	etag, _ := h.node.ETag(p, args.Handle, !namespaceCalls[call])
+	return etag
+}
+
+// call dispatches the fs call. It returns errUnsupportedMethod for unknown
+// calls.
+func (h *FileHandler) call(ctx context.Context, client string, call string, args *api.CallArgs) (interface{}, error) {
 	var data interface{}
 	var sterr error
 
 	switch call {
 	case "statfs":
-		v, err := h.node.Statfs(args.Path)
-		sterr = err
-		if data, err = ToStatfsOut(v); err != nil {
-			internalServerError(w, r, err)
-			return
+		var v *syscall.Statfs_t
+		if v, sterr = h.node.Statfs(args.Path); sterr == nil {
+			data, sterr = ToStatfsOut(v)
 		}
 	case "lstat":
 		data, sterr = h.node.Lstat(args.Path)
 	case "stat":
-		data, sterr = h.node.Stat(args.Path)
+		if args.Handle != "" {
+			data, sterr = h.node.Fstat(args.Handle)
+		} else {
+			data, sterr = h.node.Stat(args.Path)
+		}
 	case "mknod":
 		data, sterr = h.node.Mknod(args.Path, args.Attr)
 	case "mkdir":
-		data, sterr = h.node.Mkdir(args.Path, args.Attr)
-	case "rmdir":
-		sterr = h.node.Rmdir(args.Path)
-		data = ""
-	case "unlink":
-		sterr = h.node.Unlink(args.Path)
-		data = ""
+		if args.Recursive {
+			data, sterr = h.node.MkdirAll(args.Path, args.Attr)
+		} else {
+			data, sterr = h.node.Mkdir(args.Path, args.Attr)
+		}
+	case "rmdir", "unlink":
+		if args.Recursive {
+			data, sterr = h.node.RemoveAll(args.Path)
+		} else if call == "rmdir" {
+			sterr = h.node.Rmdir(args.Path)
+			data = ""
+		} else {
+			sterr = h.node.Unlink(args.Path)
+			data = ""
+		}
 	case "rename":
 		sterr = h.node.Rename(args.Path, args.To)
 		data = ""
@@ -186,43 +519,139 @@ func (h *FileHandler) handle(w http.ResponseWriter, r *http.Request) {
 	case "readlink":
 		data, sterr = h.node.Readlink(args.Path)
 	case "open":
-		data, sterr = h.node.Open(args.Path, args.Attr)
+		data, sterr = h.node.Open(client, args.Path, args.Attr)
 	case "create":
-		data, sterr = h.node.Create(args.Path, args.Attr)
+		data, sterr = h.node.Create(client, args.Path, args.Attr)
+	case "release":
+		sterr = h.node.Release(args.Handle)
+		data = ""
+	case "fsync":
+		sterr = h.node.Fsync(args.Handle)
+		data = ""
+	case "keepalive":
+		data = ""
+	case "disconnect":
+		data = h.node.Disconnect(client)
 	case "opendir":
 		sterr = h.node.Opendir(args.Path)
 		data = ""
 	case "readdir":
 		data, sterr = h.node.Readdir(args.Path)
+	case "readdirplus":
+		data, sterr = h.node.ReaddirPlus(args.Path, args.Cookie, args.Count)
 	case "chmod":
-		sterr = h.node.Chmod(args.Path, args.Attr)
-		data = ""
+		if args.Recursive {
+			data, sterr = h.node.ChmodAll(args.Path, args.Attr)
+		} else {
+			sterr = h.node.Chmod(args.Path, args.Attr)
+			data = ""
+		}
 	case "chown":
-		sterr = h.node.Chown(args.Path, args.Attr)
-		data = ""
+		if args.Recursive {
+			data, sterr = h.node.ChownAll(args.Path, args.Attr)
+		} else {
+			sterr = h.node.Chown(args.Path, args.Attr)
+			data = ""
+		}
 	case "truncate":
-		sterr = h.node.Truncate(args.Path, args.Attr)
+		if args.Handle != "" {
+			sterr = h.node.Ftruncate(args.Handle, args.Attr)
+		} else {
+			sterr = h.node.Truncate(args.Path, args.Attr)
+		}
 		data = ""
 	case "setattr":
-		data, sterr = h.node.Setattr(args.Path, args.Attr)
+		if args.Handle != "" {
+			data, sterr = h.node.Fsetattr(args.Handle, args.Attr)
+		} else {
+			data, sterr = h.node.Setattr(args.Path, args.Attr)
+		}
+	case "getxattr":
+		data, sterr = h.node.Getxattr(args.Path, args.Name)
+	case "setxattr":
+		sterr = h.node.Setxattr(args.Path, args.Name, args.Value, args.Flags)
+		data = ""
+	case "listxattr":
+		data, sterr = h.node.Listxattr(args.Path)
+	case "removexattr":
+		sterr = h.node.Removexattr(args.Path, args.Name)
+		data = ""
+	case "fallocate":
+		sterr = h.node.Fallocate(args.Path, args.Handle, args.Attr, args.Flags)
+		data = ""
+	case "copy":
+		if args.Recursive {
+			data, sterr = h.node.CopyAll(args.Path, args.To)
+		} else {
+			data, sterr = h.node.Copy(args.Path, args.Handle, args.Attr, args.To, args.ToHandle, args.ToOffset)
+		}
+	case "job":
+		data, sterr = h.node.Job(args.Job)
+	case "jobs":
+		data = h.node.ListJobs()
+	case "canceljob":
+		sterr = h.node.CancelJob(args.Job)
+		data = ""
+	case "getlk":
+		data, sterr = h.node.Getlk(client, args.Handle, args.Lock)
+	case "setlk":
+		sterr = h.node.Setlk(ctx, client, args.Handle, args.Lock, false)
+		data = ""
+	case "setlkw":
+		sterr = h.node.Setlk(ctx, client, args.Handle, args.Lock, true)
+		data = ""
+	case "txbegin":
+		data, sterr = h.node.BeginTx()
+	case "tx":
+		data, sterr = h.node.Tx(args.Tx)
+	case "txs":
+		data = h.node.ListTxs()
+	case "txdelete":
+		sterr = h.node.StageDelete(args.Tx, args.Path, args.IfMatch)
+		data = ""
+	case "txcommit":
+		sterr = h.node.CommitTx(args.Tx)
+		data = ""
+	case "txabort":
+		sterr = h.node.AbortTx(args.Tx)
+		data = ""
+	case "trash":
+		data, sterr = h.node.ListTrash()
+	case "restore":
+		data, sterr = h.node.RestoreTrash(args.Trash, args.To)
+	case "purge":
+		sterr = h.node.PurgeTrash(args.Trash)
+		data = ""
+	case "snapshot":
+		data, sterr = h.node.CreateSnapshot(args.Snapshot, args.Path, args.Method)
+	case "snapshots":
+		data, sterr = h.node.ListSnapshots()
+	case "deletesnapshot":
+		sterr = h.node.DeleteSnapshot(args.Snapshot)
+		data = ""
+	case "restoresnapshot":
+		data, sterr = h.node.RestoreSnapshot(args.Snapshot, args.Path, args.To)
+	case "checksum":
+		data, sterr = h.node.Checksum(args.Path, args.Handle, args.Hash, args.Ranges)
 	case "read":
-		data, sterr = h.node.Read(args.Path, args.Attr)
+		data, sterr = h.node.Read(args.Path, args.Handle, args.Attr, args.Inline, args.Holes)
+	case "lseek":
+		data, sterr = h.node.Lseek(args.Handle, args.Attr, args.Flags)
 	case "write":
-		data, sterr = h.node.Write(args.Path, args.Attr)
+		data, sterr = h.node.Write(args.Path, args.Handle, args.Attr, args.Data, args.IfMatch)
 	default:
-		notSupported(w, r, r.URL.Path)
-		return
+		return nil, errUnsupportedMethod
 	}
+	return data, sterr
+}
 
-	toMsg := func(e error) string {
-		if e == nil {
-			return ""
-		}
-		return e.Error()
-	}
-	jsonResponse(w, r, api.CallResult{
-		Status: api.ToErrno(sterr),
-		Error:  toMsg(sterr),
+func toResult(data interface{}, err error) api.CallResult {
+	res := api.CallResult{
+		Status: api.ToErrno(err),
 		Data:   data,
-	})
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
 }
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+	"github.com/dhnt/nomad/api/fs"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := fs.NewFileNode(dir, u, fs.NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := NewFileHandler("/fs/", n)
+
+	batch := func(req *api.BatchReq) []api.CallResult {
+		b, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/fs/batch", bytes.NewReader(b)))
+		var res api.CallResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		var results []api.CallResult
+		b, _ = json.Marshal(res.Data)
+		json.Unmarshal(b, &results)
+		return results
+	}
+	status := func(results []api.CallResult) []syscall.Errno {
+		var s []syscall.Errno
+		for _, r := range results {
+			s = append(s, r.Status)
+		}
+		return s
+	}
+	flags, rdonly := uint32(os.O_RDWR|os.O_CREATE), uint32(os.O_RDONLY)
+	perm := uint32(0644)
+	off, size := int64(0), int64(4)
+
+	// the handle of the create is used by the following calls
+	results := batch(&api.BatchReq{Calls: []api.BatchCall{
+		{Call: "create", Args: &api.CallArgs{Path: "/f", Attr: &api.Attr{Mode: &flags, Perm: &perm}}},
+		{Call: "write", Args: &api.CallArgs{Handle: "$0.data.id", Attr: &api.Attr{Offset: &off, Size: &size}, Data: []byte("data")}},
+		{Call: "release", Args: &api.CallArgs{Handle: "$0.data.id"}},
+	}})
+	if s := status(results); len(s) != 3 || s[0] != 0 || s[1] != 0 || s[2] != 0 {
+		t.Fatalf("refs: %+v", results)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "f")); string(b) != "data" {
+		t.Fatalf("refs: %q", b)
+	}
+
+	tests := []struct {
+		stop  bool
+		calls []api.BatchCall
+		want  []syscall.Errno
+	}{
+		{true, []api.BatchCall{
+			{Call: "lstat", Args: &api.CallArgs{Path: "/f"}},
+			{Call: "lstat", Args: &api.CallArgs{Path: "/x"}},
+			{Call: "lstat", Args: &api.CallArgs{Path: "/f"}},
+		}, []syscall.Errno{0, syscall.ENOENT}},
+		{false, []api.BatchCall{
+			{Call: "lstat", Args: &api.CallArgs{Path: "/x"}},
+			{Call: "lstat", Args: &api.CallArgs{Path: "/f"}},
+		}, []syscall.Errno{syscall.ENOENT, 0}},
+		// refs to failed, later and missing results
+		{false, []api.BatchCall{
+			{Call: "open", Args: &api.CallArgs{Path: "/x", Attr: &api.Attr{Mode: &rdonly, Perm: &perm}}},
+			{Call: "release", Args: &api.CallArgs{Handle: "$0.data.id"}},
+			{Call: "release", Args: &api.CallArgs{Handle: "$3.data.id"}},
+			{Call: "lstat", Args: &api.CallArgs{Path: "$2.data.x"}},
+		}, []syscall.Errno{syscall.ENOENT, syscall.ENOENT, syscall.EINVAL, syscall.EINVAL}},
+		{true, []api.BatchCall{
+			{Call: "nosuchcall"},
+			{Call: "lstat", Args: &api.CallArgs{Path: "/f"}},
+		}, []syscall.Errno{syscall.ENOSYS}},
+	}
+	for i, tc := range tests {
+		results := batch(&api.BatchReq{Calls: tc.calls, StopOnError: tc.stop})
+		if s := status(results); !reflect.DeepEqual(s, tc.want) {
+			t.Fatalf("%v: %v", i, s)
+		}
+	}
+}
+
+func TestNamespaceIfMatch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"l", "m"} {
+		if err := os.Symlink("f", filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	u, _ := url.Parse("http://localhost:58080/")
+	n, err := fs.NewFileNode(dir, u, fs.NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := NewFileHandler("/fs/", n)
+
+	call := func(call string, args *api.CallArgs) api.CallResult {
+		res, err := h.run(context.Background(), "", call, args)
+		if err != nil {
+			t.Fatalf("%v: %v", call, err)
+		}
+		return res
+	}
+
+	// the etag of the target does not match the symlink
+	target := call("stat", &api.CallArgs{Path: "/l"}).ETag
+	link := call("lstat", &api.CallArgs{Path: "/l"}).ETag
+	tests := []struct {
+		call string
+		args *api.CallArgs
+		want syscall.Errno
+	}{
+		{"unlink", &api.CallArgs{Path: "/l", IfMatch: target}, api.ErrConflict},
+		{"rename", &api.CallArgs{Path: "/l", To: "/k", IfMatch: target}, api.ErrConflict},
+		{"rmdir", &api.CallArgs{Path: "/l", IfMatch: target}, api.ErrConflict},
+		{"rename", &api.CallArgs{Path: "/l", To: "/k", IfMatch: link}, 0},
+	}
+	for i, tc := range tests {
+		if res := call(tc.call, tc.args); res.Status != tc.want {
+			t.Fatalf("%v: %v %+v", i, tc.call, res)
+		}
+	}
+
+	etag := call("lstat", &api.CallArgs{Path: "/k"}).ETag
+	if res := call("unlink", &api.CallArgs{Path: "/k", IfMatch: etag}); res.Status != 0 {
+		t.Fatalf("unlink: %+v", res)
+	}
+
+	// the etag after rename is of the entry
+	etag = call("lstat", &api.CallArgs{Path: "/m"}).ETag
+	res := call("rename", &api.CallArgs{Path: "/m", To: "/n", IfMatch: etag})
+	if res.Status != 0 || res.ETag != call("lstat", &api.CallArgs{Path: "/n"}).ETag {
+		t.Fatalf("rename etag: %+v", res)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "f")); err != nil {
+		t.Fatalf("target: %v", err)
+	}
+}
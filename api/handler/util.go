@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func internalServerError(w http.ResponseWriter, r *http.Request, err error) {
@@ -15,6 +17,30 @@ func internalServerError(w http.ResponseWriter, r *http.Request, err error) {
 	log.Println(s)
 }
 
+func badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	s := fmt.Sprintf("bad request: %v\n", err)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(s))
+
+	log.Println(s)
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	s := fmt.Sprintf("forbidden: %v\n", err)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(s))
+
+	log.Println(s)
+}
+
+func preconditionFailed(w http.ResponseWriter, r *http.Request, err error) {
+	s := fmt.Sprintf("precondition failed: %v\n", err)
+	w.WriteHeader(http.StatusPreconditionFailed)
+	w.Write([]byte(s))
+
+	log.Println(s)
+}
+
 func notFound(w http.ResponseWriter, r *http.Request, v interface{}) {
 	s := fmt.Sprintf("not found: %v\n", v)
 	w.WriteHeader(http.StatusNotFound)
@@ -31,6 +57,14 @@ func notSupported(w http.ResponseWriter, r *http.Request, v interface{}) {
 	log.Println(s)
 }
 
+func insufficientStorage(w http.ResponseWriter, r *http.Request, err error) {
+	s := fmt.Sprintf("insufficient storage: %v\n", err)
+	w.WriteHeader(http.StatusInsufficientStorage)
+	w.Write([]byte(s))
+
+	log.Println(s)
+}
+
 func jsonResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -43,3 +77,36 @@ func jsonResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
 
 	log.Printf("%v", string(b))
 }
+
+// parseContentRange parses the Content-Range header of an upload in the form
+// "bytes first-last/total" where total may be "*". It returns the first byte
+// position and the length of the range.
+func parseContentRange(s string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil || end >= n {
+			return 0, 0, fmt.Errorf("invalid content range: %q", s)
+		}
+	}
+	return start, end - start + 1, nil
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		start  int64
+		length int64
+		err    bool
+	}{
+		{"bytes 0-9/*", 0, 10, false},
+		{"bytes 5-7/100", 5, 3, false},
+		{"bytes 0-0/1", 0, 1, false},
+		{"bytes 0-9/9", 0, 0, true},
+		{"bytes 7-5/*", 0, 0, true},
+		{"bytes -5/*", 0, 0, true},
+		{"bytes 0-9", 0, 0, true},
+		{"items 0-9/*", 0, 0, true},
+	}
+
+	for _, tc := range tests {
+		start, length, err := parseContentRange(tc.s)
+		if (err != nil) != tc.err {
+			t.Fatalf("%q: %v", tc.s, err)
+		}
+		if start != tc.start || length != tc.length {
+			t.Fatalf("%q: expected %v %v, got: %v %v", tc.s, tc.start, tc.length, start, length)
+		}
+	}
+}
@@ -9,6 +9,29 @@ import (
 	"time"
 )
 
+// InlineHeader advertises the max size of data the server transfers inline
+// in read/write calls.
+const InlineHeader = "X-Web-FS-Inline"
+
+// Whence of lseek for sparse files, the values are those of Linux.
+const (
+	SeekData = 3
+	SeekHole = 4
+)
+
+// ChecksumHeader carries the hex encoded sha256 of a blob upload, as header
+// or trailer.
+const ChecksumHeader = "X-Content-Sha256"
+
+// Hash algorithms of checksum, the sums are hex encoded.
+const (
+	HashSHA256 = "sha256"
+	HashXXH64  = "xxh64"
+)
+
+// ClientHeader identifies the client owning the open file handles.
+const ClientHeader = "X-Nomad-Client"
+
 type Owner struct {
 	Uid int `json:"uid"`
 	Gid int `json:"gid"`
@@ -34,19 +57,115 @@ type CallArgs struct {
 	Link string `json:"link,omitempty"`
 	To   string `json:"to,omitempty"`
 
+	// open file handle
+	Handle string `json:"handle,omitempty"`
+
+	// max size of read data the client accepts inline
+	Inline int64 `json:"inline,omitempty"`
+	// whether the client accepts holes reported in read
+	Holes bool `json:"holes,omitempty"`
+	// inline write data
+	Data []byte `json:"data,omitempty"`
+
+	// extended attribute name, value and XATTR_* or FALLOC_FL_* flags
+	Name  string `json:"name,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Flags int    `json:"flags,omitempty"`
+
+	// destination handle and offset of copy, the destination path is To
+	ToHandle string `json:"to_handle,omitempty"`
+	ToOffset int64  `json:"to_offset,omitempty"`
+
+	Lock *Lock `json:"lock,omitempty"`
+
+	// continuation cookie and max count of entries of readdirplus
+	Cookie int64 `json:"cookie,omitempty"`
+	Count  int   `json:"count,omitempty"`
+
+	// recursive rmdir/unlink, copy, chmod and chown run as job, recursive
+	// mkdir creates the parents
+	Recursive bool `json:"recursive,omitempty"`
+	// id of the job of job and canceljob
+	Job string `json:"job,omitempty"`
+
+	// etag the file must match for write, truncate, setattr, rename, unlink
+	// and rmdir, "*" for any. It is of the lstat of the entry for rename,
+	// unlink and rmdir.
+	IfMatch string `json:"if_match,omitempty"`
+
+	// id of the transaction of tx, txdelete, txcommit and txabort
+	Tx string `json:"tx,omitempty"`
+
+	// id of the trash entry of restore and purge, "*" purges all
+	Trash string `json:"trash,omitempty"`
+
+	// name of the snapshot and method of creating it
+	Snapshot string `json:"snapshot,omitempty"`
+	Method   string `json:"method,omitempty"`
+
+	// hash algorithm and byte ranges of checksum
+	Hash   string  `json:"hash,omitempty"`
+	Ranges []Range `json:"ranges,omitempty"`
+
 	Attr *Attr `json:"attr,omitempty"`
 }
 
+// ErrConflict is the status of a call whose if_match precondition failed,
+// the file was changed since the etag was returned. It is not returned by
+// file system calls, unlike ESTALE of stale handles.
+const ErrConflict = syscall.EIDRM
+
 type CallResult struct {
 	Status syscall.Errno `json:"status"`
 	Error  string        `json:"error,omitempty"`
 	Data   interface{}   `json:"data,omitempty"`
+
+	// version of the file after stat, lstat, open, create, read, write,
+	// truncate, setattr and rename
+	ETag string `json:"etag,omitempty"`
+}
+
+// Ops of change events, overflow means events were lost and the path should
+// be rescanned. limit ends the stream as there are more directories than the
+// server watches.
+const (
+	EventCreate   = "create"
+	EventModify   = "modify"
+	EventAttrib   = "attrib"
+	EventDelete   = "delete"
+	EventRename   = "rename"
+	EventOverflow = "overflow"
+	EventLimit    = "limit"
+)
+
+// Event is a change of the file at path relative to the root. To is the new
+// path of rename.
+type Event struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	To    string `json:"to,omitempty"`
+	IsDir bool   `json:"isdir,omitempty"`
+}
+
+type BatchCall struct {
+	Call string    `json:"call"`
+	Args *CallArgs `json:"args,omitempty"`
+}
+
+// BatchReq runs the calls in order in a single request. The result has the
+// CallResult of each call run. String args of the form $<i>.<field>... refer
+// to the field of the result of the earlier call i, e.g. "$0.data.id" for
+// the handle opened by the first call.
+type BatchReq struct {
+	Calls       []BatchCall `json:"calls"`
+	StopOnError bool        `json:"stop_on_error,omitempty"`
 }
 
 type CallResultRaw struct {
 	Status syscall.Errno   `json:"status"`
 	Error  string          `json:"error,omitempty"`
 	Data   json.RawMessage `json:"data,omitempty"`
+	ETag   string          `json:"etag,omitempty"`
 }
 
 type FileInfo struct {
@@ -57,6 +176,19 @@ type FileInfo struct {
 	IsDir   bool      `json:"isdir"`
 }
 
+type DirEntryPlus struct {
+	Name string         `json:"name"`
+	Stat syscall.Stat_t `json:"stat"`
+}
+
+// DirPage is a page of readdirplus. Cookie continues reading after the last
+// entry until EOF.
+type DirPage struct {
+	Entries []DirEntryPlus `json:"entries"`
+	Cookie  int64          `json:"cookie"`
+	EOF     bool           `json:"eof"`
+}
+
 type DirEntry struct {
 	Name  string   `json:"name"`
 	IsDir bool     `json:"isdir"`
@@ -64,15 +196,147 @@ type DirEntry struct {
 	Info  FileInfo `json:"info"`
 }
 
+// Lock is a byte range POSIX lock or a whole file flock lock. The range is
+// inclusive, type is one of F_RDLCK, F_WRLCK and F_UNLCK.
+type Lock struct {
+	Owner uint64 `json:"owner"`
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	Type  uint32 `json:"type"`
+	Pid   uint32 `json:"pid"`
+	Flock bool   `json:"flock,omitempty"`
+}
+
+type FileHandle struct {
+	ID   string          `json:"id"`
+	Stat *syscall.Stat_t `json:"stat"`
+}
+
 type BlobInfo struct {
 	Path   string `json:"path"`
+	Handle string `json:"handle,omitempty"`
 	Offset int64  `json:"offset"`
 	Size   int64  `json:"size"`
 	Perm   uint32 `json:"perm"`
 
 	Href string `json:"href"`
+
+	// inline data if href is empty
+	Data []byte `json:"data,omitempty"`
+
+	// the range is a hole of zeros, neither href nor data are set
+	Hole bool `json:"hole,omitempty"`
+
+	// etag precondition of the upload to href
+	IfMatch string `json:"if_match,omitempty"`
+}
+
+// BlobResult is the result of a blob upload, the count of bytes written and
+// the etag of the file after the write.
+type BlobResult struct {
+	N    int64
+	ETag string `json:"etag,omitempty"`
+}
+
+type Range struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// Checksum is the sum of a range. The size is short of the requested one
+// if the range extends past the end of the file.
+type Checksum struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Sum    string `json:"sum"`
+}
+
+// PutOptions of the atomic put of a whole file. The permissions and owner
+// of an existing file are kept unless set.
+type PutOptions struct {
+	Perm  *uint32 `json:"perm,omitempty"`
+	Owner *Owner  `json:"owner,omitempty"`
+
+	// fsync the file and directory before returning
+	Sync bool `json:"sync,omitempty"`
+
+	// etag the replaced file must match, "*" for any
+	IfMatch string `json:"if_match,omitempty"`
+
+	// path of a file on the server to copy instead of the body
+	From string `json:"from,omitempty"`
+
+	// id of the transaction staging the put, the file is replaced on commit
+	// if the if_match precondition still holds
+	Tx string `json:"tx,omitempty"`
+}
+
+// Tx is a transaction of puts and deletes of files staged on the server and
+// committed together.
+type Tx struct {
+	ID      string    `json:"id"`
+	Ops     []TxOp    `json:"ops"`
+	Created time.Time `json:"created"`
+	// aborted unless staged to or looked up before
+	Expires time.Time `json:"expires"`
 }
 
+// TxOp is the staged put or delete of the path, size is of the put file.
+type TxOp struct {
+	Path   string `json:"path"`
+	Delete bool   `json:"delete,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+// TrashEntry is a deleted file or directory tree kept in the trash. Files
+// is the count of entries of the tree, size the bytes of its files.
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"isdir,omitempty"`
+	Size    int64     `json:"size"`
+	Files   int64     `json:"files"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// Methods of creating snapshots. Copy clones the files by reflink where the
+// file system supports it, reflink fails where it does not.
+const (
+	SnapshotCopy    = "copy"
+	SnapshotReflink = "reflink"
+)
+
+// Snapshot is a captured file or directory tree, readable under
+// /.snapshots/<name>/.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Method  string    `json:"method"`
+	Files   int64     `json:"files"`
+	Bytes   int64     `json:"bytes"`
+	Created time.Time `json:"created"`
+}
+
+// Formats of archive download and upload-extract.
+const (
+	ArchiveTar = "tar"
+	ArchiveTgz = "tgz"
+	ArchiveZip = "zip"
+)
+
+// ArchiveInfo is the count of entries and bytes of files extracted.
+type ArchiveInfo struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// io scheduling classes
+const (
+	IOClassRealtime   = "realtime"
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
 type RunState int
 
 const (
@@ -85,6 +349,27 @@ const (
 
 type RunReq = Proc
 
+// Job is a recursive fs call running on the server. The state is Failed
+// with status ECANCELED if canceled.
+type Job struct {
+	ID   string `json:"id"`
+	Call string `json:"call"`
+	Path string `json:"path"`
+	To   string `json:"to,omitempty"`
+
+	State RunState `json:"state"`
+
+	// progress, count of entries done and bytes copied
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	Status syscall.Errno `json:"status"`
+	Error  string        `json:"error,omitempty"`
+
+	Created time.Time `json:"created"`
+	Elapsed int64     `json:"elapsed"`
+}
+
 type Proc struct {
 	ID string `json:"id"`
 
@@ -103,8 +388,25 @@ type Proc struct {
 
 	Timeout int64 `json:"timeout"`
 
+	// scheduling, applied when the proc starts
+	Nice        *int   `json:"nice,omitempty"`
+	IOClass     string `json:"ioclass,omitempty"`
+	IOPriority  int    `json:"ioprio,omitempty"`
+	CPUs        []int  `json:"cpus,omitempty"`
+	OOMScoreAdj *int   `json:"oomscoreadj,omitempty"`
+
+	// lease in seconds, the proc is killed if not renewed in time
+	Lease   int64     `json:"lease,omitempty"`
+	Renewed time.Time `json:"renewed,omitempty"`
+
 	Meta map[string]string `json:"meta"`
 
+	// owning session if any
+	Session string `json:"session,omitempty"`
+
+	// directory for tmp: paths, removed with the proc
+	Workspace string `json:"workspace,omitempty"`
+
 	//
 	Pid   int      `json:"pid"`
 	State RunState `json:"state"`
@@ -118,6 +420,58 @@ type Proc struct {
 	Cancel context.CancelFunc `json:"-"`
 }
 
+type TemplateParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// regular expression the whole value must match
+	Pattern string `json:"pattern,omitempty"`
+
+	Required bool    `json:"required,omitempty"`
+	Default  *string `json:"default,omitempty"`
+}
+
+// Template is a named proc registered on the server. Placeholders of the
+// form {{name}} in the command, args, dir, env and redirect files are
+// replaced with the param values.
+type Template struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	Params []TemplateParam `json:"params,omitempty"`
+
+	Proc Proc `json:"proc"`
+}
+
+// TemplateInfo is a template as listed to clients, without the proc.
+type TemplateInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	Params []TemplateParam `json:"params,omitempty"`
+}
+
+type TemplateReq struct {
+	Params map[string]string `json:"params"`
+
+	Background bool  `json:"bg"`
+	Lease      int64 `json:"lease,omitempty"`
+}
+
+type Session struct {
+	ID string `json:"id"`
+
+	// working dir relative to the root
+	Cwd string   `json:"cwd"`
+	Env []string `json:"env"`
+
+	// idle timeout in seconds
+	Timeout int64 `json:"timeout"`
+
+	Created  time.Time `json:"created"`
+	Accessed time.Time `json:"accessed"`
+}
+
 type RunResult struct {
 	ID string `json:"id"`
 
@@ -4,12 +4,15 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -22,11 +25,15 @@ type execConfig struct {
 	args    []string
 	bg      bool
 	timeout int64
+	lease   int64
 	outfile string
 	errfile string
 
 	wait     bool
 	interval int64
+
+	session        string
+	sessionTimeout int64
 }
 
 func exec(baseUrl *url.URL, cfg *execConfig) {
@@ -40,6 +47,13 @@ func exec(baseUrl *url.URL, cfg *execConfig) {
 
 	log.Printf("config: %v", cfg)
 
+	if cfg.session != "" {
+		if err := sh.Attach(cfg.session); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	//
 	showError := func(status int, err error) {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
@@ -77,15 +91,72 @@ func exec(baseUrl *url.URL, cfg *execConfig) {
 			showError(1, err)
 		}
 		os.Exit(0)
-	default:
-		r, err := sh.Exec(api.RunReq{
-			Command:    cmd,
-			Args:       cfg.args,
-			Background: cfg.bg,
-			Timeout:    cfg.timeout,
-			Outfile:    cfg.outfile,
-			Errfile:    cfg.errfile,
+	case "session":
+		sub := ""
+		if len(cfg.args) > 0 {
+			sub = cfg.args[0]
+		}
+		switch sub {
+		case "new":
+			result, err := sh.NewSession(cfg.sessionTimeout)
+			if err != nil {
+				showError(1, err)
+			}
+			showResult(result)
+		case "close":
+			if len(cfg.args) < 2 {
+				showError(1, fmt.Errorf("missing session id"))
+			}
+			if err := sh.CloseSession(cfg.args[1]); err != nil {
+				showError(1, err)
+			}
+			os.Exit(0)
+		case "ls", "":
+			result, err := sh.Sessions()
+			if err != nil {
+				showError(1, err)
+			}
+			showResult(result)
+		default:
+			showError(1, fmt.Errorf("unknown session command: %q", sub))
+		}
+	case "fs":
+		// the builtins run through fs calls, not as remote commands
+		if len(cfg.args) == 0 || !shell.IsFsBuiltin(cfg.args[0]) {
+			showError(1, fmt.Errorf("usage: fs mkdir|rm|cp|chmod|chown|echo [args ...]"))
+		}
+		// interrupt cancels the job of recursive calls
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		out, err := sh.Builtin(ctx, cfg.args[0], cfg.args[1:], func(job *api.Job) {
+			log.Printf("%v %v: files: %v bytes: %v", job.Call, job.Path, job.Files, job.Bytes)
 		})
+		stop()
+		if err != nil {
+			showError(1, err)
+		}
+		fmt.Fprint(os.Stdout, out)
+		os.Exit(0)
+	case "templates":
+		result, err := sh.Templates()
+		if err != nil {
+			showError(1, err)
+		}
+		showResult(result)
+	default:
+		var r *api.RunResult
+		if cmd == "template" {
+			r, err = execTemplate(sh, cfg)
+		} else {
+			r, err = sh.Exec(api.RunReq{
+				Command:    cmd,
+				Args:       cfg.args,
+				Background: cfg.bg,
+				Timeout:    cfg.timeout,
+				Lease:      cfg.lease,
+				Outfile:    cfg.outfile,
+				Errfile:    cfg.errfile,
+			})
+		}
 
 		cleanup := func() {
 			if r != nil && cfg.bg {
@@ -115,14 +186,16 @@ func exec(baseUrl *url.URL, cfg *execConfig) {
 
 		log.Printf("%v err: %v", result, err)
 
-		if err != nil || result.Status != 0 {
-			status := 1
-			if result.Status != 0 {
-				status = result.Status
-			}
-			fmt.Fprintf(os.Stderr, "%v %v", result.Error, err)
+		// no result on wait errors
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			cleanup()
-			os.Exit(status)
+			os.Exit(1)
+		}
+		if result.Status != 0 {
+			fmt.Fprintf(os.Stderr, "%v", result.Error)
+			cleanup()
+			os.Exit(result.Status)
 		}
 
 		cleanup()
@@ -130,6 +203,27 @@ func exec(baseUrl *url.URL, cfg *execConfig) {
 	}
 }
 
+// execTemplate runs the template named by the first arg with the remaining
+// args as name=value params.
+func execTemplate(sh *shell.Shell, cfg *execConfig) (*api.RunResult, error) {
+	if len(cfg.args) == 0 {
+		return &api.RunResult{}, fmt.Errorf("missing template name")
+	}
+	params := make(map[string]string)
+	for _, v := range cfg.args[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return &api.RunResult{}, fmt.Errorf("invalid param: %q", v)
+		}
+		params[kv[0]] = kv[1]
+	}
+	return sh.ExecTemplate(cfg.args[0], api.TemplateReq{
+		Params:     params,
+		Background: cfg.bg,
+		Lease:      cfg.lease,
+	})
+}
+
 // execCmd represents the exec command
 var execCmd = &cobra.Command{
 	Use:   "exec",
@@ -158,20 +252,28 @@ to quickly create a Cobra application.`,
 		bg, _ := cmd.Flags().GetBool("bg")
 		wait, _ := cmd.Flags().GetBool("wait")
 		timeout, _ := cmd.Flags().GetInt64("timeout")
+		lease, _ := cmd.Flags().GetInt64("lease")
 		interval, _ := cmd.Flags().GetInt64("interval")
 
 		outfile, _ := cmd.Flags().GetString("out")
 		errfile, _ := cmd.Flags().GetString("err")
 
+		session, _ := cmd.Flags().GetString("session")
+		sessionTimeout, _ := cmd.Flags().GetInt64("session-timeout")
+
 		exec(u, &execConfig{
 			bg:       bg,
 			wait:     wait,
 			cmd:      args[0],
 			args:     args[1:],
 			timeout:  timeout,
+			lease:    lease,
 			interval: interval,
 			outfile:  outfile,
 			errfile:  errfile,
+			session:  session,
+
+			sessionTimeout: sessionTimeout,
 		})
 	},
 }
@@ -196,7 +298,11 @@ func init() {
 	execCmd.Flags().Bool("wait", false, "Wait for the specified command and report its termination status")
 	execCmd.Flags().Int64("timeout", 30, "Timeout in seconds")
 	execCmd.Flags().Int64("interval", 1, "Time interval for wait in seconds")
+	execCmd.Flags().Int64("lease", 0, "Kill the command if not renewed within the lease in seconds, renewed while waiting")
 
 	execCmd.Flags().String("out", "", "Write output to the file if provided")
 	execCmd.Flags().String("err", "", "Write error to the file if provided")
+
+	execCmd.Flags().String("session", "", "Run command in the server side session of id")
+	execCmd.Flags().Int64("session-timeout", 0, "Idle timeout in seconds of a new session, the server default if 0")
 }
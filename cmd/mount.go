@@ -26,6 +26,10 @@ type mountConfig struct {
 	readOnly bool
 	quiet    bool
 
+	// invalidate the kernel cache on server changes
+	watch        bool
+	cacheTimeout time.Duration
+
 	cpuProfile string
 	memProfile string
 
@@ -82,12 +86,13 @@ func mount(cfg *mountConfig) {
 		log.Fatalln(err)
 	}
 
-	sec := time.Second
+	// The timeout options are to be compatible with libfuse defaults,
+	// making benchmarking easier. The nodes use the cache timeout while the
+	// cache is invalidated by the watched server changes.
+	timeout := time.Second
 	opts := &fs.Options{
-		// The timeout options are to be compatible with libfuse defaults,
-		// making benchmarking easier.
-		AttrTimeout:  &sec,
-		EntryTimeout: &sec,
+		AttrTimeout:  &timeout,
+		EntryTimeout: &timeout,
 
 		NullPermissions: true, // Leave file permissions on "000" files as-is
 
@@ -98,6 +103,7 @@ func mount(cfg *mountConfig) {
 			DirectMountStrict: cfg.directMountStrict,
 			FsName:            cfg.remote, // First column in "df -T": original dir
 			Name:              "nomad",    // Second column in "df -T" will be shown as "fuse." + Name
+			EnableLocks:       true,
 		},
 	}
 	if opts.AllowOther {
@@ -121,6 +127,11 @@ func mount(cfg *mountConfig) {
 		log.Println("Mounted!")
 	}
 
+	if n, ok := root.(*fs.WebNode); ok && cfg.watch {
+		n.RootData.CacheTimeout = cfg.cacheTimeout
+		go n.RootData.Watch()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -129,6 +140,12 @@ func mount(cfg *mountConfig) {
 	}()
 
 	server.Wait()
+
+	if n, ok := root.(*fs.WebNode); ok {
+		if err := n.RootData.Close(); err != nil {
+			log.Printf("close: %v", err)
+		}
+	}
 }
 
 func writeMemProfile(fn string, sigs <-chan os.Signal) {
@@ -195,6 +212,11 @@ to quickly create a Cobra application.`,
 			log.Fatal(err)
 		}
 
+		noWatch, _ := cmd.Flags().GetBool("no-watch")
+		c.watch = !noWatch
+		cacheTimeout, _ := cmd.Flags().GetInt64("cache-timeout")
+		c.cacheTimeout = time.Duration(cacheTimeout) * time.Second
+
 		c.cpuProfile, _ = cmd.Flags().GetString("cpu-profile")
 		if err != nil {
 			log.Fatal(err)
@@ -219,5 +241,7 @@ func init() {
 	mountCmd.Flags().Bool("direct-mount-strict", false, "Like direct mount, but don't fall back to fusermount")
 	mountCmd.Flags().String("cpu-profile", "", "Write cpu profile to this file")
 	mountCmd.Flags().String("mem-profile", "", "Write memory profile to this file")
+	mountCmd.Flags().Bool("no-watch", false, "Do not subscribe to server changes, the kernel cache expires in a second as if the server watches too many directories")
+	mountCmd.Flags().Int64("cache-timeout", 60, "Specifies the seconds attributes and entries are cached if watching server changes")
 
 }
@@ -11,8 +11,11 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
+	"time"
 
+	"github.com/dhnt/nomad/api/fs"
 	"github.com/dhnt/nomad/api/handler"
 	"github.com/dhnt/nomad/internal/server"
 
@@ -24,6 +27,40 @@ func health(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("OK\n"))
 }
 
+// rootDir hides the state of the server from browsing.
+type rootDir struct {
+	http.Dir
+}
+
+func (d rootDir) Open(name string) (http.File, error) {
+	if fs.IsState(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := d.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return rootFile{f, path.Clean("/"+name) == "/"}, nil
+}
+
+type rootFile struct {
+	http.File
+	root bool
+}
+
+func (f rootFile) Readdir(count int) ([]os.FileInfo, error) {
+	list, err := f.File.Readdir(count)
+	if f.root {
+		for i, fi := range list {
+			if fs.IsState(fi.Name()) {
+				list = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+	}
+	return list, err
+}
+
 func serve(cfg *server.ServerConfig) {
 	log.Printf("config: %v", cfg)
 
@@ -61,23 +98,51 @@ func serve(cfg *server.ServerConfig) {
 	mux.HandleFunc("/health", health)
 
 	ph := server.NewProcHandler(cfg)
+	if cfg.Templates != "" {
+		if err := ph.LoadTemplates(cfg.Templates); err != nil {
+			log.Fatalf("could not load templates: %v", err)
+		}
+	}
 	mux.Handle("/procs", ph)
 	mux.Handle("/procs/", ph)
 
-	vh := server.NewVolHandler(cfg.Root)
-	mux.Handle("/volumes/", vh)
+	sh := server.NewSessionHandler(cfg, ph)
+	mux.Handle("/sessions", sh)
+	mux.Handle("/sessions/", sh)
 
-	bh := handler.NewBlobHandler("/blob/", cfg.Root)
-	mux.Handle("/blob/", bh)
+	handles := fs.NewHandleTable(cfg.HandleLease)
 
-	fh, err := handler.NewFileHandler("/fs/", cfg.Root, cfg.Url)
+	node, err := fs.NewFileNode(cfg.Root, cfg.Url, handles)
 	if err != nil {
 		log.Fatalf("could not create fs handler: %v", err)
 	}
+	node.InlineMax = cfg.InlineMax
+	node.TxLease = cfg.TxLease
+	node.MaxWatches = cfg.MaxWatches
+	if cfg.Trash {
+		if node.Trash, err = fs.NewTrash(cfg.Root, cfg.TrashMaxAge, cfg.TrashMaxSize); err != nil {
+			log.Fatalf("could not create trash: %v", err)
+		}
+	}
+	if n, err := node.RecoverTxs(); err != nil {
+		log.Fatalf("could not recover transactions: %v", err)
+	} else if n > 0 {
+		log.Printf("recovered %v transactions", n)
+	}
+	fh := handler.NewFileHandler("/fs/", node)
 	mux.Handle("/fs/", fh)
 
+	vh := server.NewVolHandler(node)
+	mux.Handle("/volumes/", vh)
+
+	bh := handler.NewBlobHandler("/blob/", node)
+	mux.Handle("/blob/", bh)
+
+	ah := handler.NewArchiveHandler("/archive/", node)
+	mux.Handle("/archive/", ah)
+
 	// make files available for browsing
-	mux.Handle("/root/", http.StripPrefix("/root/", http.FileServer(http.Dir(cfg.Root))))
+	mux.Handle("/root/", http.StripPrefix("/root/", http.FileServer(rootDir{http.Dir(cfg.Root)})))
 	mux.Handle("/", http.RedirectHandler(cfg.Url.JoinPath("/root/").String(), http.StatusSeeOther))
 
 	ver := server.Version
@@ -103,6 +168,22 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		port, _ := cmd.Flags().GetInt("port")
 		root, _ := cmd.Flags().GetString("root")
+		templates, _ := cmd.Flags().GetString("templates")
+		volumes, _ := cmd.Flags().GetStringToString("volume")
+
+		minNice, _ := cmd.Flags().GetInt("min-nice")
+		minOOMScoreAdj, _ := cmd.Flags().GetInt("min-oom-score-adj")
+		realtimeIO, _ := cmd.Flags().GetBool("realtime-io")
+		cpus, _ := cmd.Flags().GetIntSlice("cpus")
+
+		handleLease, _ := cmd.Flags().GetInt64("handle-lease")
+		inlineMax, _ := cmd.Flags().GetInt64("inline-max")
+		txLease, _ := cmd.Flags().GetInt64("tx-lease")
+		maxWatches, _ := cmd.Flags().GetInt("max-watches")
+
+		trash, _ := cmd.Flags().GetBool("trash")
+		trashMaxAge, _ := cmd.Flags().GetInt64("trash-max-age")
+		trashMaxSize, _ := cmd.Flags().GetInt64("trash-max-size")
 
 		s, _ := cmd.Flags().GetString("url")
 		url, err := url.Parse(s)
@@ -114,6 +195,25 @@ to quickly create a Cobra application.`,
 			Port: port,
 			Root: root,
 			Url:  url,
+
+			Volumes:   volumes,
+			Templates: templates,
+
+			HandleLease: time.Duration(handleLease) * time.Second,
+			InlineMax:   inlineMax,
+			TxLease:     time.Duration(txLease) * time.Second,
+			MaxWatches:  maxWatches,
+
+			Trash:        trash,
+			TrashMaxAge:  time.Duration(trashMaxAge) * time.Second,
+			TrashMaxSize: trashMaxSize,
+
+			Sched: server.SchedLimits{
+				MinNice:        minNice,
+				MinOOMScoreAdj: minOOMScoreAdj,
+				RealtimeIO:     realtimeIO,
+				CPUs:           cpus,
+			},
 		})
 	},
 }
@@ -139,5 +239,22 @@ func init() {
 	serveCmd.Flags().IntP("port", "p", 58080, "Specifies the port on which the server listens for connections")
 	serveCmd.Flags().String("root", home, "Specifies the base directory for resolving file path")
 
+	serveCmd.Flags().StringToString("volume", nil, "Specifies named exports as name=dir for resolving vol:name/ paths")
+	serveCmd.Flags().String("templates", "", "Specifies the directory of named command templates")
+
+	serveCmd.Flags().Int("min-nice", 0, "Specifies the lowest nice value procs may request")
+	serveCmd.Flags().Int("min-oom-score-adj", 0, "Specifies the lowest oom score adjustment procs may request")
+	serveCmd.Flags().Bool("realtime-io", false, "Allows procs to request the realtime io class")
+	serveCmd.Flags().IntSlice("cpus", nil, "Specifies the cpus procs may request in the affinity, any if not set")
+
+	serveCmd.Flags().Int64("handle-lease", 300, "Specifies the seconds open files are kept for an inactive client")
+	serveCmd.Flags().Int64("inline-max", fs.DefaultInlineMax, "Specifies the max bytes read or written inline, 0 to always use blobs")
+	serveCmd.Flags().Int64("tx-lease", int64(fs.DefaultTxLease/time.Second), "Specifies the seconds an open transaction is kept without staging")
+	serveCmd.Flags().Int("max-watches", fs.DefaultMaxWatches, "Specifies the max directories watched for a change stream, clients fall back to short cache timeouts beyond")
+
+	serveCmd.Flags().Bool("trash", false, "Keeps deleted files in a trash under the root for restore")
+	serveCmd.Flags().Int64("trash-max-age", 7*24*3600, "Specifies the seconds deleted files are kept in the trash, 0 for no limit")
+	serveCmd.Flags().Int64("trash-max-size", 0, "Specifies the max bytes of deleted files kept in the trash, 0 for no limit")
+
 	serveCmd.Flags().String("url", "http://localhost:58080/", "Specifies the service url for file upload/download")
 }
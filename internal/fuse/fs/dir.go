@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// webDirStream reads the directory page by page as the kernel asks for
+// entries.
+type webDirStream struct {
+	n    *WebNode
+	path string
+
+	entries []api.DirEntryPlus
+	cookie  int64
+	eof     bool
+	errno   syscall.Errno
+}
+
+var _ = (fs.DirStream)((*webDirStream)(nil))
+
+func (d *webDirStream) HasNext() bool {
+	for len(d.entries) == 0 && !d.eof && d.errno == 0 {
+		var page api.DirPage
+		if err := d.n.c.ReaddirPlus(d.path, d.cookie, dirPageSize, &page); err != nil {
+			d.errno = fs.ToErrno(err)
+			break
+		}
+		d.entries = page.Entries
+		d.cookie = page.Cookie
+		d.eof = page.EOF
+
+		d.n.cacheStats(page.Entries)
+	}
+	return len(d.entries) > 0 || d.errno != 0
+}
+
+func (d *webDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if d.errno != 0 {
+		errno := d.errno
+		d.errno = 0
+		d.eof = true
+		return fuse.DirEntry{}, errno
+	}
+
+	e := d.entries[0]
+	d.entries = d.entries[1:]
+	return fuse.DirEntry{
+		Mode: uint32(e.Stat.Mode),
+		Name: e.Name,
+		Ino:  d.n.RootData.idFromStat(&e.Stat).Ino,
+	}, fs.OK
+}
+
+func (d *webDirStream) Close() {
+}
@@ -13,20 +13,24 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// newWebFile creates a FileHandle out of a file descriptor.
-func newWebFile(fd string, c *cli.Client) fs.FileHandle {
+// newWebFile creates a FileHandle out of an open file handle on the server.
+func newWebFile(fh string, path string, c *cli.Client) fs.FileHandle {
 	return &webFile{
-		fd: fd,
-		c:  c,
+		fh:   fh,
+		path: path,
+		c:    c,
 	}
 }
 
 type webFile struct {
 	mu sync.Mutex
 
-	// file path
-	fd string
-	c  *cli.Client
+	// open file handle on the server
+	fh string
+
+	// file path at the time of open
+	path string
+	c    *cli.Client
 }
 
 var _ = (fs.FileHandle)((*webFile)(nil))
@@ -49,14 +53,8 @@ func (f *webFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.Rea
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	var bi api.BlobInfo
-	if err := f.c.Read(f.fd, off, int64(len(buf)), &bi); err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	sz := bi.Size
-	data := make([]byte, sz)
-	n, err := f.c.Download(bi.Href, data)
+	data := make([]byte, len(buf))
+	n, err := f.c.ReadAt(f.fh, data, off)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -70,58 +68,91 @@ func (f *webFile) Write(ctx context.Context, data []byte, off int64) (uint32, sy
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	var bi api.BlobInfo
-	if err := f.c.Write(f.fd, off, int64(len(data)), &bi); err != nil {
-		return 0, fs.ToErrno(err)
-	}
-	n, err := f.c.Upload(bi.Href, data)
+	n, err := f.c.WriteAt(f.fh, data, off)
 	return uint32(n), fs.ToErrno(err)
 }
 
 func (f *webFile) Release(ctx context.Context) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	if f.fd != "" {
-		f.fd = ""
-		return fs.OK
+	if f.fh != "" {
+		err := f.c.Release(f.fh)
+		f.fh = ""
+		return fs.ToErrno(err)
 	}
 	return syscall.EBADF
 }
 
 func (f *webFile) Flush(ctx context.Context) syscall.Errno {
-	// TODO
-	log.Println("TODO Flush")
+	// nothing is buffered on the client
 	return fs.OK
 }
 
 func (f *webFile) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
-	// TODO
-	log.Println("TODO Fsync")
-	return fs.OK
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.c.Fsync(f.fh)
+	return fs.ToErrno(err)
 }
 
 func (f *webFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (errno syscall.Errno) {
-	// return syscall.ENOTSUP
-	log.Println("TODO Getlk")
+	f.mu.Lock()
+	fh := f.fh
+	f.mu.Unlock()
+
+	var c api.Lock
+	if err := f.c.Getlk(fh, toLock(owner, lk, flags), &c); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.Start = c.Start
+	out.End = c.End
+	out.Typ = c.Type
+	out.Pid = c.Pid
 	return fs.OK
 }
 
 func (f *webFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
-	// return syscall.ENOTSUP
-	log.Println("TODO Setlk")
-	return fs.OK
+	f.mu.Lock()
+	fh := f.fh
+	f.mu.Unlock()
+
+	err := f.c.Setlk(fh, toLock(owner, lk, flags))
+	return fs.ToErrno(err)
 }
 
+// Setlkw waits without holding the file so other calls on it proceed. The
+// wait is interrupted if the request is.
 func (f *webFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
-	// return syscall.ENOTSUP
-	log.Println("TODO Setlkw")
-	return fs.OK
+	f.mu.Lock()
+	fh := f.fh
+	f.mu.Unlock()
+
+	err := f.c.Setlkw(ctx, fh, toLock(owner, lk, flags))
+	if ctx.Err() != nil {
+		return syscall.EINTR
+	}
+	return fs.ToErrno(err)
+}
+
+func toLock(owner uint64, lk *fuse.FileLock, flags uint32) *api.Lock {
+	return &api.Lock{
+		Owner: owner,
+		Start: lk.Start,
+		End:   lk.End,
+		Type:  lk.Typ,
+		Pid:   lk.Pid,
+		Flock: flags&fuse.FUSE_LK_FLOCK != 0,
+	}
 }
 
 func (f *webFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	st := syscall.Stat_t{}
 	attr := ToAttr(in)
-	err := f.c.Setattr(f.fd, attr, &st)
+	err := f.c.Fsetattr(f.fh, attr, &st)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
@@ -134,7 +165,7 @@ func (f *webFile) fchmod(mode uint32) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	err := f.c.Chmod(f.fd, mode)
+	err := f.c.Fsetattr(f.fh, &api.Attr{Mode: &mode}, nil)
 	return fs.ToErrno(err)
 }
 
@@ -142,7 +173,7 @@ func (f *webFile) fchown(uid, gid int) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	err := f.c.Chown(f.fd, uid, gid)
+	err := f.c.Fsetattr(f.fh, &api.Attr{Owner: &api.Owner{Uid: uid, Gid: gid}}, nil)
 	return fs.ToErrno(err)
 }
 
@@ -150,7 +181,7 @@ func (f *webFile) ftruncate(sz uint64) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	err := f.c.Truncate(f.fd, int64(sz))
+	err := f.c.Ftruncate(f.fh, int64(sz))
 	return fs.ToErrno(err)
 }
 
@@ -159,7 +190,7 @@ func (f *webFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
 	defer f.mu.Unlock()
 
 	st := syscall.Stat_t{}
-	err := f.c.Stat(f.fd, &st)
+	err := f.c.Fstat(f.fh, &st)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
@@ -169,15 +200,18 @@ func (f *webFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
 }
 
 func (f *webFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
-	// f.mu.Lock()
-	// defer f.mu.Unlock()
-	// n, err := unix.Seek(f.fd, int64(off), int(whence))
-	// return uint64(n), ToErrno(err)
-	log.Println("TODO Lseek")
-	return 0, fs.OK
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int64
+	err := f.c.Lseek(f.fh, int64(off), int(whence), &n)
+	return uint64(n), fs.ToErrno(err)
 }
 
 func (f *webFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
-	log.Println("TODO Allocate")
-	return fs.OK
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.c.Fallocate(f.fh, int64(off), int64(size), int(mode))
+	return fs.ToErrno(err)
 }
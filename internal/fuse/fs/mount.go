@@ -1,6 +1,11 @@
 package fs
 
 import (
+	"log"
+	"math"
+	"sync/atomic"
+	"syscall"
+
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -9,5 +14,77 @@ type Options = fs.Options
 type MountOptions = fuse.MountOptions
 
 func Mount(dir string, root fs.InodeEmbedder, options *Options) (*fuse.Server, error) {
-	return fs.Mount(dir, root, options)
+	rawFS := &lockFS{RawFileSystem: &entryFS{fs.NewNodeFS(root, options)}}
+	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// entryFS replies to the lookup of a missing entry with a negative entry if
+// the node set an entry timeout, which the kernel caches for that long. The
+// entry is dropped along with the error status otherwise.
+type entryFS struct {
+	fuse.RawFileSystem
+}
+
+func (r *entryFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	status := r.RawFileSystem.Lookup(cancel, header, name, out)
+	if status == fuse.ENOENT && out.EntryTimeout() > 0 {
+		out.NodeId = 0
+		return fuse.OK
+	}
+	return status
+}
+
+// lockFS releases the POSIX locks of the lock owner on flush as close(2)
+// does. The kernel leaves it to the file system holding the locks.
+type lockFS struct {
+	fuse.RawFileSystem
+
+	// whether any POSIX lock has been set, flushes cost no unlock before
+	posix atomic.Bool
+}
+
+func (r *lockFS) SetLk(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	r.setLk(in)
+	return r.RawFileSystem.SetLk(cancel, in)
+}
+
+func (r *lockFS) SetLkw(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	r.setLk(in)
+	return r.RawFileSystem.SetLkw(cancel, in)
+}
+
+func (r *lockFS) setLk(in *fuse.LkIn) {
+	if in.Lk.Typ != syscall.F_UNLCK && in.LkFlags&fuse.FUSE_LK_FLOCK == 0 {
+		r.posix.Store(true)
+	}
+}
+
+func (r *lockFS) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status {
+	status := r.RawFileSystem.Flush(cancel, in)
+	if !r.posix.Load() {
+		return status
+	}
+
+	unlock := &fuse.LkIn{
+		InHeader: in.InHeader,
+		Fh:       in.Fh,
+		Owner:    in.LockOwner,
+		Lk: fuse.FileLock{
+			End: math.MaxUint64,
+			Typ: syscall.F_UNLCK,
+		},
+	}
+	if st := r.RawFileSystem.SetLk(cancel, unlock); !st.Ok() {
+		log.Printf("flush unlock %v: %v", in.LockOwner, st)
+	}
+	return status
 }
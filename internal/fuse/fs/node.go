@@ -5,7 +5,10 @@ import (
 	"log"
 	"net/url"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/dhnt/nomad/api"
 	"github.com/dhnt/nomad/api/cli"
@@ -14,6 +17,14 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+const keepaliveInterval = time.Second * 30
+
+// how long stats of readdirplus are used for lookups
+const statCacheTimeout = time.Second
+
+// count of entries fetched per readdirplus page
+const dirPageSize = 512
+
 // WebRoot holds the parameters for creating a new web
 // filesystem. Web filesystem delegate their operations to an
 // underlying POSIX file system on remote machine.
@@ -25,8 +36,20 @@ type WebRoot struct {
 	// the underlying filesystem crosses file systems.
 	Dev uint64
 
+	// How long entries and attributes are cached while the changes on
+	// the server are watched, see Watch.
+	CacheTimeout time.Duration
+
 	c *cli.Client
 
+	// whether the watch stream is established
+	watching atomic.Bool
+
+	// root node of the mount
+	root *fs.Inode
+
+	done chan struct{}
+
 	// NewNode returns a new InodeEmbedder to be used to respond
 	// to a LOOKUP/CREATE/MKDIR/MKNOD opcode. If not set, use a
 	// WebNode.
@@ -75,6 +98,11 @@ type WebNode struct {
 	RootData *WebRoot
 
 	c *cli.Client
+
+	// stats of the last readdirplus page for the lookups following it
+	mu      sync.Mutex
+	stats   map[string]*syscall.Stat_t
+	statsAt time.Time
 }
 
 var _ = (fs.NodeStatfser)((*WebNode)(nil))
@@ -93,6 +121,11 @@ var _ = (fs.NodeOpendirer)((*WebNode)(nil))
 var _ = (fs.NodeReaddirer)((*WebNode)(nil))
 var _ = (fs.NodeGetattrer)((*WebNode)(nil))
 var _ = (fs.NodeSetattrer)((*WebNode)(nil))
+var _ = (fs.NodeCopyFileRanger)((*WebNode)(nil))
+var _ = (fs.NodeGetxattrer)((*WebNode)(nil))
+var _ = (fs.NodeSetxattrer)((*WebNode)(nil))
+var _ = (fs.NodeListxattrer)((*WebNode)(nil))
+var _ = (fs.NodeRemovexattrer)((*WebNode)(nil))
 
 func (n *WebNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 	s := syscall.Statfs_t{}
@@ -115,19 +148,52 @@ func (n *WebNode) path() string {
 func (n *WebNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
 	log.Printf("lookup %v", name)
 
-	p := filepath.Join(n.path(), name)
-	st := syscall.Stat_t{}
-	err := n.c.Lstat(p, &st)
-	if err != nil {
-		return nil, fs.ToErrno(err)
+	st := n.cachedStat(name)
+	if st == nil {
+		p := filepath.Join(n.path(), name)
+		st = &syscall.Stat_t{}
+		err := n.c.Lstat(p, st)
+		if err != nil {
+			if t := n.RootData.cacheTimeout(); t > 0 && fs.ToErrno(err) == syscall.ENOENT {
+				out.SetEntryTimeout(t)
+			}
+			return nil, fs.ToErrno(err)
+		}
 	}
 
-	out.Attr.FromStat(&st)
-	node := n.RootData.newNode(n.EmbeddedInode(), name, &st)
-	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+	out.Attr.FromStat(st)
+	n.RootData.setEntryTimeout(out)
+	node := n.RootData.newNode(n.EmbeddedInode(), name, st)
+	ch := n.NewInode(ctx, node, n.RootData.idFromStat(st))
 	return ch, 0
 }
 
+// cacheStats keeps the stats of a readdirplus page, replacing the previous.
+func (n *WebNode) cacheStats(entries []api.DirEntryPlus) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats = make(map[string]*syscall.Stat_t, len(entries))
+	for i := range entries {
+		n.stats[entries[i].Name] = &entries[i].Stat
+	}
+	n.statsAt = time.Now()
+}
+
+// cachedStat returns the stat of the entry from the last readdirplus page
+// once if not expired.
+func (n *WebNode) cachedStat(name string) *syscall.Stat_t {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.stats[name]
+	if !ok || time.Since(n.statsAt) > statCacheTimeout {
+		return nil
+	}
+	delete(n.stats, name)
+	return st
+}
+
 func (n *WebNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
 	log.Printf("mknod %v", name)
 
@@ -139,6 +205,7 @@ func (n *WebNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out
 	}
 
 	out.Attr.FromStat(&st)
+	n.RootData.setEntryTimeout(out)
 	node := n.RootData.newNode(n.EmbeddedInode(), name, &st)
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
 
@@ -155,6 +222,7 @@ func (n *WebNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse
 	}
 
 	out.Attr.FromStat(&st)
+	n.RootData.setEntryTimeout(out)
 	node := n.RootData.newNode(n.EmbeddedInode(), name, &st)
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
 
@@ -184,17 +252,19 @@ func (n *WebNode) Rename(ctx context.Context, name string, newParent fs.InodeEmb
 func (n *WebNode) Create(ctx context.Context, name string, mode uint32, perm uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	log.Printf("create %v", name)
 	p := filepath.Join(n.path(), name)
-	st := syscall.Stat_t{}
-	err := n.c.Create(p, mode, perm, &st)
+	var h api.FileHandle
+	err := n.c.Create(p, mode, perm, &h)
 	if err != nil {
 		return nil, nil, 0, fs.ToErrno(err)
 	}
+	st := h.Stat
 
-	node := n.RootData.newNode(n.EmbeddedInode(), name, &st)
-	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
-	lf := newWebFile(p, n.c)
+	node := n.RootData.newNode(n.EmbeddedInode(), name, st)
+	ch := n.NewInode(ctx, node, n.RootData.idFromStat(st))
+	lf := newWebFile(h.ID, p, n.c)
 
-	out.FromStat(&st)
+	out.FromStat(st)
+	n.RootData.setEntryTimeout(out)
 	return ch, lf, 0, 0
 }
 
@@ -211,6 +281,7 @@ func (n *WebNode) Symlink(ctx context.Context, target, name string, out *fuse.En
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
 
 	out.Attr.FromStat(&st)
+	n.RootData.setEntryTimeout(out)
 	return ch, 0
 }
 
@@ -227,6 +298,7 @@ func (n *WebNode) Link(ctx context.Context, target fs.InodeEmbedder, name string
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
 
 	out.Attr.FromStat(&st)
+	n.RootData.setEntryTimeout(out)
 	return ch, 0
 }
 
@@ -243,11 +315,12 @@ func (n *WebNode) Open(ctx context.Context, mode uint32) (fh fs.FileHandle, fuse
 	log.Println("open")
 
 	p := n.path()
-	err := n.c.Open(p, mode, 0, nil)
+	var h api.FileHandle
+	err := n.c.Open(p, mode, 0, &h)
 	if err != nil {
 		return nil, 0, fs.ToErrno(err)
 	}
-	lf := newWebFile(p, n.c)
+	lf := newWebFile(h.ID, p, n.c)
 	return lf, 0, 0
 }
 
@@ -259,26 +332,25 @@ func (n *WebNode) Opendir(ctx context.Context) syscall.Errno {
 	return fs.OK
 }
 
+// Readdir streams the entries in pages with their stat, so the lookups of
+// readdirplus do not cost a round trip per entry.
 func (n *WebNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	var result []api.DirEntry
-	err := n.c.Readdir(n.path(), &result)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
+	return &webDirStream{
+		n:    n,
+		path: n.path(),
+	}, fs.OK
+}
 
-	entries := make([]fuse.DirEntry, len(result))
-	for i, v := range result {
-		entries[i] = fuse.DirEntry{
-			Mode: uint32(v.Info.Mode),
-			Name: v.Name,
-			// TODO Ino:,
+func (n *WebNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// the open file may have been unlinked or renamed
+	if f != nil {
+		errno := f.(fs.FileGetattrer).Getattr(ctx, out)
+		if errno == 0 {
+			n.RootData.setAttrTimeout(out)
 		}
+		return errno
 	}
 
-	return fs.NewListDirStream(entries), fs.OK
-}
-
-func (n *WebNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	p := n.path()
 
 	var err error
@@ -293,10 +365,19 @@ func (n *WebNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOu
 		return fs.ToErrno(err)
 	}
 	out.FromStat(&st)
+	n.RootData.setAttrTimeout(out)
 	return fs.OK
 }
 
 func (n *WebNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if f != nil {
+		errno := f.(fs.FileSetattrer).Setattr(ctx, in, out)
+		if errno == 0 {
+			n.RootData.setAttrTimeout(out)
+		}
+		return errno
+	}
+
 	p := n.path()
 
 	st := syscall.Stat_t{}
@@ -307,7 +388,7 @@ func (n *WebNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttr
 	}
 
 	out.FromStat(&st)
-
+	n.RootData.setAttrTimeout(out)
 	return fs.OK
 }
 
@@ -333,9 +414,36 @@ func NewWebRoot(baseUrl string) (fs.InodeEmbedder, error) {
 		Path: rootPath,
 		Dev:  uint64(st.Dev),
 		c:    c,
+		done: make(chan struct{}),
 	}
+	go root.keepalive()
 
-	return root.newNode(nil, "", &st), nil
+	n := root.newNode(nil, "", &st)
+	root.root = n.EmbeddedInode()
+	return n, nil
+}
+
+// keepalive renews the lease of the open files on the server until Close.
+func (r *WebRoot) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.c.Keepalive(); err != nil {
+				log.Printf("keepalive: %v", err)
+			}
+		}
+	}
+}
+
+// Close releases all open files of the mount on the server.
+func (r *WebRoot) Close() error {
+	close(r.done)
+	return r.c.Disconnect()
 }
 
 func ToAttr(in *fuse.SetAttrIn) *api.Attr {
@@ -376,3 +484,60 @@ func ToAttr(in *fuse.SetAttrIn) *api.Attr {
 
 	return &attr
 }
+
+func (n *WebNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	var value []byte
+	if err := n.c.Getxattr(n.path(), attr, &value); err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	// the size is queried with an empty dest
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), fs.OK
+}
+
+func (n *WebNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	err := n.c.Setxattr(n.path(), attr, data, int(flags))
+	return fs.ToErrno(err)
+}
+
+func (n *WebNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []string
+	if err := n.c.Listxattr(n.path(), &names); err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	var b []byte
+	for _, v := range names {
+		b = append(b, v...)
+		b = append(b, 0)
+	}
+	if len(dest) < len(b) {
+		return uint32(len(b)), syscall.ERANGE
+	}
+	return uint32(copy(dest, b)), fs.OK
+}
+
+func (n *WebNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	err := n.c.Removexattr(n.path(), attr)
+	return fs.ToErrno(err)
+}
+
+// CopyFileRange copies on the server, the data is not transferred.
+func (n *WebNode) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64, len uint64, flags uint64) (uint32, syscall.Errno) {
+	in, ok := fhIn.(*webFile)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	o, ok := fhOut.(*webFile)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+
+	var written int64
+	err := n.c.CopyFileRange(in.fh, int64(offIn), o.fh, int64(offOut), int64(len), &written)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	return uint32(written), fs.OK
+}
@@ -0,0 +1,177 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	watchRetryInterval = time.Second * 5
+	// max interval between retries while the stream keeps failing, each
+	// retry walks the whole tree on the server
+	watchRetryMax = time.Minute * 5
+)
+
+// Watch subscribes to the changes on the server and invalidates the kernel
+// cache of the affected nodes until Close. It must be called once mounted.
+// Entries and attributes are cached for CacheTimeout only while the stream
+// is established. All nodes are invalidated once it ends as events may be
+// lost. The retries back off while the stream fails, and stop for the mount
+// defaults as with no watch if the server does not watch that many
+// directories.
+func (r *WebRoot) Watch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-r.done
+		cancel()
+	}()
+
+	retry := watchRetryInterval
+	for {
+		start := time.Now()
+		err := r.c.Watch(ctx, r.Path, true, func() {
+			r.watching.Store(true)
+		}, r.notify)
+		if r.watching.Swap(false) {
+			r.invalidate(r.root)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			log.Printf("watch: too many directories, falling back to short cache timeouts: %v", err)
+			return
+		}
+		log.Printf("watch: %v", err)
+
+		if time.Since(start) > watchRetryMax {
+			retry = watchRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > watchRetryMax {
+			retry = watchRetryMax
+		}
+	}
+}
+
+// cacheTimeout returns how long entries and attributes are cached, 0 for the
+// mount defaults if the changes are not watched.
+func (r *WebRoot) cacheTimeout() time.Duration {
+	if !r.watching.Load() {
+		return 0
+	}
+	return r.CacheTimeout
+}
+
+func (r *WebRoot) setEntryTimeout(out *fuse.EntryOut) {
+	if t := r.cacheTimeout(); t > 0 {
+		out.SetEntryTimeout(t)
+		out.SetAttrTimeout(t)
+	}
+}
+
+func (r *WebRoot) setAttrTimeout(out *fuse.AttrOut) {
+	if t := r.cacheTimeout(); t > 0 {
+		out.SetTimeout(t)
+	}
+}
+
+func (r *WebRoot) notify(e *api.Event) {
+	log.Printf("event %v %v %v", e.Op, e.Path, e.To)
+
+	switch e.Op {
+	case api.EventCreate:
+		if parent, name := r.parent(e.Path); parent != nil {
+			parent.NotifyEntry(name)
+			parent.NotifyContent(-1, 0)
+		}
+	case api.EventDelete:
+		if parent, name := r.parent(e.Path); parent != nil {
+			if ch := parent.GetChild(name); ch != nil {
+				parent.NotifyDelete(name, ch)
+				parent.RmChild(name)
+			} else {
+				parent.NotifyEntry(name)
+			}
+			parent.NotifyContent(-1, 0)
+		}
+	case api.EventModify:
+		if n := r.lookup(e.Path); n != nil {
+			n.NotifyContent(0, 0)
+		}
+	case api.EventAttrib:
+		if n := r.lookup(e.Path); n != nil {
+			// attributes only
+			n.NotifyContent(-1, 0)
+		}
+	case api.EventRename:
+		from, oldName := r.parent(e.Path)
+		to, newName := r.parent(e.To)
+		if from != nil {
+			from.NotifyEntry(oldName)
+			from.NotifyContent(-1, 0)
+		}
+		if to != nil {
+			to.NotifyEntry(newName)
+			to.NotifyContent(-1, 0)
+		}
+		// keep the paths of the nodes in sync
+		if from != nil && from.GetChild(oldName) != nil {
+			if to != nil {
+				from.MvChild(oldName, to, newName, true)
+			} else {
+				from.RmChild(oldName)
+			}
+		}
+	case api.EventOverflow:
+		r.invalidate(r.root)
+	}
+}
+
+// lookup returns the known node of the path on the server or nil.
+func (r *WebRoot) lookup(p string) *fs.Inode {
+	rel, err := filepath.Rel(r.Path, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil
+	}
+	n := r.root
+	if rel == "." {
+		return n
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if n = n.GetChild(name); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// parent returns the known node of the parent of the path and the name.
+func (r *WebRoot) parent(p string) (*fs.Inode, string) {
+	dir, name := filepath.Split(p)
+	return r.lookup(filepath.Clean(dir)), name
+}
+
+// invalidate drops the cached data, attributes and entries of the node and
+// its known children.
+func (r *WebRoot) invalidate(n *fs.Inode) {
+	n.NotifyContent(0, 0)
+	for name, ch := range n.Children() {
+		n.NotifyEntry(name)
+		r.invalidate(ch)
+	}
+}
@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nfs "github.com/dhnt/nomad/api/fs"
+	"github.com/dhnt/nomad/api/handler"
+)
+
+func TestWatch(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("no /dev/fuse")
+	}
+
+	dir := t.TempDir()
+	p := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for _, name := range []string{"f", "a"} {
+		if err := os.WriteFile(p(name), []byte("v1"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/")
+	node, err := nfs.NewFileNode(dir, u, nfs.NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	mux.Handle("/fs/", handler.NewFileHandler("/fs/", node))
+
+	root, err := NewWebRoot(u.String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	r := root.(*WebNode).RootData
+	defer r.Close()
+	// long enough that only the invalidation refreshes the cache
+	r.CacheTimeout = time.Hour
+	if r.cacheTimeout() != 0 {
+		t.Fatalf("cached before watching")
+	}
+
+	mnt := t.TempDir()
+	timeout := time.Hour
+	server, err := Mount(mnt, root, &Options{
+		AttrTimeout:  &timeout,
+		EntryTimeout: &timeout,
+		MountOptions: MountOptions{DirectMountStrict: true, Name: "nomad"},
+	})
+	if err != nil {
+		t.Skipf("mount: %v", err)
+	}
+	defer server.Unmount()
+
+	go r.Watch()
+	waitFor(t, "watching", func() bool {
+		return r.cacheTimeout() == time.Hour
+	})
+	m := func(name string) string {
+		return filepath.Join(mnt, name)
+	}
+
+	// cached while watching, then invalidated by the events
+	size := func(name string) int64 {
+		fi, err := os.Lstat(m(name))
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+	if size("f") != 2 || size("a") != 2 || size("g") != -1 {
+		t.Fatalf("lookup: %v %v %v", size("f"), size("a"), size("g"))
+	}
+
+	if err := os.WriteFile(p("g"), []byte("g"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitFor(t, "create", func() bool {
+		return size("g") == 1
+	})
+
+	if err := os.WriteFile(p("f"), []byte("v2 longer"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitFor(t, "modify", func() bool {
+		return size("f") == 9
+	})
+	if b, err := os.ReadFile(m("f")); err != nil || string(b) != "v2 longer" {
+		t.Fatalf("read: %q %v", b, err)
+	}
+
+	if err := os.Chmod(p("a"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitFor(t, "attrib", func() bool {
+		fi, err := os.Lstat(m("a"))
+		return err == nil && fi.Mode().Perm() == 0600
+	})
+
+	if err := os.Rename(p("g"), p("h")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitFor(t, "rename", func() bool {
+		return size("g") == -1 && size("h") == 1
+	})
+
+	if err := os.Remove(p("f")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	waitFor(t, "delete", func() bool {
+		return size("f") == -1
+	})
+
+	// nothing is cached once the stream ends
+	srv.CloseClientConnections()
+	waitFor(t, "stream end", func() bool {
+		return r.cacheTimeout() == 0
+	})
+}
+
+func TestWatchLimit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/")
+	node, err := nfs.NewFileNode(dir, u, nfs.NewHandleTable(0))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	node.MaxWatches = 1
+	mux.Handle("/fs/", handler.NewFileHandler("/fs/", node))
+
+	root, err := NewWebRoot(u.String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	r := root.(*WebNode).RootData
+	defer r.Close()
+	r.CacheTimeout = time.Hour
+
+	// gives up without retrying, nothing is cached as with no watch
+	done := make(chan struct{})
+	go func() {
+		r.Watch()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(watchRetryInterval / 2):
+		t.Fatalf("still watching")
+	}
+	if r.cacheTimeout() != 0 {
+		t.Fatalf("cached without watching")
+	}
+}
+
+// waitFor fails the test if cond does not hold within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: timed out", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/url"
+	"time"
 )
 
 type ServerConfig struct {
@@ -9,4 +10,41 @@ type ServerConfig struct {
 
 	Root string
 	Url  *url.URL
+
+	// named exports for resolving vol:name/ paths
+	Volumes map[string]string
+
+	// directory of proc templates
+	Templates string
+
+	// lease of open files of inactive clients
+	HandleLease time.Duration
+
+	// max size of data read or written inline in fs calls
+	InlineMax int64
+
+	// lease of open transactions not staged to
+	TxLease time.Duration
+
+	// max directories watched by a change stream
+	MaxWatches int
+
+	// keep deleted files in the trash until the max age or total size
+	Trash        bool
+	TrashMaxAge  time.Duration
+	TrashMaxSize int64
+
+	Sched SchedLimits
+}
+
+// SchedLimits bounds the scheduling controls requested by procs.
+type SchedLimits struct {
+	// lowest nice value allowed, lower values raise the priority
+	MinNice int
+	// lowest oom score adjustment allowed
+	MinOOMScoreAdj int
+	// whether the realtime io class is allowed
+	RealtimeIO bool
+	// cpus allowed in the affinity, any if empty
+	CPUs []int
 }
@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -12,7 +14,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dhnt/nomad/api"
@@ -23,11 +27,18 @@ import (
 const defaultTimeout = time.Second * 30
 const durationInSecond = 1000000000
 
+// grace period between the terminate signal and kill on lease expiry
+const leaseGrace = time.Second * 5
+
 var (
 	listProcRe   = regexp.MustCompile(`^\/procs[\/]?$`)
 	getProcRe    = regexp.MustCompile(`^\/procs\/([-0-9a-fA-F]+)$`)
 	deleteProcRe = regexp.MustCompile(`^\/procs\/([-0-9a-fA-F]+)$`)
 	createProcRe = regexp.MustCompile(`^\/procs[\/]?$`)
+	renewProcRe  = regexp.MustCompile(`^\/procs\/([-0-9a-fA-F]+)\/heartbeat$`)
+
+	listTemplateRe = regexp.MustCompile(`^\/procs\/templates[\/]?$`)
+	execTemplateRe = regexp.MustCompile(`^\/procs\/templates\/([-\w.]+)$`)
 )
 
 type datastore struct {
@@ -49,18 +60,52 @@ func (r *datastore) Remove(id string) {
 	r.Unlock()
 }
 
+// Get returns a copy of the proc of id.
 func (r *datastore) Get(id string) *api.Proc {
 	r.RLock()
 	defer r.RUnlock()
 
 	p, ok := r.m[id]
 	if ok {
-		p.Elapsed = (int64)(time.Since(p.Created)) / durationInSecond
-		return p
+		c := *p
+		c.Elapsed = (int64)(time.Since(c.Created)) / durationInSecond
+		return &c
 	}
 	return nil
 }
 
+// Update applies fn to p, changes to procs in the store are made under its
+// lock.
+func (r *datastore) Update(p *api.Proc, fn func(p *api.Proc)) {
+	r.Lock()
+	defer r.Unlock()
+
+	fn(p)
+}
+
+// Renew extends the lease of the proc of id. It returns false if not found.
+func (r *datastore) Renew(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	p, ok := r.m[id]
+	if ok {
+		p.Renewed = time.Now()
+	}
+	return ok
+}
+
+// Expired reports whether the lease of p has not been renewed in time.
+func (r *datastore) Expired(p *api.Proc) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	if p.Lease <= 0 {
+		return false
+	}
+	return time.Since(p.Renewed) > time.Duration(p.Lease*durationInSecond)
+}
+
 func (r *datastore) List() []*api.Proc {
 	r.RLock()
 	defer r.RUnlock()
@@ -69,8 +114,9 @@ func (r *datastore) List() []*api.Proc {
 
 	procs := make([]*api.Proc, 0, len(r.m))
 	for _, p := range r.m {
-		p.Elapsed = (int64)(now.Sub(p.Created)) / durationInSecond
-		procs = append(procs, p)
+		c := *p
+		c.Elapsed = (int64)(now.Sub(c.Created)) / durationInSecond
+		procs = append(procs, &c)
 	}
 	return procs
 }
@@ -80,22 +126,51 @@ type ProcHandler struct {
 	baseUrl *url.URL
 
 	store *datastore
+
+	// named exports
+	volumes map[string]string
+
+	sched SchedLimits
+
+	templates map[string]*api.Template
 }
 
 func NewProcHandler(cfg *ServerConfig) *ProcHandler {
 	return &ProcHandler{
 		root:    cfg.Root,
 		baseUrl: cfg.Url,
+		volumes: cfg.Volumes,
+		sched:   cfg.Sched,
 		store: &datastore{
 			m:       map[string]*api.Proc{},
 			RWMutex: &sync.RWMutex{},
 		},
+		templates: map[string]*api.Template{},
+	}
+}
+
+// LoadTemplates registers the proc templates found in dir.
+func (h *ProcHandler) LoadTemplates(dir string) error {
+	templates, err := loadTemplates(dir)
+	if err != nil {
+		return err
+	}
+	for name := range templates {
+		log.Printf("template: %v", name)
 	}
+	h.templates = templates
+	return nil
 }
 
 func (h *ProcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	switch {
+	case r.Method == http.MethodGet && listTemplateRe.MatchString(r.URL.Path):
+		h.ListTemplates(w, r)
+		return
+	case r.Method == http.MethodPost && execTemplateRe.MatchString(r.URL.Path):
+		h.ExecTemplate(w, r)
+		return
 	case r.Method == http.MethodGet && listProcRe.MatchString(r.URL.Path):
 		h.List(w, r)
 		return
@@ -108,14 +183,64 @@ func (h *ProcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case r.Method == http.MethodDelete && deleteProcRe.MatchString(r.URL.Path):
 		h.Remove(w, r)
 		return
+	case r.Method == http.MethodPost && renewProcRe.MatchString(r.URL.Path):
+		h.Renew(w, r)
+		return
 	default:
 		notFound(w, r, r.URL.Path)
 		return
 	}
 }
 
-func (h *ProcHandler) resolvePath(name string) string {
-	return filepath.Join(h.root, name)
+// resolver returns the resolver for the paths of p.
+func (h *ProcHandler) resolver(p *api.Proc) *resolver {
+	return &resolver{
+		root: h.root,
+		tmp:  p.Workspace,
+		vols: h.volumes,
+	}
+}
+
+// createRedirect creates the stdout/stderr redirect file of p including any
+// missing parent dirs.
+func (h *ProcHandler) createRedirect(p *api.Proc, name string) (*os.File, error) {
+	path, err := h.resolver(p).path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// workspaceDir is the parent of the temp workspaces of procs.
+func workspaceDir() string {
+	return filepath.Join(os.TempDir(), "nomad")
+}
+
+// workspace returns the temp workspace of the proc of id, removed after the
+// proc. It is named by the id if a uuid in canonical form, by the hash of
+// the id otherwise as any id is accepted.
+func workspace(id string) string {
+	name := id
+	if u, err := uuid.Parse(id); err != nil || u.String() != id {
+		sum := sha256.Sum256([]byte(id))
+		name = hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(workspaceDir(), name)
+}
+
+// remove removes the proc of id and its workspace.
+func (h *ProcHandler) remove(id string) {
+	p := h.store.Get(id)
+	if p == nil {
+		return
+	}
+	h.store.Remove(id)
+	if p.Workspace != "" && filepath.Dir(p.Workspace) == workspaceDir() {
+		os.RemoveAll(p.Workspace)
+	}
 }
 
 func (h *ProcHandler) List(w http.ResponseWriter, r *http.Request) {
@@ -160,6 +285,66 @@ func (h *ProcHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.start(w, r, &p, h.add)
+}
+
+// ListTemplates replies with the names, descriptions and params of the
+// templates. The procs are not listed as their env may hold secrets.
+func (h *ProcHandler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates := make([]*api.TemplateInfo, 0, len(h.templates))
+	for _, t := range h.templates {
+		templates = append(templates, &api.TemplateInfo{
+			Name:        t.Name,
+			Description: t.Description,
+			Params:      t.Params,
+		})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+
+	jsonResponse(w, r, templates)
+}
+
+func (h *ProcHandler) ExecTemplate(w http.ResponseWriter, r *http.Request) {
+	matches := execTemplateRe.FindStringSubmatch(r.URL.Path)
+	if len(matches) < 2 {
+		notFound(w, r, r.URL.Path)
+		return
+	}
+
+	t, ok := h.templates[matches[1]]
+	if !ok {
+		notFound(w, r, fmt.Sprintf("template %s", matches[1]))
+		return
+	}
+
+	var req api.TemplateReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	p, err := expandTemplate(t, req.Params)
+	if err != nil {
+		badRequest(w, r, err)
+		return
+	}
+	p.Background = req.Background
+	p.Lease = req.Lease
+
+	h.start(w, r, p, h.add)
+}
+
+// add stores p to be run.
+func (h *ProcHandler) add(p *api.Proc) bool {
+	h.store.Add(p)
+	return true
+}
+
+// start resolves and runs p, in the background if requested. add stores p,
+// it returns false if p may no longer be started.
+func (h *ProcHandler) start(w http.ResponseWriter, r *http.Request, p *api.Proc, add func(p *api.Proc) bool) {
 	// add proc id if not provided
 	if p.ID == "" {
 		id, err := uuid.NewRandom()
@@ -172,26 +357,59 @@ func (h *ProcHandler) Create(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("create: %v", p)
 
-	args, err := resolveArgs(h.root, p.Resolve, p.Args)
+	if err := checkSched(p, &h.sched); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	p.Workspace = workspace(p.ID)
+
+	rs := h.resolver(p)
+	args, err := resolveArgs(rs, p.Resolve, p.Args)
 	if err != nil {
-		internalServerError(w, r, err)
+		badRequest(w, r, err)
 		return
 	}
 	p.Args = args
 
-	h.store.Add(&p)
+	if p.Dir != "" {
+		if p.Dir, err = rs.path(p.Dir); err != nil {
+			badRequest(w, r, err)
+			return
+		}
+	}
+	if p.Env, err = resolveEnv(rs, p.Resolve, p.Env); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+	p.Renewed = time.Now()
+
+	// cancelable once stored, also before the command is started
+	timeout := time.Duration(p.Timeout * durationInSecond)
+	if p.Timeout <= 0 {
+		timeout = defaultTimeout
+		p.Timeout = int64(defaultTimeout) / durationInSecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	p.Cancel = cancel
+
+	if !add(p) {
+		cancel()
+		notFound(w, r, fmt.Sprintf("session %s", p.Session))
+		return
+	}
 
 	if p.Background {
-		go h.Run(&p)
+		go h.Run(ctx, p)
 		u := h.baseUrl.JoinPath("procs", p.ID)
 		http.Redirect(w, r, u.String(), http.StatusSeeOther)
 		return
 	}
 
 	// remove after completion if running in sync/foreground
-	defer h.store.Remove(p.ID)
+	defer h.remove(p.ID)
 
-	res := h.Run(&p)
+	res := h.Run(ctx, p)
 	b, err := json.Marshal(res)
 	if err != nil {
 		internalServerError(w, r, err)
@@ -215,16 +433,76 @@ func (h *ProcHandler) Remove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if p.Cancel != nil {
+	p.Cancel()
+	h.remove(p.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// KillSession cancels and removes all procs of the session of id.
+func (h *ProcHandler) KillSession(id string) {
+	for _, p := range h.store.List() {
+		if p.Session != id {
+			continue
+		}
+		log.Printf("kill session proc: %v %v", id, p.ID)
 		p.Cancel()
+		h.remove(p.ID)
 	}
+}
 
-	h.store.Remove(p.ID)
+func (h *ProcHandler) Renew(w http.ResponseWriter, r *http.Request) {
+	matches := renewProcRe.FindStringSubmatch(r.URL.Path)
+	if len(matches) < 2 {
+		notFound(w, r, r.URL.Path)
+		return
+	}
+
+	if !h.store.Renew(matches[1]) {
+		notFound(w, r, fmt.Sprintf("proc %s", matches[1]))
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *ProcHandler) Run(p *api.Proc) *api.RunResult {
+// watchLease terminates the process of p once its lease expires.
+// It returns when ctx is done.
+func (h *ProcHandler) watchLease(ctx context.Context, p *api.Proc, proc *os.Process, cancel context.CancelFunc) {
+	interval := time.Duration(p.Lease*durationInSecond) / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !h.store.Expired(p) {
+				continue
+			}
+			log.Printf("lease expired: %v pid: %v", p.ID, proc.Pid)
+
+			proc.Signal(syscall.SIGTERM)
+			select {
+			case <-ctx.Done():
+			case <-time.After(leaseGrace):
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// Run runs p until done or ctx, created with p.Cancel, is done. The command
+// is not started if p has been canceled.
+func (h *ProcHandler) Run(ctx context.Context, p *api.Proc) *api.RunResult {
+	cancel := p.Cancel
+	defer cancel()
+
 	command := p.Command
 	args := p.Args
 
@@ -240,28 +518,35 @@ func (h *ProcHandler) Run(p *api.Proc) *api.RunResult {
 	}
 
 	// state transitions
-	stateRunning := func() {
-		p.State = api.Running
-		p.Status = 0
-		p.Error = ""
+	stateRunning := func(pid int) {
+		h.store.Update(p, func(p *api.Proc) {
+			p.Pid = pid
+			p.State = api.Running
+			p.Status = 0
+			p.Error = ""
+		})
 		res.Status = 0
 		res.Error = ""
 	}
 
 	stateDone := func() {
-		p.State = api.Done
-		p.Status = 0
-		p.Error = ""
+		h.store.Update(p, func(p *api.Proc) {
+			p.State = api.Done
+			p.Status = 0
+			p.Error = ""
+		})
 		res.Status = 0
 		res.Error = ""
 	}
 
-	stateFailed := func(err error) {
-		p.State = api.Failed
+	stateFailed := func(err error, status int) {
 		st := err.Error()
-		p.Status = 1
-		p.Error = st
-		res.Status = 1
+		h.store.Update(p, func(p *api.Proc) {
+			p.State = api.Failed
+			p.Status = status
+			p.Error = st
+		})
+		res.Status = status
 		res.Error = st
 	}
 
@@ -273,10 +558,10 @@ func (h *ProcHandler) Run(p *api.Proc) *api.RunResult {
 
 	redirectOut, redirectErr := p.Outfile != "", p.Errfile != ""
 	if redirectOut {
-		outfile, err = os.Create(h.resolvePath(p.Outfile))
+		outfile, err = h.createRedirect(p, p.Outfile)
 		if err != nil {
 			log.Printf("failed to create outfile: %q %v", command, err)
-			stateFailed(err)
+			stateFailed(err, 1)
 			return res
 		}
 		defer outfile.Close()
@@ -285,26 +570,16 @@ func (h *ProcHandler) Run(p *api.Proc) *api.RunResult {
 		if p.Errfile == p.Outfile {
 			errfile = outfile
 		} else {
-			errfile, err = os.Create(h.resolvePath(p.Errfile))
+			errfile, err = h.createRedirect(p, p.Errfile)
 			if err != nil {
 				log.Printf("failed to create errfile: %q %v", command, err)
-				stateFailed(err)
+				stateFailed(err, 1)
 				return res
 			}
 			defer errfile.Close()
 		}
 	}
 
-	timeout := func() time.Duration {
-		if p.Timeout <= 0 {
-			p.Timeout = int64(defaultTimeout) / durationInSecond
-			return defaultTimeout
-		}
-		return time.Duration(p.Timeout * durationInSecond)
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout())
-	defer cancel()
-
 	cmd := exec.CommandContext(ctx, command, args...)
 
 	if redirectOut {
@@ -327,17 +602,26 @@ func (h *ProcHandler) Run(p *api.Proc) *api.RunResult {
 		cmd.Env = append(os.Environ(), p.Env...)
 	}
 
+	// applied before the command is executed
+	if hasSched(p) {
+		if err := schedCommand(cmd, p); err != nil {
+			log.Printf("sched error: %q %v", command, err)
+			stateFailed(err, 1)
+			return res
+		}
+	}
+
 	if err := cmd.Start(); err != nil {
 		log.Printf("start error: %q %v", command, err)
-		stateFailed(err)
+		stateFailed(err, 1)
 		return res
 	}
 
-	//
-	p.Pid = cmd.Process.Pid
-	p.Cancel = cancel
+	stateRunning(cmd.Process.Pid)
 
-	stateRunning()
+	if p.Lease > 0 {
+		go h.watchLease(ctx, p, cmd.Process, cancel)
+	}
 
 	//
 	err = cmd.Wait()
@@ -346,16 +630,13 @@ func (h *ProcHandler) Run(p *api.Proc) *api.RunResult {
 	res.Stderr = stderr.String()
 
 	if err != nil {
-		stateFailed(err)
-
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			log.Printf("exit status: %q %v %d", command, err, exiterr.ExitCode())
-			// update status code
-			p.Status = exiterr.ExitCode()
-			res.Status = p.Status
+			stateFailed(err, exiterr.ExitCode())
 			return res
 		} else {
 			log.Printf("error: %q %v", command, err)
+			stateFailed(err, 1)
 			return res
 		}
 	}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestWorkspace(t *testing.T) {
+	tests := []struct {
+		id   string
+		name bool
+	}{
+		{"0181f31b-44ea-4b53-92a8-f1e041cdcde0", true},
+		{"0181F31B-44EA-4B53-92A8-F1E041CDCDE0", false},
+		{"{0181f31b-44ea-4b53-92a8-f1e041cdcde0}", false},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../../x", false},
+		{"abc", false},
+	}
+
+	seen := make(map[string]bool)
+	for _, tc := range tests {
+		dir := workspace(tc.id)
+		if filepath.Dir(dir) != workspaceDir() || seen[dir] {
+			t.Fatalf("%q: %v", tc.id, dir)
+		}
+		seen[dir] = true
+		if (filepath.Base(dir) == tc.id) != tc.name {
+			t.Fatalf("%q: %v", tc.id, dir)
+		}
+	}
+}
+
+func TestProcDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := NewProcHandler(&ServerConfig{Root: root})
+
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{"/", root},
+		{"sub", filepath.Join(root, "sub")},
+		{"/sub", filepath.Join(root, "sub")},
+		{"../sub", filepath.Join(root, "sub")},
+		{"file:/sub", filepath.Join(root, "sub")},
+	}
+	for _, tc := range tests {
+		b, _ := json.Marshal(&api.Proc{Command: "pwd", Dir: tc.dir})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/procs", bytes.NewReader(b)))
+		var res api.RunResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%q: %v %s", tc.dir, err, w.Body)
+		}
+		if res.Stdout != tc.want+"\n" {
+			t.Fatalf("%q: %+v", tc.dir, res)
+		}
+	}
+
+	// any client id, the workspace is named by its hash
+	b, _ := json.Marshal(&api.Proc{ID: "../my proc", Command: "sh", Args: []string{"-c", "pwd; echo tmp:x"}, Dir: "tmp:", Resolve: []string{}})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/procs", bytes.NewReader(b)))
+	var res api.RunResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("id: %v %s", err, w.Body)
+	}
+	if res.Status != 0 || res.Stdout != workspace("../my proc")+"\ntmp:x\n" {
+		t.Fatalf("id: %+v", res)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+
+	"github.com/google/uuid"
+)
+
+const defaultSessionTimeout = time.Hour
+const sessionReapInterval = time.Second * 10
+
+var (
+	listSessionRe   = regexp.MustCompile(`^\/sessions[\/]?$`)
+	createSessionRe = regexp.MustCompile(`^\/sessions[\/]?$`)
+	getSessionRe    = regexp.MustCompile(`^\/sessions\/([-0-9a-fA-F]+)$`)
+	deleteSessionRe = regexp.MustCompile(`^\/sessions\/([-0-9a-fA-F]+)$`)
+	execSessionRe   = regexp.MustCompile(`^\/sessions\/([-0-9a-fA-F]+)\/procs[\/]?$`)
+
+	// ids provided by clients must be found by the routes above
+	sessionIDRe = regexp.MustCompile(`^[-0-9a-fA-F]+$`)
+)
+
+type sessionstore struct {
+	m map[string]*api.Session
+
+	*sync.RWMutex
+}
+
+func (r *sessionstore) Add(s *api.Session) {
+	r.Lock()
+	s.Created = time.Now()
+	s.Accessed = s.Created
+	r.m[s.ID] = s
+	r.Unlock()
+}
+
+func (r *sessionstore) Remove(id string) {
+	r.Lock()
+	delete(r.m, id)
+	r.Unlock()
+}
+
+// Get returns a copy of the session of id and marks it as accessed.
+func (r *sessionstore) Get(id string) *api.Session {
+	r.Lock()
+	defer r.Unlock()
+
+	s, ok := r.m[id]
+	if ok {
+		s.Accessed = time.Now()
+		c := *s
+		return &c
+	}
+	return nil
+}
+
+// Update applies fn to the session of id. It returns false if not found.
+func (r *sessionstore) Update(id string, fn func(s *api.Session)) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	s, ok := r.m[id]
+	if ok {
+		fn(s)
+		s.Accessed = time.Now()
+	}
+	return ok
+}
+
+func (r *sessionstore) List() []api.Session {
+	r.RLock()
+	defer r.RUnlock()
+
+	sessions := make([]api.Session, 0, len(r.m))
+	for _, s := range r.m {
+		sessions = append(sessions, *s)
+	}
+	return sessions
+}
+
+// Expired returns the ids of sessions idle longer than their timeout.
+func (r *sessionstore) Expired() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	now := time.Now()
+
+	var ids []string
+	for id, s := range r.m {
+		if now.Sub(s.Accessed) > time.Duration(s.Timeout*durationInSecond) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SessionHandler keeps the cwd and env on the server so they are shared by
+// all clients of a session. Procs started in a session are killed when the
+// session is closed or expires.
+type SessionHandler struct {
+	root string
+
+	procs *ProcHandler
+	store *sessionstore
+}
+
+func NewSessionHandler(cfg *ServerConfig, ph *ProcHandler) *SessionHandler {
+	h := &SessionHandler{
+		root:  cfg.Root,
+		procs: ph,
+		store: &sessionstore{
+			m:       map[string]*api.Session{},
+			RWMutex: &sync.RWMutex{},
+		},
+	}
+	go h.reap()
+	return h
+}
+
+func (h *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && listSessionRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodGet && getSessionRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodPost && createSessionRe.MatchString(r.URL.Path):
+		h.Create(w, r)
+		return
+	case r.Method == http.MethodPost && execSessionRe.MatchString(r.URL.Path):
+		h.Exec(w, r)
+		return
+	case r.Method == http.MethodDelete && deleteSessionRe.MatchString(r.URL.Path):
+		h.Remove(w, r)
+		return
+	default:
+		notFound(w, r, r.URL.Path)
+		return
+	}
+}
+
+func (h *SessionHandler) resolvePath(name string) string {
+	return filepath.Join(h.root, name)
+}
+
+func (h *SessionHandler) reap() {
+	ticker := time.NewTicker(sessionReapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, id := range h.store.Expired() {
+			log.Printf("session expired: %v", id)
+			h.close(id)
+		}
+	}
+}
+
+// close removes the session, then kills its procs. Procs are added to the
+// proc store under the session store lock while the session exists, so none
+// is started after.
+func (h *SessionHandler) close(id string) {
+	h.store.Remove(id)
+	h.procs.KillSession(id)
+}
+
+func (h *SessionHandler) List(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, r, h.store.List())
+}
+
+func (h *SessionHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := getSessionRe.FindStringSubmatch(r.URL.Path)
+	if len(matches) < 2 {
+		notFound(w, r, r.URL.Path)
+		return
+	}
+
+	s := h.store.Get(matches[1])
+	if s == nil {
+		notFound(w, r, fmt.Sprintf("session %s", matches[1]))
+		return
+	}
+	jsonResponse(w, r, s)
+}
+
+func (h *SessionHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var s api.Session
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil && err != io.EOF {
+		internalServerError(w, r, err)
+		return
+	}
+
+	// add session id if not provided
+	if s.ID == "" {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		s.ID = id.String()
+	}
+	if !sessionIDRe.MatchString(s.ID) {
+		badRequest(w, r, fmt.Errorf("invalid session id: %q", s.ID))
+		return
+	}
+	s.Cwd = filepath.Join("/", s.Cwd)
+	if s.Timeout <= 0 {
+		s.Timeout = int64(defaultSessionTimeout) / durationInSecond
+	}
+
+	if err := h.checkDir(s.Cwd); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	log.Printf("create session: %v", s)
+
+	h.store.Add(&s)
+
+	jsonResponse(w, r, s)
+}
+
+func (h *SessionHandler) Remove(w http.ResponseWriter, r *http.Request) {
+	matches := deleteSessionRe.FindStringSubmatch(r.URL.Path)
+	if len(matches) < 2 {
+		notFound(w, r, r.URL.Path)
+		return
+	}
+
+	if h.store.Get(matches[1]) == nil {
+		notFound(w, r, fmt.Sprintf("session %s", matches[1]))
+		return
+	}
+
+	h.close(matches[1])
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Exec runs the proc in the session. The builtins cd/chdir and export
+// update the session instead of starting a process.
+func (h *SessionHandler) Exec(w http.ResponseWriter, r *http.Request) {
+	matches := execSessionRe.FindStringSubmatch(r.URL.Path)
+	if len(matches) < 2 {
+		notFound(w, r, r.URL.Path)
+		return
+	}
+	id := matches[1]
+
+	var p api.Proc
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	s := h.store.Get(id)
+	if s == nil {
+		notFound(w, r, fmt.Sprintf("session %s", id))
+		return
+	}
+
+	switch p.Command {
+	case "cd", "chdir":
+		h.chdir(w, r, s, &p)
+		return
+	case "export":
+		h.export(w, r, s, &p)
+		return
+	}
+
+	p.Session = id
+	if p.Dir == "" {
+		p.Dir = s.Cwd
+	}
+	p.Env = mergeEnv(s.Env, p.Env)
+
+	// stored only while the session is, so that closing it kills the proc
+	add := func(p *api.Proc) bool {
+		return h.store.Update(id, func(*api.Session) {
+			h.procs.store.Add(p)
+		})
+	}
+	h.procs.start(w, r, &p, add)
+}
+
+func (h *SessionHandler) checkDir(dir string) error {
+	fi, err := os.Stat(h.resolvePath(dir))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory: %v", dir)
+	}
+	return nil
+}
+
+func (h *SessionHandler) chdir(w http.ResponseWriter, r *http.Request, s *api.Session, p *api.Proc) {
+	res := &api.RunResult{
+		ID:      s.ID,
+		Command: p.Command,
+		Args:    p.Args,
+	}
+
+	dir := "/"
+	if len(p.Args) > 0 {
+		dir = p.Args[0]
+	}
+	if !strings.HasPrefix(dir, "/") {
+		dir = filepath.Join(s.Cwd, dir)
+	}
+	// never go above the root
+	dir = filepath.Join("/", dir)
+
+	if err := h.checkDir(dir); err != nil {
+		res.Status = 1
+		res.Error = err.Error()
+		jsonResponse(w, r, res)
+		return
+	}
+
+	h.store.Update(s.ID, func(s *api.Session) {
+		s.Cwd = dir
+	})
+	res.Stdout = dir
+	jsonResponse(w, r, res)
+}
+
+func (h *SessionHandler) export(w http.ResponseWriter, r *http.Request, s *api.Session, p *api.Proc) {
+	res := &api.RunResult{
+		ID:      s.ID,
+		Command: p.Command,
+		Args:    p.Args,
+	}
+
+	for _, v := range p.Args {
+		if !strings.Contains(v, "=") {
+			res.Status = 1
+			res.Error = fmt.Sprintf("invalid variable: %q", v)
+			jsonResponse(w, r, res)
+			return
+		}
+	}
+
+	h.store.Update(s.ID, func(s *api.Session) {
+		s.Env = mergeEnv(s.Env, p.Args)
+		res.Stdout = strings.Join(s.Env, "\n")
+	})
+	jsonResponse(w, r, res)
+}
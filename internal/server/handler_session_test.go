@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestKillSession(t *testing.T) {
+	u, _ := url.Parse("http://localhost:58080/")
+	cfg := &ServerConfig{Root: t.TempDir(), Url: u}
+	ph := NewProcHandler(cfg)
+	sh := NewSessionHandler(cfg, ph)
+
+	serve := func(h http.Handler, method string, path string, v interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(v)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return w
+	}
+
+	// only ids found by the routes
+	for _, id := range []string{"my session", "../x", "g0"} {
+		if w := serve(sh, http.MethodPost, "/sessions", &api.Session{ID: id}); w.Code != http.StatusBadRequest {
+			t.Fatalf("%q: %v", id, w.Code)
+		}
+	}
+	id := "0181f31b"
+	if w := serve(sh, http.MethodPost, "/sessions", &api.Session{ID: id}); w.Code != http.StatusOK {
+		t.Fatalf("create: %v %s", w.Code, w.Body)
+	}
+
+	for i := 0; i < 3; i++ {
+		w := serve(sh, http.MethodPost, "/sessions/"+id+"/procs", &api.Proc{Command: "sleep", Args: []string{"10"}, Background: true})
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("exec: %v %s", w.Code, w.Body)
+		}
+	}
+	// listed while starting and killed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			serve(ph, http.MethodGet, "/procs", nil)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if w := serve(sh, http.MethodDelete, "/sessions/"+id, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %v", w.Code)
+	}
+	<-done
+
+	if procs := ph.store.List(); len(procs) != 0 {
+		t.Fatalf("procs: %+v", procs)
+	}
+	if w := serve(sh, http.MethodGet, "/sessions/"+id, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("get: %v", w.Code)
+	}
+	if w := serve(sh, http.MethodPost, "/sessions/"+id+"/procs", &api.Proc{Command: "true"}); w.Code != http.StatusNotFound {
+		t.Fatalf("exec closed: %v", w.Code)
+	}
+
+	// killed once stored, before it is started
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &api.Proc{ID: "p", Session: "s", Command: "sleep", Args: []string{"10"}, Cancel: cancel}
+	ph.store.Add(p)
+	ph.KillSession("s")
+	if res := ph.Run(ctx, p); res.Status == 0 || res.Error != context.Canceled.Error() {
+		t.Fatalf("run killed: %+v", res)
+	}
+}
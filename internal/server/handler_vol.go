@@ -1,12 +1,12 @@
 package server
 
 import (
-	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
-	"strconv"
+
+	"github.com/dhnt/nomad/api/fs"
+	"github.com/dhnt/nomad/api/handler"
 )
 
 var (
@@ -14,19 +14,19 @@ var (
 )
 
 type VolHandler struct {
-	root string
+	node *fs.FileNode
 }
 
-func NewVolHandler(root string) *VolHandler {
+func NewVolHandler(node *fs.FileNode) *VolHandler {
 	return &VolHandler{
-		root: root,
+		node: node,
 	}
 }
 
 func (h *VolHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	switch {
-	case r.Method == http.MethodGet && volumeRe.MatchString(r.URL.Path):
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && volumeRe.MatchString(r.URL.Path):
 		h.Download(w, r)
 		return
 	default:
@@ -35,36 +35,19 @@ func (h *VolHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *VolHandler) resolvePath(name string) string {
-	return filepath.Join(h.root, name)
-}
-
 func (h *VolHandler) Download(w http.ResponseWriter, r *http.Request) {
 	matches := volumeRe.FindStringSubmatch(r.URL.Path)
 	if len(matches) < 2 {
 		notFound(w, r, r.URL.Path)
 		return
 	}
-	pathname := h.resolvePath(matches[1])
-	f, err := os.Open(pathname)
-	defer f.Close()
-
+	pathname := matches[1]
+	f, done, err := h.node.File(pathname, "", os.O_RDONLY)
 	if err != nil {
 		http.Error(w, "File not found.", 404)
 		return
 	}
+	defer done()
 
-	buf := make([]byte, 512)
-	f.Read(buf)
-	contentType := http.DetectContentType(buf)
-
-	s, _ := f.Stat()
-	size := strconv.FormatInt(s.Size(), 10)
-
-	//
-	w.Header().Set("Content-Type", contentType+";"+filepath.Base(pathname))
-	w.Header().Set("Content-Length", size)
-
-	f.Seek(0, 0)
-	io.Copy(w, f)
+	handler.ServeContent(w, r, pathname, f, 0, -1)
 }
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/dhnt/nomad/api"
+)
+
+const (
+	maxNice        = 19
+	maxOOMScoreAdj = 1000
+	maxIOPriority  = 7
+)
+
+// checkSched validates the scheduling controls of p against the limits.
+func checkSched(p *api.Proc, limits *SchedLimits) error {
+	if p.Nice != nil {
+		if *p.Nice < limits.MinNice || *p.Nice > maxNice {
+			return fmt.Errorf("nice out of range [%v, %v]: %v", limits.MinNice, maxNice, *p.Nice)
+		}
+	}
+
+	switch p.IOClass {
+	case "", api.IOClassBestEffort, api.IOClassIdle:
+	case api.IOClassRealtime:
+		if !limits.RealtimeIO {
+			return fmt.Errorf("io class not allowed: %q", p.IOClass)
+		}
+	default:
+		return fmt.Errorf("unknown io class: %q", p.IOClass)
+	}
+	if p.IOPriority < 0 || p.IOPriority > maxIOPriority {
+		return fmt.Errorf("io priority out of range [0, %v]: %v", maxIOPriority, p.IOPriority)
+	}
+
+	for _, c := range p.CPUs {
+		if c < 0 {
+			return fmt.Errorf("invalid cpu: %v", c)
+		}
+		if len(limits.CPUs) == 0 {
+			continue
+		}
+		allowed := false
+		for _, v := range limits.CPUs {
+			if v == c {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("cpu not allowed: %v", c)
+		}
+	}
+
+	if p.OOMScoreAdj != nil {
+		if *p.OOMScoreAdj < limits.MinOOMScoreAdj || *p.OOMScoreAdj > maxOOMScoreAdj {
+			return fmt.Errorf("oom score adj out of range [%v, %v]: %v", limits.MinOOMScoreAdj, maxOOMScoreAdj, *p.OOMScoreAdj)
+		}
+	}
+	return nil
+}
+
+// hasSched reports whether p requests any scheduling control.
+func hasSched(p *api.Proc) bool {
+	return p.Nice != nil || p.IOClass != "" || len(p.CPUs) > 0 || p.OOMScoreAdj != nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/dhnt/nomad/api"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioClasses = map[string]int{
+	api.IOClassRealtime:   1,
+	api.IOClassBestEffort: 2,
+	api.IOClassIdle:       3,
+}
+
+// the scheduling controls for the server executed in place of a command,
+// applied before it executes the command
+const schedEnv = "NOMAD_SCHED"
+
+func init() {
+	if v, ok := os.LookupEnv(schedEnv); ok {
+		schedExec(v)
+	}
+}
+
+// schedCommand makes cmd run the server executable which applies the
+// scheduling controls of p to itself and then executes the command, so they
+// are in effect before the command runs and inherited by its children.
+func schedCommand(cmd *exec.Cmd, p *api.Proc) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&api.Proc{
+		Nice:        p.Nice,
+		IOClass:     p.IOClass,
+		IOPriority:  p.IOPriority,
+		CPUs:        p.CPUs,
+		OOMScoreAdj: p.OOMScoreAdj,
+	})
+	if err != nil {
+		return err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, schedEnv+"="+string(b))
+	cmd.Args = append([]string{cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	return nil
+}
+
+// schedExec applies the scheduling controls and executes the command of the
+// arguments, exiting with 127 if either fails.
+func schedExec(v string) {
+	os.Unsetenv(schedEnv)
+	var p api.Proc
+	err := json.Unmarshal([]byte(v), &p)
+	if err == nil && len(os.Args) == 0 {
+		err = syscall.EINVAL
+	}
+	if err == nil {
+		err = applySched(os.Getpid(), &p)
+	}
+	if err == nil {
+		err = syscall.Exec(os.Args[0], os.Args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "sched: %v\n", err)
+	os.Exit(127)
+}
+
+// applySched applies the scheduling controls of p to the process of pid.
+func applySched(pid int, p *api.Proc) error {
+	if p.Nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, *p.Nice); err != nil {
+			return fmt.Errorf("nice: %v", err)
+		}
+	}
+
+	if p.IOClass != "" {
+		prio := ioClasses[p.IOClass]<<ioprioClassShift | p.IOPriority
+		_, _, errno := syscall.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio))
+		if errno != 0 {
+			return fmt.Errorf("ioprio: %v", errno)
+		}
+	}
+
+	if len(p.CPUs) > 0 {
+		var set unix.CPUSet
+		for _, c := range p.CPUs {
+			set.Set(c)
+		}
+		if err := unix.SchedSetaffinity(pid, &set); err != nil {
+			return fmt.Errorf("affinity: %v", err)
+		}
+	}
+
+	if p.OOMScoreAdj != nil {
+		name := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+		if err := os.WriteFile(name, []byte(strconv.Itoa(*p.OOMScoreAdj)), 0644); err != nil {
+			return fmt.Errorf("oom score adj: %v", err)
+		}
+	}
+	return nil
+}
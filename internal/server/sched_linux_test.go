@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestSchedCommand(t *testing.T) {
+	nice := 5
+	h := NewProcHandler(&ServerConfig{Root: t.TempDir()})
+
+	// in effect for the children of the command too
+	ctx, cancel := context.WithCancel(context.Background())
+	res := h.Run(ctx, &api.Proc{
+		Command: "sh",
+		Args:    []string{"-c", "nice; grep Cpus_allowed_list /proc/self/status"},
+		Nice:    &nice,
+		CPUs:    []int{0},
+		Cancel:  cancel,
+	})
+	if want := "5\nCpus_allowed_list:\t0\n"; res.Stdout != want {
+		t.Fatalf("%+v", res)
+	}
+}
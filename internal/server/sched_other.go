@@ -0,0 +1,18 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/dhnt/nomad/api"
+)
+
+// schedCommand is not supported on this platform.
+func schedCommand(cmd *exec.Cmd, p *api.Proc) error {
+	if hasSched(p) {
+		return errors.New("scheduling controls not supported")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestCheckSched(t *testing.T) {
+	n := func(v int) *int {
+		return &v
+	}
+	limits := &SchedLimits{
+		MinNice:        0,
+		MinOOMScoreAdj: -100,
+		CPUs:           []int{0, 1},
+	}
+
+	tests := []struct {
+		p    api.Proc
+		fail bool
+	}{
+		{api.Proc{}, false},
+		{api.Proc{Nice: n(10)}, false},
+		{api.Proc{Nice: n(-5)}, true},
+		{api.Proc{Nice: n(20)}, true},
+		{api.Proc{IOClass: api.IOClassIdle}, false},
+		{api.Proc{IOClass: api.IOClassBestEffort, IOPriority: 7}, false},
+		{api.Proc{IOClass: api.IOClassBestEffort, IOPriority: 8}, true},
+		{api.Proc{IOClass: api.IOClassRealtime}, true},
+		{api.Proc{IOClass: "fast"}, true},
+		{api.Proc{CPUs: []int{1}}, false},
+		{api.Proc{CPUs: []int{0, 2}}, true},
+		{api.Proc{OOMScoreAdj: n(-100)}, false},
+		{api.Proc{OOMScoreAdj: n(-101)}, true},
+		{api.Proc{OOMScoreAdj: n(1001)}, true},
+	}
+
+	for i, tc := range tests {
+		err := checkSched(&tc.p, limits)
+		if (err != nil) != tc.fail {
+			t.Fatalf("[%v] proc: %+v err: %v", i, tc.p, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dhnt/nomad/api"
+)
+
+var (
+	placeholderRe = regexp.MustCompile(`{{\s*([-\w]+)\s*}}`)
+
+	// names the templates are called by, see execTemplateRe
+	templateNameRe = regexp.MustCompile(`^[-\w.]+$`)
+)
+
+// loadTemplates reads all *.json files in dir as proc templates. The name of
+// a template defaults to the file name without extension.
+func loadTemplates(dir string) (map[string]*api.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*api.Template)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var t api.Template
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if t.Name == "" {
+			t.Name = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+		if !templateNameRe.MatchString(t.Name) || t.Name == "." || t.Name == ".." {
+			return nil, fmt.Errorf("%s: invalid template name: %q", f, t.Name)
+		}
+		if err := checkTemplate(&t); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if _, ok := templates[t.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate template: %q", f, t.Name)
+		}
+		templates[t.Name] = &t
+	}
+	return templates, nil
+}
+
+// templateFields returns pointers to all fields of p subject to expansion.
+func templateFields(p *api.Proc) []*string {
+	fields := []*string{&p.Command, &p.Dir, &p.Outfile, &p.Errfile}
+	for i := range p.Args {
+		fields = append(fields, &p.Args[i])
+	}
+	for i := range p.Env {
+		fields = append(fields, &p.Env[i])
+	}
+	return fields
+}
+
+// checkTemplate verifies the param patterns and that every placeholder refers
+// to a declared param.
+func checkTemplate(t *api.Template) error {
+	declared := make(map[string]bool)
+	for _, v := range t.Params {
+		if v.Name == "" {
+			return fmt.Errorf("missing param name")
+		}
+		if _, err := regexp.Compile(v.Pattern); err != nil {
+			return fmt.Errorf("param %q: %v", v.Name, err)
+		}
+		declared[v.Name] = true
+	}
+
+	p := t.Proc
+	for _, f := range templateFields(&p) {
+		for _, m := range placeholderRe.FindAllStringSubmatch(*f, -1) {
+			if !declared[m[1]] {
+				return fmt.Errorf("undeclared param: %q", m[1])
+			}
+		}
+	}
+	return nil
+}
+
+// expandTemplate validates the param values and returns a new proc with the
+// placeholders of t replaced.
+func expandTemplate(t *api.Template, params map[string]string) (*api.Proc, error) {
+	values := make(map[string]string)
+
+	known := make(map[string]bool)
+	for _, v := range t.Params {
+		known[v.Name] = true
+	}
+	var unknown []string
+	for k := range params {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown params: %v", unknown)
+	}
+
+	for _, v := range t.Params {
+		val, ok := params[v.Name]
+		if !ok {
+			if v.Default == nil {
+				if v.Required {
+					return nil, fmt.Errorf("missing param: %q", v.Name)
+				}
+			} else {
+				val = *v.Default
+			}
+		}
+		if v.Pattern != "" && (ok || v.Default != nil) {
+			re, err := regexp.Compile(`^(?:` + v.Pattern + `)$`)
+			if err != nil {
+				return nil, err
+			}
+			if !re.MatchString(val) {
+				return nil, fmt.Errorf("invalid param: %q value: %q pattern: %q", v.Name, val, v.Pattern)
+			}
+		}
+		values[v.Name] = val
+	}
+
+	p := t.Proc
+	p.ID = ""
+	p.Args = append([]string{}, t.Proc.Args...)
+	p.Env = append([]string{}, t.Proc.Env...)
+	p.Resolve = append([]string{}, t.Proc.Resolve...)
+
+	for _, f := range templateFields(&p) {
+		*f = placeholderRe.ReplaceAllStringFunc(*f, func(s string) string {
+			return values[placeholderRe.FindStringSubmatch(s)[1]]
+		})
+	}
+	return &p, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	def := "main"
+	tmpl := &api.Template{
+		Name: "build",
+		Params: []api.TemplateParam{
+			{Name: "pkg", Pattern: `[\w./]+`, Required: true},
+			{Name: "branch", Default: &def},
+			{Name: "tags"},
+		},
+		Proc: api.Proc{
+			Command: "go",
+			Args:    []string{"build", "-tags={{tags}}", "{{ pkg }}"},
+			Env:     []string{"BRANCH={{branch}}"},
+		},
+	}
+
+	tests := []struct {
+		params map[string]string
+		args   []string
+		env    []string
+		fail   bool
+	}{
+		{map[string]string{"pkg": "./..."}, []string{"build", "-tags=", "./..."}, []string{"BRANCH=main"}, false},
+		{map[string]string{"pkg": "./cmd", "branch": "dev", "tags": "x"}, []string{"build", "-tags=x", "./cmd"}, []string{"BRANCH=dev"}, false},
+		{map[string]string{}, nil, nil, true},
+		{map[string]string{"pkg": "./cmd; rm -rf /"}, nil, nil, true},
+		{map[string]string{"pkg": "./cmd", "other": "x"}, nil, nil, true},
+	}
+
+	for i, tc := range tests {
+		p, err := expandTemplate(tmpl, tc.params)
+		if tc.fail {
+			if err == nil {
+				t.Fatalf("[%v] params: %v, expected error", i, tc.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%v] err: %v", i, err)
+		}
+		if !reflect.DeepEqual(p.Args, tc.args) || !reflect.DeepEqual(p.Env, tc.env) {
+			t.Fatalf("[%v] params: %v, want: %v %v got: %v %v", i, tc.params, tc.args, tc.env, p.Args, p.Env)
+		}
+	}
+
+	// the template itself is never modified
+	if tmpl.Proc.Args[2] != "{{ pkg }}" {
+		t.Fatalf("template modified: %v", tmpl.Proc.Args)
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl *api.Template
+		fail bool
+	}{
+		{&api.Template{Proc: api.Proc{Command: "ls"}}, false},
+		{&api.Template{Proc: api.Proc{Command: "ls", Args: []string{"{{dir}}"}}}, true},
+		{&api.Template{Params: []api.TemplateParam{{Name: "dir"}}, Proc: api.Proc{Command: "ls", Dir: "{{dir}}"}}, false},
+		{&api.Template{Params: []api.TemplateParam{{Name: "dir", Pattern: "("}}, Proc: api.Proc{Command: "ls"}}, true},
+	}
+
+	for i, tc := range tests {
+		err := checkTemplate(tc.tmpl)
+		if (err != nil) != tc.fail {
+			t.Fatalf("[%v] template: %v err: %v", i, tc.tmpl, err)
+		}
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	tests := []struct {
+		file string
+		name string
+		fail bool
+	}{
+		{"ls.json", "", false},
+		{"ls.json", "ls-v1.2", false},
+		{"ls.json", "../ls", true},
+		{"ls.json", "ls all", true},
+		{"ls.json", "..", true},
+		{"ls all.json", "", true},
+	}
+
+	for i, tc := range tests {
+		dir := t.TempDir()
+		b, _ := json.Marshal(&api.Template{Name: tc.name, Proc: api.Proc{Command: "ls"}})
+		if err := os.WriteFile(filepath.Join(dir, tc.file), b, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, err := loadTemplates(dir)
+		if (err != nil) != tc.fail {
+			t.Fatalf("[%v] %q %q: %v", i, tc.file, tc.name, err)
+		}
+	}
+}
+
+func TestListTemplates(t *testing.T) {
+	dir := t.TempDir()
+	b, _ := json.Marshal(&api.Template{
+		Name:        "deploy",
+		Description: "deploys",
+		Params:      []api.TemplateParam{{Name: "env"}},
+		Proc:        api.Proc{Command: "deploy", Env: []string{"TOKEN=secret"}},
+	})
+	if err := os.WriteFile(filepath.Join(dir, "deploy.json"), b, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	h := NewProcHandler(&ServerConfig{Root: t.TempDir()})
+	if err := h.LoadTemplates(dir); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/procs/templates", nil))
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("env listed: %s", w.Body)
+	}
+	var list []api.TemplateInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(list) != 1 || list[0].Name != "deploy" || list[0].Description != "deploys" || len(list[0].Params) != 1 {
+		t.Fatalf("list: %+v", list)
+	}
+}
@@ -6,50 +6,213 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
-// resolveArgs prepends root to the arg if it is prefixed with file: scheme
-// or preceded by an arg specified in the options.
-func resolveArgs(root string, options []string, args []string) ([]string, error) {
-	var opt string
-	resolve := func(arg string) (string, error) {
-		if strings.HasPrefix(arg, "file:") {
-			u, err := url.Parse(arg)
-			if err != nil {
-				return "", err
-			}
-			return filepath.Join(root, u.Path), nil
+// resolver maps the paths of a proc under the directories of the server.
+type resolver struct {
+	root string
+
+	// proc workspace for the tmp: scheme, created on first use
+	tmp string
+
+	// named exports for the vol: scheme
+	vols map[string]string
+}
+
+// join joins p to base without escaping base.
+func join(base string, p string) string {
+	return filepath.Join(base, filepath.Join("/", p))
+}
+
+// hasScheme reports whether arg is prefixed with a supported scheme.
+func hasScheme(arg string) bool {
+	for _, v := range []string{"file:", "tmp:", "vol:"} {
+		if strings.HasPrefix(arg, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheme resolves arg prefixed with a supported scheme:
+//
+//	file:path     path under the root
+//	tmp:path      path under the proc workspace
+//	vol:name/path path under the named export
+//
+// arg is returned as is if there is no scheme.
+func (rs *resolver) scheme(arg string) (string, error) {
+	switch {
+	case strings.HasPrefix(arg, "file:"):
+		u, err := url.Parse(arg)
+		if err != nil {
+			return "", err
+		}
+		return join(rs.root, u.Path), nil
+	case strings.HasPrefix(arg, "tmp:"):
+		if rs.tmp == "" {
+			return "", fmt.Errorf("no workspace: %q", arg)
 		}
+		if err := os.MkdirAll(rs.tmp, 0700); err != nil {
+			return "", err
+		}
+		return join(rs.tmp, strings.TrimPrefix(arg, "tmp:")), nil
+	case strings.HasPrefix(arg, "vol:"):
+		p := strings.TrimPrefix(arg, "vol:")
+		name, rest, _ := strings.Cut(p, "/")
+		dir, ok := rs.vols[name]
+		if !ok {
+			return "", fmt.Errorf("unknown volume: %q", name)
+		}
+		return join(dir, rest), nil
+	}
+	return arg, nil
+}
+
+// path resolves arg by scheme or, if there is none, under the root.
+func (rs *resolver) path(arg string) (string, error) {
+	if hasScheme(arg) {
+		return rs.scheme(arg)
+	}
+	return join(rs.root, arg), nil
+}
+
+// resolveArgs resolves the arg if it is prefixed with a scheme or is the value
+// of an option specified in the options. Values are recognized in the forms
+// "-o value", "--option=value" and "-ovalue" for single letter options.
+// Args after "--" are operands, only resolved if prefixed with a scheme.
+func resolveArgs(rs *resolver, options []string, args []string) ([]string, error) {
+	isOption := func(s string) bool {
 		for _, v := range options {
-			if v == opt {
-				return filepath.Join(root, arg), nil
+			if v == s {
+				return true
 			}
 		}
+		return false
+	}
+
+	var opt string
+	resolve := func(arg string) (string, error) {
+		if hasScheme(arg) {
+			return rs.scheme(arg)
+		}
+		if opt != "" && isOption(opt) {
+			return join(rs.root, arg), nil
+		}
 		return arg, nil
 	}
 
 	resolved := []string{}
+	operands := false
 
 	for _, v := range args {
-		// including --
-		if strings.HasPrefix(v, "-") {
+		switch {
+		case operands:
+			arg, err := resolve(v)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, arg)
+		case v == "--":
+			// end of options
+			operands = true
+			opt = ""
+			resolved = append(resolved, v)
+		case strings.HasPrefix(v, "--") && strings.Contains(v, "="):
+			// --option=value
+			name, val, _ := strings.Cut(v, "=")
+			opt = name
+			arg, err := resolve(val)
+			if err != nil {
+				return nil, err
+			}
+			opt = ""
+			resolved = append(resolved, name+"="+arg)
+		case strings.HasPrefix(v, "-") && !strings.HasPrefix(v, "--") && len(v) > 2 && !isOption(v) && isOption(v[:2]):
+			// -ovalue
+			opt = v[:2]
+			arg, err := resolve(v[2:])
+			if err != nil {
+				return nil, err
+			}
+			opt = ""
+			resolved = append(resolved, v[:2]+arg)
+		case strings.HasPrefix(v, "-"):
 			opt = v
 			resolved = append(resolved, v)
+		default:
+			arg, err := resolve(v)
+			if err != nil {
+				return nil, err
+			}
+			opt = ""
+			resolved = append(resolved, arg)
+		}
+	}
+
+	return resolved, nil
+}
+
+// resolveEnv resolves the values of env prefixed with a scheme or whose
+// names are specified as $NAME in the options.
+func resolveEnv(rs *resolver, options []string, env []string) ([]string, error) {
+	if env == nil {
+		return nil, nil
+	}
+	resolved := make([]string, 0, len(env))
+	for _, v := range env {
+		name, val, ok := strings.Cut(v, "=")
+		if !ok {
+			resolved = append(resolved, v)
 			continue
 		}
-		arg, err := resolve(v)
+		arg := val
+		var err error
+		if hasScheme(val) {
+			arg, err = rs.scheme(val)
+		} else {
+			for _, o := range options {
+				if o == "$"+name {
+					arg = join(rs.root, val)
+					break
+				}
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
-		opt = ""
-		resolved = append(resolved, arg)
+		resolved = append(resolved, name+"="+arg)
 	}
-
 	return resolved, nil
 }
 
+// mergeEnv returns env with the key=value pairs in vars added or replaced.
+func mergeEnv(env []string, vars []string) []string {
+	merged := append([]string{}, env...)
+	for _, v := range vars {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			continue
+		}
+		key := v[:i+1]
+		found := false
+		for j, e := range merged {
+			if strings.HasPrefix(e, key) {
+				merged[j] = v
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
 func internalServerError(w http.ResponseWriter, r *http.Request, err error) {
 	s := fmt.Sprintf("internal server error: %v\n", err)
 	w.WriteHeader(http.StatusInternalServerError)
@@ -58,6 +221,14 @@ func internalServerError(w http.ResponseWriter, r *http.Request, err error) {
 	log.Println(s)
 }
 
+func badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	s := fmt.Sprintf("bad request: %v\n", err)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(s))
+
+	log.Println(s)
+}
+
 func notFound(w http.ResponseWriter, r *http.Request, v interface{}) {
 	s := fmt.Sprintf("not found: %v\n", v)
 	w.WriteHeader(http.StatusNotFound)
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -9,6 +11,12 @@ import (
 func TestResolveArgs(t *testing.T) {
 	const root = "/root"
 
+	rs := &resolver{
+		root: root,
+		tmp:  "",
+		vols: map[string]string{"data": "/mnt/data"},
+	}
+
 	tests := []struct {
 		args     string
 		options  []string
@@ -36,12 +44,33 @@ func TestResolveArgs(t *testing.T) {
 		{"-xf /tmp/tar.gz --zstd --strip 1 -C /opt/", []string{"-xf"}, "-xf /root/tmp/tar.gz --zstd --strip 1 -C /opt/"},
 		{"-xf /tmp/tar.gz --zstd --strip 1 -C /opt/", []string{"-xf", "-C"}, "-xf /root/tmp/tar.gz --zstd --strip 1 -C /root/opt"},
 		{"xf file:/tmp/tar.gz --zstd --strip 1 -C file:/opt/", nil, "xf /root/tmp/tar.gz --zstd --strip 1 -C /root/opt"},
+		{"file:/../../etc", nil, "/root/etc"},
+		{"-al ../../etc", []string{"-al"}, "-al /root/etc"},
+		{"--output=/tmp/x", nil, "--output=/tmp/x"},
+		{"--output=/tmp/x", []string{"--output"}, "--output=/root/tmp/x"},
+		{"--output=file:/tmp/x", nil, "--output=/root/tmp/x"},
+		{"--output= /tmp/x", []string{"--output"}, "--output=/root /tmp/x"},
+		{"--output=/tmp/x /bin", []string{"--output"}, "--output=/root/tmp/x /bin"},
+		{"-C/opt", nil, "-C/opt"},
+		{"-C/opt", []string{"-C"}, "-C/root/opt"},
+		{"-Cfile:/opt", nil, "-Cfile:/opt"},
+		{"-Cfile:/opt", []string{"-C"}, "-C/root/opt"},
+		{"-xf/tmp/tar.gz", []string{"-x"}, "-x/root/f/tmp/tar.gz"},
+		{"-xf /tmp/tar.gz", []string{"-xf", "-x"}, "-xf /root/tmp/tar.gz"},
+		{"-- -C/opt", []string{"-C"}, "-- -C/opt"},
+		{"-C /opt -- -C /opt", []string{"-C"}, "-C /root/opt -- -C /opt"},
+		{"-- -C file:/opt", []string{"-C"}, "-- -C /root/opt"},
+		{"-- --", []string{"--"}, "-- --"},
+		{"vol:data/in.csv", nil, "/mnt/data/in.csv"},
+		{"vol:data", nil, "/mnt/data"},
+		{"-i vol:data/../../in.csv", []string{"-i"}, "-i /mnt/data/in.csv"},
+		{"--input=vol:data/in.csv", nil, "--input=/mnt/data/in.csv"},
 	}
 
 	for i, tc := range tests {
 		args := strings.Split(tc.args, " ")
 		expected := strings.Split(tc.expected, " ")
-		resolved, err := resolveArgs(root, tc.options, args)
+		resolved, err := resolveArgs(rs, tc.options, args)
 		if err != nil {
 			t.Fatalf("[%v] err: %v", i, err)
 		}
@@ -50,3 +79,92 @@ func TestResolveArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveArgsError(t *testing.T) {
+	rs := &resolver{
+		root: "/root",
+	}
+
+	tests := []string{
+		"tmp:out.log",
+		"vol:data/in.csv",
+		"--input=vol:none/in.csv",
+	}
+
+	for i, tc := range tests {
+		if _, err := resolveArgs(rs, nil, strings.Split(tc, " ")); err == nil {
+			t.Fatalf("[%v] args: %v, expected error", i, tc)
+		}
+	}
+}
+
+func TestResolveTmp(t *testing.T) {
+	tmp := filepath.Join(t.TempDir(), "ws")
+	rs := &resolver{
+		root: "/root",
+		tmp:  tmp,
+	}
+
+	resolved, err := resolveArgs(rs, nil, []string{"-o", "tmp:out/log", "--dir=tmp:"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{"-o", tmp + "/out/log", "--dir=" + tmp}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Fatalf("want: %v got: %v", expected, resolved)
+	}
+	if fi, err := os.Stat(tmp); err != nil || !fi.IsDir() {
+		t.Fatalf("workspace not created: %v", err)
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	rs := &resolver{
+		root: "/root",
+		vols: map[string]string{"data": "/mnt/data"},
+	}
+
+	tests := []struct {
+		env      []string
+		options  []string
+		expected []string
+	}{
+		{nil, nil, nil},
+		{[]string{"A=1", "B"}, nil, []string{"A=1", "B"}},
+		{[]string{"GOPATH=file:/go"}, nil, []string{"GOPATH=/root/go"}},
+		{[]string{"GOPATH=/go"}, nil, []string{"GOPATH=/go"}},
+		{[]string{"GOPATH=/go", "HOME=/home"}, []string{"$GOPATH"}, []string{"GOPATH=/root/go", "HOME=/home"}},
+		{[]string{"DATA=vol:data/x"}, nil, []string{"DATA=/mnt/data/x"}},
+	}
+
+	for i, tc := range tests {
+		resolved, err := resolveEnv(rs, tc.options, tc.env)
+		if err != nil {
+			t.Fatalf("[%v] err: %v", i, err)
+		}
+		if !reflect.DeepEqual(resolved, tc.expected) {
+			t.Fatalf("[%v] env: %v, want: %v got: %v", i, tc.env, tc.expected, resolved)
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		env      []string
+		vars     []string
+		expected []string
+	}{
+		{nil, nil, []string{}},
+		{nil, []string{"A=1"}, []string{"A=1"}},
+		{[]string{"A=1"}, []string{"A=2"}, []string{"A=2"}},
+		{[]string{"A=1", "AB=1"}, []string{"AB=2", "B="}, []string{"A=1", "AB=2", "B="}},
+		{[]string{"A=1"}, []string{"A"}, []string{"A=1"}},
+	}
+
+	for i, tc := range tests {
+		merged := mergeEnv(tc.env, tc.vars)
+		if !reflect.DeepEqual(merged, tc.expected) {
+			t.Fatalf("[%v] env: %v vars: %v, want: %v got: %v", i, tc.env, tc.vars, tc.expected, merged)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+const jobPollInterval = time.Millisecond * 500
+
+// fs builtins run through fs calls and their flags
+var fsBuiltins = map[string]string{
+	"mkdir": "p",
+	"rm":    "rRf",
+	"cp":    "rR",
+	"chmod": "R",
+	"chown": "R",
+	"echo":  "n",
+}
+
+// IsFsBuiltin reports whether the command is run by Builtin.
+func IsFsBuiltin(command string) bool {
+	_, ok := fsBuiltins[command]
+	return ok
+}
+
+// Builtin runs the fs builtin and returns its output. Recursive calls run
+// as jobs on the server, fn if set is called with their progress. The job
+// is canceled if ctx is done.
+func (sh *Shell) Builtin(ctx context.Context, command string, args []string, fn func(job *api.Job)) (string, error) {
+	valid, ok := fsBuiltins[command]
+	if !ok {
+		return "", fmt.Errorf("%s: not a builtin", command)
+	}
+	if command == "echo" {
+		// the other args are text
+		return sh.Echo(args)
+	}
+
+	flags := make(map[rune]bool)
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, c := range args[0][1:] {
+			if !strings.ContainsRune(valid, c) {
+				return "", fmt.Errorf("%s: invalid option: -%c", command, c)
+			}
+			flags[c] = true
+		}
+		args = args[1:]
+	}
+	recursive := flags['r'] || flags['R'] || flags['p']
+
+	min := 1
+	switch command {
+	case "cp", "chmod", "chown":
+		min = 2
+	}
+	if len(args) < min {
+		return "", fmt.Errorf("%s: missing operand", command)
+	}
+
+	var err error
+	switch command {
+	case "mkdir":
+		for _, p := range args {
+			if err = sh.Mkdir(p, 0755, recursive); err != nil {
+				break
+			}
+		}
+	case "rm":
+		for _, p := range args {
+			err = sh.Remove(ctx, p, recursive, fn)
+			if flags['f'] && err == syscall.ENOENT {
+				err = nil
+			}
+			if err != nil {
+				break
+			}
+		}
+	case "cp":
+		err = sh.Copy(ctx, args[0], args[1], recursive, fn)
+	case "chmod":
+		var mode uint64
+		if mode, err = strconv.ParseUint(args[0], 8, 32); err != nil {
+			return "", fmt.Errorf("%s: invalid mode: %q", command, args[0])
+		}
+		for _, p := range args[1:] {
+			if err = sh.Chmod(ctx, p, uint32(mode), recursive, fn); err != nil {
+				break
+			}
+		}
+	case "chown":
+		var uid, gid int
+		if _, err = fmt.Sscanf(args[0], "%d:%d", &uid, &gid); err != nil {
+			return "", fmt.Errorf("%s: invalid owner: %q", command, args[0])
+		}
+		for _, p := range args[1:] {
+			if err = sh.Chown(ctx, p, uid, gid, recursive, fn); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", command, err)
+	}
+	return "", nil
+}
+
+// Echo returns the args joined with spaces and a newline unless the first
+// arg is -n. With a redirect "> file" or ">file", the text atomically
+// replaces the file instead.
+func (sh *Shell) Echo(args []string) (string, error) {
+	newline := "\n"
+	if len(args) > 0 && args[0] == "-n" {
+		newline = ""
+		args = args[1:]
+	}
+
+	var words []string
+	var target string
+	for i := 0; i < len(args); i++ {
+		v := args[i]
+		switch {
+		case v == ">":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("echo: missing redirect target")
+			}
+			i++
+			target = args[i]
+		case strings.HasPrefix(v, ">>"):
+			return "", fmt.Errorf("echo: unsupported redirect: %q", v)
+		case strings.HasPrefix(v, ">"):
+			target = v[1:]
+		default:
+			words = append(words, v)
+		}
+	}
+
+	text := strings.Join(words, " ") + newline
+	if target == "" {
+		return text, nil
+	}
+	var st syscall.Stat_t
+	if _, err := sh.c.Put(sh.abs(target), strings.NewReader(text), int64(len(text)), nil, &st); err != nil {
+		return "", fmt.Errorf("echo: %v", err)
+	}
+	return "", nil
+}
+
+// Mkdir creates the directory, along with any missing parents if set.
+func (sh *Shell) Mkdir(p string, mode uint32, parents bool) error {
+	var st syscall.Stat_t
+	if parents {
+		return sh.c.MkdirAll(sh.abs(p), mode, &st)
+	}
+	return sh.c.Mkdir(sh.abs(p), mode, &st)
+}
+
+// Remove removes the file, or the directory tree if recursive is set.
+func (sh *Shell) Remove(ctx context.Context, p string, recursive bool, fn func(job *api.Job)) error {
+	if !recursive {
+		return sh.c.Unlink(sh.abs(p))
+	}
+	var job api.Job
+	if err := sh.c.RemoveAll(sh.abs(p), &job); err != nil {
+		return err
+	}
+	return sh.wait(ctx, &job, fn)
+}
+
+// Copy copies the file, or the directory tree if recursive is set. The
+// source is copied into the destination if that is a directory.
+func (sh *Shell) Copy(ctx context.Context, from, to string, recursive bool, fn func(job *api.Job)) error {
+	from = sh.abs(from)
+	to = sh.abs(to)
+
+	var st syscall.Stat_t
+	exists := sh.c.Stat(to, &st) == nil
+	if exists && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		to = path.Join(to, path.Base(from))
+		exists = sh.c.Stat(to, &st) == nil
+	}
+
+	if !recursive {
+		if err := sh.c.Stat(from, &st); err != nil {
+			return err
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			return syscall.EISDIR
+		}
+		// replaced atomically, a new file gets the mode of the source
+		opts := &api.PutOptions{
+			From: from,
+		}
+		if !exists {
+			perm := uint32(st.Mode) & 0777
+			opts.Perm = &perm
+		}
+		_, err := sh.c.Put(to, nil, 0, opts, &st)
+		return err
+	}
+	var job api.Job
+	if err := sh.c.CopyAll(from, to, &job); err != nil {
+		return err
+	}
+	return sh.wait(ctx, &job, fn)
+}
+
+// Chmod changes the mode of the file, or of the tree if recursive is set.
+func (sh *Shell) Chmod(ctx context.Context, p string, mode uint32, recursive bool, fn func(job *api.Job)) error {
+	if !recursive {
+		return sh.c.Chmod(sh.abs(p), mode)
+	}
+	var job api.Job
+	if err := sh.c.ChmodAll(sh.abs(p), mode, &job); err != nil {
+		return err
+	}
+	return sh.wait(ctx, &job, fn)
+}
+
+// Chown changes the owner of the file, or of the tree if recursive is set.
+func (sh *Shell) Chown(ctx context.Context, p string, uid, gid int, recursive bool, fn func(job *api.Job)) error {
+	if !recursive {
+		return sh.c.Chown(sh.abs(p), uid, gid)
+	}
+	var job api.Job
+	if err := sh.c.ChownAll(sh.abs(p), uid, gid, &job); err != nil {
+		return err
+	}
+	return sh.wait(ctx, &job, fn)
+}
+
+func (sh *Shell) wait(ctx context.Context, job *api.Job, fn func(job *api.Job)) error {
+	_, err := sh.c.WaitJob(ctx, job.ID, jobPollInterval, fn)
+	return err
+}
+
+// abs resolves the path against the working dir.
+func (sh *Shell) abs(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return p
+	}
+	return path.Join(sh.Pwd(), p)
+}
@@ -17,6 +17,9 @@ type Shell struct {
 
 	cwd string
 	env []string
+
+	// server side session, cwd and env are kept on the server if set
+	session string
 }
 
 func New(baseUrl string) (*Shell, error) {
@@ -59,51 +62,177 @@ var builtins = []string{
 	"cat",
 }
 
+// Attach binds the shell to the server side session of id.
+func (sh *Shell) Attach(id string) error {
+	var s api.Session
+	if err := sh.c.Session(id, &s); err != nil {
+		return err
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.session = s.ID
+	sh.cwd = s.Cwd
+	sh.env = s.Env
+	return nil
+}
+
+// NewSession creates a server side session and attaches the shell to it.
+func (sh *Shell) NewSession(timeout int64) (*api.Session, error) {
+	var s api.Session
+	err := sh.c.CreateSession(&api.Session{
+		Cwd:     sh.Pwd(),
+		Env:     sh.Env(),
+		Timeout: timeout,
+	}, &s)
+	if err != nil {
+		return nil, err
+	}
+	if err := sh.Attach(s.ID); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sh *Shell) Sessions() ([]api.Session, error) {
+	var result []api.Session
+	err := sh.c.Sessions(&result)
+	return result, err
+}
+
+func (sh *Shell) CloseSession(id string) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if id == sh.session {
+		sh.session = ""
+	}
+	return sh.c.CloseSession(id)
+}
+
 func (sh *Shell) Env() []string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.session != "" {
+		var s api.Session
+		if err := sh.c.Session(sh.session, &s); err == nil {
+			sh.env = s.Env
+		}
+	}
 	return sh.env
 }
 
-func (sh *Shell) Export(env []string) {
+func (sh *Shell) Export(env []string) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.session != "" {
+		return sh.sessionBuiltin("export", env...)
+	}
 	sh.env = env
+	return nil
+}
+
+// sessionBuiltin runs a builtin in the session.
+func (sh *Shell) sessionBuiltin(command string, args ...string) error {
+	var result api.RunResult
+	err := sh.c.SessionExec(sh.session, &api.RunReq{
+		Command: command,
+		Args:    args,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if result.Status != 0 {
+		return fmt.Errorf("%s: %s", command, result.Error)
+	}
+	return nil
 }
 
 // Wait polls the status of the process of id at interval until timeout.
-// Any errors will be ignored before the timeout is reached.
+// The lease of the process, if any, is renewed at half of it, failing if
+// it can not be. Other errors will be ignored before the timeout is reached.
 // Result of the last poll will be returned.
 func (sh *Shell) Wait(id string, states []api.RunState, timeout int64, interval int64) (*api.Proc, error) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	defer ticker.Stop()
 
+	expired := time.After(time.Duration(timeout) * time.Second)
+
+	// set once the lease is known from the first poll
+	var heartbeat <-chan time.Time
+
+	// polled right away for the lease
+	poll := make(chan time.Time, 1)
+	poll <- time.Now()
+
 	for {
 		select {
+		case <-poll:
 		case <-ticker.C:
-			var r api.Proc
-			if err := sh.c.Ps1(id, &r); err != nil {
-				if _, ok := err.(api.ErrorNotFound); ok {
-					return nil, err
-				}
-				// continue for other types of errors
-			}
-			for _, s := range states {
-				if r.State == s {
-					return &r, nil
-				}
+		case <-heartbeat:
+			if err := sh.c.Heartbeat(id); err != nil {
+				return nil, fmt.Errorf("heartbeat: %w", err)
 			}
-		case <-time.After(time.Duration(timeout) * time.Second):
+			continue
+		case <-expired:
 			return nil, fmt.Errorf("timed out after %v seconds", timeout)
 		}
+
+		var r api.Proc
+		if err := sh.c.Ps1(id, &r); err != nil {
+			if _, ok := err.(api.ErrorNotFound); ok {
+				return nil, err
+			}
+			// continue for other types of errors
+		}
+		for _, s := range states {
+			if r.State == s {
+				return &r, nil
+			}
+		}
+		if r.Lease > 0 && heartbeat == nil {
+			t := time.NewTicker(time.Duration(r.Lease) * time.Second / 2)
+			defer t.Stop()
+			heartbeat = t.C
+		}
 	}
 }
 
 func (sh *Shell) Exec(req api.RunReq) (*api.RunResult, error) {
-	req.Dir = sh.cwd
-	req.Env = sh.env
-
 	var result api.RunResult
+
+	// not held while running
+	sh.mu.Lock()
+	session, cwd, env := sh.session, sh.cwd, sh.env
+	sh.mu.Unlock()
+
+	if session != "" {
+		err := sh.c.SessionExec(session, &req, &result)
+		return &result, err
+	}
+
+	req.Dir = cwd
+	req.Env = env
+
 	err := sh.c.Exec(&req, &result)
 	return &result, err
 }
 
+func (sh *Shell) Templates() ([]api.TemplateInfo, error) {
+	var result []api.TemplateInfo
+	err := sh.c.Templates(&result)
+	return result, err
+}
+
+func (sh *Shell) ExecTemplate(name string, req api.TemplateReq) (*api.RunResult, error) {
+	var result api.RunResult
+	err := sh.c.ExecTemplate(name, &req, &result)
+	return &result, err
+}
+
 func (sh *Shell) Ps(ids ...string) ([]api.Proc, error) {
 	if len(ids) == 1 {
 		var result api.Proc
@@ -161,6 +290,12 @@ func (sh *Shell) Pwd() string {
 	sh.mu.Lock()
 	defer sh.mu.Unlock()
 
+	if sh.session != "" {
+		var s api.Session
+		if err := sh.c.Session(sh.session, &s); err == nil {
+			sh.cwd = s.Cwd
+		}
+	}
 	return sh.cwd
 }
 
@@ -168,6 +303,10 @@ func (sh *Shell) Chdir(s string) error {
 	sh.mu.Lock()
 	defer sh.mu.Unlock()
 
+	if sh.session != "" {
+		return sh.sessionBuiltin("cd", s)
+	}
+
 	dir := sh.resolvePath(s)
 
 	err := sh.c.Opendir(dir)
@@ -0,0 +1,47 @@
+package shell
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dhnt/nomad/api"
+)
+
+func TestWaitLease(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test...")
+	}
+
+	sh, err := New("http://localhost:58080/")
+	if err != nil {
+		t.FailNow()
+	}
+	done := []api.RunState{api.Done, api.Failed}
+
+	// killed once the lease expires
+	r, err := sh.Exec(api.RunReq{Command: "sleep", Args: []string{"10"}, Background: true, Lease: 1})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	time.Sleep(3 * time.Second)
+	ps, err := sh.Ps(r.ID)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if ps[0].State != api.Failed {
+		t.Fatalf("expired: %+v", ps[0])
+	}
+
+	// renewed while waiting, polled less often than the lease
+	r, err = sh.Exec(api.RunReq{Command: "sleep", Args: []string{"3"}, Background: true, Lease: 1})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	p, err := sh.Wait(r.ID, done, 10, 4)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if p.State != api.Done {
+		t.Fatalf("renewed: %+v", p)
+	}
+}